@@ -6,11 +6,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"ton-storage-s3-cli/internal/api"
 	"ton-storage-s3-cli/internal/config"
 	"ton-storage-s3-cli/internal/daemons"
 	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/s3"
+	"ton-storage-s3-cli/internal/staging"
 	"ton-storage-s3-cli/internal/ton"
 )
 
@@ -43,6 +46,20 @@ func main() {
 
 	log.Println("✅ Database connected")
 
+	providerKeys := make([]string, 0, len(cfg.Providers))
+	for _, addr := range cfg.Providers {
+		key, err := ton.ParseProviderKey(addr)
+		if err != nil {
+			log.Fatalf("❌ PROVIDERS: %v", err)
+		}
+		providerKeys = append(providerKeys, key)
+	}
+	if added, err := db.AddProviders(ctx, providerKeys, "config"); err != nil {
+		log.Fatalf("❌ Failed to add configured providers: %v", err)
+	} else if added > 0 {
+		log.Printf("✅ Added %d configured providers", added)
+	}
+
 	tonSvc, err := ton.NewService(
 		ctx,
 		cfg.WalletSeed,
@@ -55,18 +72,56 @@ func main() {
 	}
 	log.Println("✅ TON Service initialized")
 
+	store := staging.NewStore(cfg.DownloadsPath)
+
 	if err := tonSvc.StartSeeding(ctx); err != nil {
 		log.Printf("⚠️ Warning: Failed to resume seeding: %v", err)
 	}
 
+	discoveryInterval := time.Duration(cfg.ProviderProbeMinutes) * time.Minute
+	discoveryTask := func(ctx context.Context, id int, total int) {
+		daemons.RunDiscoveryWorker(ctx, id, total, db, tonSvc, discoveryInterval)
+	}
+	discoveryPool := daemons.NewPool(ctx, 1, discoveryTask)
+	discoveryPool.Start()
+	log.Println("✅ Started Provider Discovery")
+
+	funding := ton.Funding{Days: cfg.StorageDays, MaxNano: cfg.MaxFundingNano}
 	replicatorTask := func(ctx context.Context, id int, total int) {
-		daemons.RunReplicatorWorker(ctx, id, total, db, tonSvc)
+		daemons.RunReplicatorWorker(ctx, id, total, db, tonSvc, funding)
 	}
 
 	replicatorPool := daemons.NewPool(ctx, cfg.ReplicatorWorkers, replicatorTask)
 	replicatorPool.Start()
 	log.Printf("✅ Started Replicator Pool (%d workers)", cfg.ReplicatorWorkers)
 
+	keeperCfg := daemons.KeeperConfig{
+		Interval:       time.Duration(cfg.BalanceCheckMinutes) * time.Minute,
+		Funding:        funding,
+		TopUpBelowDays: cfg.TopUpBelowDays,
+	}
+	keeperTask := func(ctx context.Context, id int, total int) {
+		daemons.RunKeeperWorker(ctx, id, total, db, tonSvc, keeperCfg)
+	}
+	keeperPool := daemons.NewPool(ctx, 1, keeperTask)
+	keeperPool.Start()
+	log.Println("✅ Started Balance Keeper")
+
+	teardownTask := func(ctx context.Context, id int, total int) {
+		daemons.RunTeardownWorker(ctx, id, total, db, tonSvc)
+	}
+	teardownPool := daemons.NewPool(ctx, 1, teardownTask)
+	teardownPool.Start()
+	log.Println("✅ Started Contract Teardown")
+
+	sweepInterval := time.Duration(cfg.SweepHours) * time.Hour
+	sweeperTask := func(ctx context.Context, id int, total int) {
+		daemons.RunSweeperWorker(ctx, id, total, db, tonSvc, sweepInterval)
+	}
+	sweeperPool := daemons.NewPool(ctx, 1, sweeperTask)
+	sweeperPool.Start()
+	log.Println("✅ Started Contract Sweeper")
+
 	auditorTask := func(ctx context.Context, id int, total int) {
 		daemons.RunAuditorWorker(ctx, id, total, db, tonSvc)
 	}
@@ -84,8 +139,9 @@ func main() {
 
 	log.Printf("✅ Started Pinger Pool (%d workers)", cfg.PingerWorkers)
 
+	pieceCacheTTL := time.Duration(cfg.PieceCacheTTLHours) * time.Hour
 	cleanerTask := func(ctx context.Context, id int, total int) {
-		daemons.RunCleanerWorker(ctx, id, total, db, tonSvc)
+		daemons.RunCleanerWorker(ctx, id, total, db, tonSvc, store, pieceCacheTTL)
 	}
 	
 	cleanerPool := daemons.NewPool(ctx, cfg.CleanerWorkers, cleanerTask)
@@ -93,8 +149,33 @@ func main() {
 	cleanerPool.Start()
 	log.Println("✅ Started Cleaner Pool")
 
-	s3Server := api.NewS3Server(db, tonSvc, cfg.DownloadsPath)
-	adminServer := api.NewAdminServer(db, tonSvc)
+	multipartMaxAge := time.Duration(cfg.MultipartMaxAgeHours) * time.Hour
+	multipartTask := func(ctx context.Context, id int, total int) {
+		daemons.RunMultipartCleanerWorker(ctx, id, total, db, store, multipartMaxAge)
+	}
+	multipartPool := daemons.NewPool(ctx, 1, multipartTask)
+	multipartPool.Start()
+	log.Println("✅ Started Multipart GC")
+
+	packerCfg := daemons.PackerConfig{
+		MinObjects:  cfg.PackMinObjects,
+		MaxWait:     time.Duration(cfg.PackMaxWaitMinutes) * time.Minute,
+		LivePercent: cfg.RepackLivePercent,
+	}
+	packerTask := func(ctx context.Context, id int, total int) {
+		daemons.RunPackerWorker(ctx, id, total, db, tonSvc, store, packerCfg)
+	}
+	packerPool := daemons.NewPool(ctx, 1, packerTask)
+	packerPool.Start()
+	log.Println("✅ Started Packer")
+
+	s3Server := api.NewS3Server(db, tonSvc, store, s3.Options{
+		PackMaxSize:     int64(cfg.PackMaxObjectSize),
+		StripeSize:      int64(cfg.StripeSizeMB) << 20,
+		MasterKey:       cfg.SSEMasterKey,
+		DefaultReplicas: cfg.DefaultReplicas,
+	})
+	adminServer := api.NewAdminServer(db, tonSvc, store, cfg.S3PublicURL, cfg.DefaultReplicas, funding)
 
 	go func() {
 		if err := s3Server.Start(cfg.ServerPort); err != nil {
@@ -119,12 +200,28 @@ func main() {
 		log.Println("🛑 Context cancelled. Shutting down...")
 	}
 
+	log.Println("Waiting for Provider Discovery to finish...")
+	discoveryPool.Stop()
+
 	log.Println("Waiting for Replicators to finish...")
 	replicatorPool.Stop()
 
 	log.Println("Waiting for Auditors to finish...")
 	auditorPool.Stop()
 
+	log.Println("Waiting for Balance Keeper to finish...")
+	keeperPool.Stop()
+
+	log.Println("Waiting for Contract Teardown to finish...")
+	teardownPool.Stop()
+	sweeperPool.Stop()
+
+	log.Println("Waiting for Multipart GC to finish...")
+	multipartPool.Stop()
+
+	log.Println("Waiting for Packer to finish...")
+	packerPool.Stop()
+
 	cancel()
 
 	log.Println("👋 Shutdown complete.")
@@ -2,6 +2,19 @@ module ton-storage-s3-cli
 
 go 1.25.3
 
+require (
+	github.com/gofiber/fiber/v2 v2.52.10
+	github.com/jackc/pgx/v5 v5.8.0
+	github.com/johannesboyne/gofakes3 v0.0.0-20250916175020-ebf3e50324d3
+	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.17.9
+	github.com/syndtr/goleveldb v1.0.0
+	github.com/xssnick/raptorq v1.3.0
+	github.com/xssnick/tonutils-go v1.15.4-0.20251203102642-124ac120fe14
+	github.com/xssnick/tonutils-storage v1.3.2
+	github.com/xssnick/tonutils-storage-provider v0.3.13
+)
+
 require (
 	atomicgo.dev/cursor v0.2.0 // indirect
 	atomicgo.dev/keyboard v0.2.9 // indirect
@@ -9,18 +22,13 @@ require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/containerd/console v1.0.5 // indirect
-	github.com/gofiber/fiber/v2 v2.52.10 // indirect
 	github.com/golang/snappy v1.0.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/gookit/color v1.5.4 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
-	github.com/jackc/pgx/v5 v5.8.0 // indirect
 	github.com/jackc/puddle/v2 v2.2.2 // indirect
-	github.com/johannesboyne/gofakes3 v0.0.0-20250916175020-ebf3e50324d3 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/kevinms/leakybucket-go v0.0.0-20200115003610-082473db97ca // indirect
-	github.com/klauspost/compress v1.17.9 // indirect
 	github.com/lithammer/fuzzysearch v1.1.8 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
@@ -29,17 +37,12 @@ require (
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/rs/zerolog v1.34.0 // indirect
 	github.com/ryszard/goskiplist v0.0.0-20150312221310-2dfbae5fcf46 // indirect
-	github.com/syndtr/goleveldb v1.0.0 // indirect
 	github.com/ton-blockchain/adnl-tunnel v0.1.8 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.51.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	github.com/xo/terminfo v0.0.0-20220910002029-abceb7e1c41e // indirect
-	github.com/xssnick/raptorq v1.3.0 // indirect
 	github.com/xssnick/ton-payment-network v1.2.3 // indirect
-	github.com/xssnick/tonutils-go v1.15.4-0.20251203102642-124ac120fe14 // indirect
-	github.com/xssnick/tonutils-storage v1.3.2 // indirect
-	github.com/xssnick/tonutils-storage-provider v0.3.13 // indirect
 	go.shabbyrobe.org/gocovmerge v0.0.0-20230507111327-fa4f82cfbf4d // indirect
 	golang.org/x/crypto v0.46.0 // indirect
 	golang.org/x/sync v0.19.0 // indirect
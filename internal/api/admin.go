@@ -1,8 +1,8 @@
 package api
 
 import (
-	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/bits"
@@ -11,22 +11,29 @@ import (
 	"strconv"
 
 	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/s3"
+	"ton-storage-s3-cli/internal/staging"
 	"ton-storage-s3-cli/internal/ton"
 	"ton-storage-s3-cli/internal/models"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/johannesboyne/gofakes3"
 )
 
 type AdminServer struct {
 	app    *fiber.App
 	db     *database.DB
 	tonSvc *ton.Service
+	store  *staging.Store
+	s3URL  string
+
+	defaultReplicas int
+	defaultFunding  ton.Funding
 }
 
-func NewAdminServer(db *database.DB, tonSvc *ton.Service) *AdminServer {
+func NewAdminServer(db *database.DB, tonSvc *ton.Service, store *staging.Store, s3URL string, defaultReplicas int, defaultFunding ton.Funding) *AdminServer {
 	app := fiber.New(fiber.Config{
 		DisableStartupMessage: true,
 		BodyLimit:             500 * 1024 * 1024,
@@ -41,6 +48,11 @@ func NewAdminServer(db *database.DB, tonSvc *ton.Service) *AdminServer {
 		app:    app,
 		db:     db,
 		tonSvc: tonSvc,
+		store:  store,
+		s3URL:  s3URL,
+
+		defaultReplicas: defaultReplicas,
+		defaultFunding:  defaultFunding,
 	}
 
 	s.registerRoutes()
@@ -66,8 +78,35 @@ func (s *AdminServer) registerRoutes() {
 	v1.Post("/files/:id/replicate", s.manualReplicate)
 	v1.Get("/files/:id/stats", s.getFileStats)
 
+	v1.Get("/buckets/:name/erasure", s.getBucketErasure)
+	v1.Put("/buckets/:name/erasure", s.setBucketErasure)
+	v1.Get("/buckets/:name/compression", s.getBucketCompression)
+	v1.Put("/buckets/:name/compression", s.setBucketCompression)
+	v1.Get("/buckets/:name/settings", s.getBucketSettings)
+	v1.Put("/buckets/:name/settings", s.setBucketSettings)
+
 	v1.Get("/contracts/:id/audit", s.auditContract)
 	v1.Post("/contracts/:id/withdraw", s.withdrawContract)
+	v1.Get("/contracts/:id/balance", s.contractBalance)
+	v1.Get("/funding", s.listFunding)
+	v1.Get("/funding/topups", s.listTopUps)
+	v1.Get("/teardowns", s.listTeardowns)
+	v1.Post("/teardowns/:id/retry", s.retryTeardown)
+
+	v1.Get("/keys", s.listKeys)
+	v1.Post("/keys", s.createKey)
+	v1.Patch("/keys/:key", s.updateKey)
+	v1.Delete("/keys/:key", s.deleteKey)
+	v1.Get("/keys/:key/grants", s.listGrants)
+	v1.Post("/keys/:key/grants", s.createGrant)
+	v1.Delete("/keys/:key/grants/:id", s.deleteGrant)
+
+	v1.Get("/providers", s.listProviders)
+	v1.Post("/providers", s.addProvider)
+	v1.Patch("/providers/:key", s.updateProvider)
+	v1.Delete("/providers/:key", s.deleteProvider)
+
+	v1.Post("/presign", s.presignURL)
 }
 
 func (s *AdminServer) getBagsStats(c *fiber.Ctx) error {
@@ -97,7 +136,29 @@ func (s *AdminServer) getFileDetails(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "File not found"})
 	}
 
-	contracts, err := s.db.GetFileContracts(c.Context(), id)
+	if file.Striped {
+		stripes, err := s.db.GetFileStripes(c.Context(), id)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load stripes"})
+		}
+
+		var contracts []models.Contract
+		for _, stripe := range stripes {
+			stripeContracts, err := s.db.GetBagContracts(c.Context(), stripe.BagID)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to load contracts"})
+			}
+			contracts = append(contracts, stripeContracts...)
+		}
+
+		return c.JSON(fiber.Map{
+			"file":      file,
+			"stripes":   stripes,
+			"contracts": contracts,
+		})
+	}
+
+	contracts, err := s.db.GetBagContracts(c.Context(), file.BagID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to load contracts"})
 	}
@@ -115,16 +176,29 @@ func (s *AdminServer) uploadFile(c *fiber.Ctx) error {
 	}
 
 	bucket := c.FormValue("bucket", "default")
-	replicas, _ := strconv.Atoi(c.FormValue("replicas", "3"))
 
 	if exists, _ := s.db.BucketExists(c.Context(), bucket); !exists {
 		s.db.CreateBucket(c.Context(), bucket)
 	}
 
-	uploadDir := "./var/downloads"
-	os.MkdirAll(uploadDir, 0755)
+	settings, err := s.db.GetBucketSettings(c.Context(), bucket)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	replicas, _ := strconv.Atoi(c.FormValue("replicas"))
+	if replicas <= 0 {
+		replicas = settings.DefaultReplicas
+	}
+	if replicas <= 0 {
+		replicas = max(1, s.defaultReplicas)
+	}
+
+	localPath, err := s.store.ObjectPath(bucket, fileHeader.Filename, "")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	os.MkdirAll(filepath.Dir(localPath), 0755)
 
-	localPath := filepath.Join(uploadDir, fileHeader.Filename)
 	if err := c.SaveFile(fileHeader, localPath); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to save file: " + err.Error()})
 	}
@@ -143,6 +217,11 @@ func (s *AdminServer) uploadFile(c *fiber.Ctx) error {
 		SizeBytes:      fileHeader.Size,
 		TargetReplicas: replicas,
 		Status:         "pending",
+		Metadata:       map[string]string{},
+	}
+
+	if ct := fileHeader.Header.Get("Content-Type"); ct != "" {
+		newFile.Metadata["Content-Type"] = ct
 	}
 
 	id, err := s.db.CreateFile(c.Context(), newFile)
@@ -166,9 +245,21 @@ func (s *AdminServer) downloadFile(c *fiber.Ctx) error {
 		return c.Status(404).SendString("File not found in DB")
 	}
 
+	if file.Striped {
+		return c.Status(409).JSON(fiber.Map{"error": "File is striped, download it through the S3 API"})
+	}
+	if file.Encryption != "" || file.Compression != "" {
+		return c.Status(409).JSON(fiber.Map{"error": "File is encrypted or compressed, download it through the S3 API"})
+	}
+
 	bagBytes, _ := hex.DecodeString(file.BagID)
 
-	filePath, err := s.tonSvc.GetPathToBagFile(bagBytes, file.ObjectKey)
+	var filePath string
+	if file.BagID == "" {
+		filePath, err = s.store.PackingPath(file.BagPath)
+	} else {
+		filePath, err = s.tonSvc.GetPathToBagFile(bagBytes, s3.BagPath(file))
+	}
 	if err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "File missing on server disk. Use /restore endpoint first.",
@@ -181,48 +272,36 @@ func (s *AdminServer) downloadFile(c *fiber.Ctx) error {
 
 func (s *AdminServer) restoreFile(c *fiber.Ctx) error {
 	id, _ := strconv.ParseInt(c.Params("id"), 10, 64)
+	days := c.QueryInt("days", 1)
 
 	file, err := s.db.GetFileByID(c.Context(), id)
 	if err != nil {
 		return c.Status(404).JSON(fiber.Map{"error": "File not found"})
 	}
 
-	bagBytes, err := hex.DecodeString(file.BagID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Invalid BagID in DB"})
+	if !file.Offloaded {
+		return c.JSON(fiber.Map{
+			"status":  "available",
+			"message": "File is stored locally",
+			"bag_id":  file.BagID,
+		})
 	}
 
-	jobID, err := s.db.StartDownloadJob(c.Context(), id)
+	jobID, err := s3.StartRestore(s.db, s.tonSvc, file, days)
+	var s3Err gofakes3.Error
+	if errors.As(err, &s3Err) && s3Err.ErrorCode() == s3.ErrRestoreAlreadyInProgress {
+		return c.Status(409).JSON(fiber.Map{"error": "Restore is already in progress"})
+	}
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "DB Error: " + err.Error()})
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	go func() {
-		ctx := context.Background()
-		log.Printf("📥 [Job %d] Restore started for %s", jobID, file.ObjectKey)
-		
-		if err := s.tonSvc.DownloadBag(ctx, bagBytes); err != nil {
-			log.Printf("❌ Restore init failed: %v", err)
-			s.db.FinishDownloadJob(ctx, jobID, false, err.Error())
-			return
-		}
-
-		_, err := s.tonSvc.WaitForFile(ctx, bagBytes, file.ObjectKey)
-		
-		if err == nil {
-			log.Printf("✅ [Job %d] Restore success: %s", jobID, file.ObjectKey)
-			s.db.FinishDownloadJob(ctx, jobID, true, "")
-		} else {
-			log.Printf("⚠️ [Job %d] Restore failed (timeout): %v", jobID, err)
-			s.db.FinishDownloadJob(ctx, jobID, false, err.Error())
-		}
-	}()
-
 	return c.JSON(fiber.Map{
 		"status":  "restore_started",
 		"job_id":  jobID,
 		"message": "Downloading from TON network...",
 		"bag_id":  file.BagID,
+		"days":    days,
 	})
 }
 
@@ -234,38 +313,66 @@ func (s *AdminServer) manualReplicate(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "File not found"})
 	}
 
-	contracts, _ := s.db.GetFileContracts(c.Context(), id)
+	if f.Striped {
+		return c.Status(409).JSON(fiber.Map{"error": "File is striped, its stripes or shards are replicated separately"})
+	}
+	if f.BagID == "" {
+		return c.Status(409).JSON(fiber.Map{"error": "File is waiting to be packed"})
+	}
+
+	contracts, _ := s.db.GetBagContracts(c.Context(), f.BagID)
 	excludes := make([]string, 0)
 	for _, contr := range contracts {
 		excludes = append(excludes, contr.ProviderAddr)
 	}
 
-	newProvider, err := s.tonSvc.FindRandomProvider(c.Context(), excludes)
+	settings, err := s.db.GetBucketSettings(c.Context(), f.BucketName)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	policy := ton.BucketPolicy(settings)
+
+	bag, err := s.db.GetBag(c.Context(), f.BagID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "No providers found: " + err.Error()})
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	candidates, err := s.db.ListHireableProviders(c.Context())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	newProvider, err := ton.SelectProvider(candidates, excludes, bag.SizeBytes, policy)
+	if err != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "No providers found: " + err.Error()})
 	}
 
 	bagBytes, _ := hex.DecodeString(f.BagID)
-	amount := tlb.MustFromTON("0.2")
+	funding := ton.BucketFunding(settings, s.defaultFunding)
 
-	contractAddr, err := s.tonSvc.HireProvider(c.Context(), bagBytes, newProvider, amount)
+	hire, err := s.tonSvc.HireProvider(c.Context(), bagBytes, newProvider, funding, policy.MaxRateNano)
+	if !errors.Is(err, ton.ErrRateTooHigh) && !errors.Is(err, ton.ErrSpendLimit) {
+		s.db.RecordProviderHire(c.Context(), newProvider, err == nil)
+	}
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Hire failed: " + err.Error()})
 	}
 
 	newC := &models.Contract{
-		FileID:       f.ID,
+		BagID:        f.BagID,
 		ProviderAddr: newProvider,
-		ContractAddr: contractAddr,
-		BalanceNano:  amount.Nano().Int64(),
+		ContractAddr: hire.ContractAddr,
+		BalanceNano:  hire.Amount.Nano().Int64(),
 		Status:       "pending", // ИСПРАВЛЕНО: Pending (ждем проверки аудитора)
+		ExpiresAt:    hire.ExpiresAt,
 	}
 	s.db.RegisterContract(c.Context(), newC)
 
 	return c.JSON(fiber.Map{
 		"status": "hired_pending", 
 		"provider": newProvider, 
-		"contract": contractAddr,
+		"contract": hire.ContractAddr,
+		"amount": hire.Amount.String(),
+		"expires_at": hire.ExpiresAt,
 	})
 }
 
@@ -367,14 +474,28 @@ func (s *AdminServer) deleteFile(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "File not found in DB"})
 	}
 
-	bagBytes, err := hex.DecodeString(file.BagID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Invalid BagID hex"})
+	bagIDs := []string{file.BagID}
+	if file.Striped {
+		stripes, err := s.db.GetFileStripes(c.Context(), id)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load stripes"})
+		}
+		bagIDs = bagIDs[:0]
+		for _, stripe := range stripes {
+			bagIDs = append(bagIDs, stripe.BagID)
+		}
 	}
 
-	if err := s.tonSvc.DeleteLocalFile(bagBytes); err != nil {
-		log.Printf("⚠️ Failed to delete local file %s: %v", file.BagID, err)
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete files: " + err.Error()})
+	for _, bagID := range bagIDs {
+		bagBytes, err := hex.DecodeString(bagID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Invalid BagID hex"})
+		}
+
+		if err := s.tonSvc.DeleteLocalFile(bagBytes); err != nil {
+			log.Printf("⚠️ Failed to delete local file %s: %v", bagID, err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete files: " + err.Error()})
+		}
 	}
 
 	log.Printf("🗑️ File %s (ID: %d) deleted via API", file.BagID, id)
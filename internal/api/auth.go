@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/sigv4"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/johannesboyne/gofakes3"
+)
+
+// withAuth rejects S3 requests that are not signed with a key from api_keys
+// or that the key's grants do not allow. CORS preflight requests carry no
+// credentials and are passed through.
+func withAuth(db *database.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+
+		var key *models.APIKey
+		lookup := func(accessKey string) (string, error) {
+			k, err := db.GetAPIKey(ctx, accessKey)
+			if errors.Is(err, pgx.ErrNoRows) {
+				return "", sigv4.ErrInvalidAccessKeyID
+			}
+			if err != nil {
+				return "", err
+			}
+			key = k
+			return k.SecretKey, nil
+		}
+
+		creds, err := sigv4.Verify(r, time.Now(), lookup)
+		if err != nil {
+			writeAuthError(w, r, err)
+			return
+		}
+
+		payload, err := sigv4.WrapPayload(r, creds)
+		if err != nil {
+			writeAuthError(w, r, err)
+			return
+		}
+		if payload != nil {
+			w = &payloadErrorWriter{ResponseWriter: w, r: r, payload: payload}
+		}
+
+		if err := authorize(ctx, db, r, key); err != nil {
+			writeAuthError(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func authorize(ctx context.Context, db *database.DB, r *http.Request, key *models.APIKey) error {
+	if key.IsAdmin {
+		return nil
+	}
+
+	grants, err := db.ListAPIKeyGrants(ctx, key.AccessKey)
+	if err != nil {
+		return fmt.Errorf("DB error: %w", err)
+	}
+
+	access, err := requiredAccess(r)
+	if err != nil {
+		return err
+	}
+	for _, a := range access {
+		if !allowed(key, grants, a) {
+			return sigv4.ErrAccessDenied
+		}
+	}
+	return nil
+}
+
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	var authErr *sigv4.Error
+	if !errors.As(err, &authErr) {
+		log.Printf("❌ S3 auth error for %s %s: %v", r.Method, r.URL.Path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔒 S3 request denied: %s %s: %s", r.Method, r.URL.Path, authErr.Code)
+	writeError(w, r, authErr.Status, gofakes3.ErrorCode(authErr.Code), authErr.Message)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code gofakes3.ErrorCode, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(&gofakes3.ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// payloadErrorWriter replaces the response with the proper S3 error when the
+// body failed signature verification: gofakes3 would report it as an
+// internal error.
+type payloadErrorWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	payload *sigv4.Payload
+	failed  bool
+}
+
+func (w *payloadErrorWriter) WriteHeader(status int) {
+	if err := w.payload.Err(); err != nil && status >= http.StatusBadRequest {
+		w.failed = true
+		writeAuthError(w.ResponseWriter, w.r, err)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *payloadErrorWriter) Write(b []byte) (int, error) {
+	if w.failed {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
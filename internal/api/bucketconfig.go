@@ -0,0 +1,176 @@
+package api
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"ton-storage-s3-cli/internal/s3"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+const maxBucketConfigSize = 64 << 10
+
+type bucketTagging struct {
+	XMLName xml.Name    `xml:"Tagging"`
+	Xmlns   string      `xml:"xmlns,attr,omitempty"`
+	TagSet  []bucketTag `xml:"TagSet>Tag"`
+}
+
+type bucketTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type encryptionConfiguration struct {
+	XMLName xml.Name         `xml:"ServerSideEncryptionConfiguration"`
+	Xmlns   string           `xml:"xmlns,attr,omitempty"`
+	Rules   []encryptionRule `xml:"Rule"`
+}
+
+type encryptionRule struct {
+	SSEAlgorithm string `xml:"ApplyServerSideEncryptionByDefault>SSEAlgorithm"`
+}
+
+// withBucketConfig serves the tagging and default encryption of buckets, which
+// gofakes3 does not route. Both are views of the bucket settings: see
+// s3.PutBucketTagging.
+func withBucketConfig(backend *s3.TonBackend, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, object, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		query := r.URL.Query()
+
+		if bucket == "" || object != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch {
+		case query.Has("tagging"):
+			serveBucketTagging(backend, w, r, bucket)
+		case query.Has("encryption"):
+			serveBucketEncryption(backend, w, r, bucket)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func serveBucketTagging(backend *s3.TonBackend, w http.ResponseWriter, r *http.Request, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+		tags, err := backend.GetBucketTagging(bucket)
+		if err != nil {
+			writeBackendError(w, r, err)
+			return
+		}
+		if len(tags) == 0 {
+			writeBackendError(w, r, gofakes3.ErrorMessage(s3.ErrNoSuchTagSet, "The TagSet does not exist"))
+			return
+		}
+
+		out := bucketTagging{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/"}
+		for k, v := range tags {
+			out.TagSet = append(out.TagSet, bucketTag{Key: k, Value: v})
+		}
+		slices.SortFunc(out.TagSet, func(a, b bucketTag) int { return strings.Compare(a.Key, b.Key) })
+		writeXML(w, &out)
+
+	case http.MethodPut:
+		var in bucketTagging
+		if err := readXML(r, &in); err != nil {
+			writeBackendError(w, r, err)
+			return
+		}
+		tags := map[string]string{}
+		for _, tag := range in.TagSet {
+			if _, dup := tags[tag.Key]; dup {
+				writeBackendError(w, r, gofakes3.ErrorMessage(s3.ErrInvalidTag, "Cannot provide multiple Tags with the same key"))
+				return
+			}
+			tags[tag.Key] = tag.Value
+		}
+		if err := backend.PutBucketTagging(bucket, tags); err != nil {
+			writeBackendError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := backend.PutBucketTagging(bucket, nil); err != nil {
+			writeBackendError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeBackendError(w, r, gofakes3.ErrMethodNotAllowed)
+	}
+}
+
+func serveBucketEncryption(backend *s3.TonBackend, w http.ResponseWriter, r *http.Request, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+		algorithm, err := backend.GetBucketEncryption(bucket)
+		if err != nil {
+			writeBackendError(w, r, err)
+			return
+		}
+		if algorithm == "" {
+			writeBackendError(w, r, gofakes3.ErrorMessage(s3.ErrNoEncryptionConfig,
+				"The server side encryption configuration was not found"))
+			return
+		}
+		writeXML(w, &encryptionConfiguration{
+			Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/",
+			Rules: []encryptionRule{{SSEAlgorithm: algorithm}},
+		})
+
+	case http.MethodPut:
+		var in encryptionConfiguration
+		if err := readXML(r, &in); err != nil {
+			writeBackendError(w, r, err)
+			return
+		}
+		if len(in.Rules) != 1 {
+			writeBackendError(w, r, gofakes3.ErrorMessage(gofakes3.ErrMalformedXML, "Exactly one encryption rule is expected."))
+			return
+		}
+		if err := backend.PutBucketEncryption(bucket, in.Rules[0].SSEAlgorithm); err != nil {
+			writeBackendError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodDelete:
+		if err := backend.PutBucketEncryption(bucket, ""); err != nil {
+			writeBackendError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeBackendError(w, r, gofakes3.ErrMethodNotAllowed)
+	}
+}
+
+func readXML(r *http.Request, v any) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBucketConfigSize))
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(body, v); err != nil {
+		return gofakes3.ErrorMessage(gofakes3.ErrMalformedXML, err.Error())
+	}
+	return nil
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
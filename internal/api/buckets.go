@@ -0,0 +1,118 @@
+package api
+
+import (
+	"ton-storage-s3-cli/internal/compress"
+	"ton-storage-s3-cli/internal/erasure"
+	"ton-storage-s3-cli/internal/s3"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type bucketErasureRequest struct {
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+}
+
+type bucketCompressionRequest struct {
+	Codec string `json:"codec"`
+}
+
+func (s *AdminServer) getBucketErasure(c *fiber.Ctx) error {
+	data, parity, err := s.db.GetBucketErasure(c.Context(), c.Params("name"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+	return c.JSON(fiber.Map{"data_shards": data, "parity_shards": parity})
+}
+
+// setBucketErasure sets the erasure code objects uploaded to a bucket from now
+// on are stored with. 0 data shards switches back to full replicas; objects
+// already stored keep their layout.
+func (s *AdminServer) setBucketErasure(c *fiber.Ctx) error {
+	var req bucketErasureRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON: " + err.Error()})
+	}
+
+	if req.DataShards != 0 || req.ParityShards != 0 {
+		if _, err := erasure.New(req.DataShards, req.ParityShards); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	found, err := s.db.SetBucketErasure(c.Context(), c.Params("name"), req.DataShards, req.ParityShards)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+
+	return c.JSON(fiber.Map{"data_shards": req.DataShards, "parity_shards": req.ParityShards})
+}
+
+func (s *AdminServer) getBucketCompression(c *fiber.Ctx) error {
+	codec, err := s.db.GetBucketCompression(c.Context(), c.Params("name"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+	return c.JSON(fiber.Map{"codec": codec})
+}
+
+// setBucketCompression sets the codec objects uploaded to a bucket from now
+// on are compressed with, "" for none; objects already stored are kept as
+// they are.
+func (s *AdminServer) setBucketCompression(c *fiber.Ctx) error {
+	var req bucketCompressionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON: " + err.Error()})
+	}
+	if req.Codec != "" && !compress.Valid(req.Codec) {
+		return c.Status(400).JSON(fiber.Map{"error": "Unknown codec, use zstd or gzip"})
+	}
+
+	found, err := s.db.SetBucketCompression(c.Context(), c.Params("name"), req.Codec)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+
+	return c.JSON(fiber.Map{"codec": req.Codec})
+}
+
+func (s *AdminServer) getBucketSettings(c *fiber.Ctx) error {
+	settings, err := s.db.GetBucketSettings(c.Context(), c.Params("name"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+	return c.JSON(settings)
+}
+
+// setBucketSettings updates the settings of a bucket with the fields of the
+// request; fields left out keep their values. Defaults for new objects apply
+// to objects uploaded from now on, the provider and offload policies to every
+// bag of the bucket.
+func (s *AdminServer) setBucketSettings(c *fiber.Ctx) error {
+	settings, err := s.db.GetBucketSettings(c.Context(), c.Params("name"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+	if err := c.BodyParser(settings); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON: " + err.Error()})
+	}
+	if err := s3.CheckBucketSettings(settings); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	found, err := s.db.SetBucketSettings(c.Context(), c.Params("name"), settings)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Bucket not found"})
+	}
+
+	return c.JSON(settings)
+}
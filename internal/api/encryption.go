@@ -0,0 +1,124 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ton-storage-s3-cli/internal/s3"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// withEncryption reports the server-side encryption of uploads and serves
+// reads of objects encrypted with SSE-C keys, which gofakes3 has no way to
+// pass to the backend. Reads of such objects without their key are rejected.
+func withEncryption(backend *s3.TonBackend, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, object, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		query := r.URL.Query()
+
+		if object == "" || query.Has("uploadId") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPut && len(query) == 0,
+			r.Method == http.MethodPost && query.Has("uploads"):
+			headers, err := backend.UploadEncryptionHeaders(bucket, r.Header)
+			if err != nil {
+				writeBackendError(w, r, err)
+				return
+			}
+			for k, v := range headers {
+				w.Header().Set(k, v)
+			}
+
+		case r.Method == http.MethodGet, r.Method == http.MethodHead:
+			versionID := query.Get("versionId")
+			key, err := s3.ParseCustomerKey(r.Header.Get, "")
+			if err == nil && key == nil {
+				err = backend.CheckCustomerKey(bucket, object, versionID)
+			}
+			if err != nil {
+				writeBackendError(w, r, err)
+				return
+			}
+			if key != nil {
+				serveWithKey(backend, w, r, bucket, object, versionID, key)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// keyedObjects reads object versions encrypted with an SSE-C key, as
+// TonBackend does.
+type keyedObjects interface {
+	GetObjectWithKey(bucketName, objectName, versionID, rangeHeader string, key *s3.CustomerKey) (*gofakes3.Object, error)
+	HeadObjectWithKey(bucketName, objectName, versionID string, key *s3.CustomerKey) (*gofakes3.Object, error)
+}
+
+// serveWithKey answers a GET or HEAD of an object read with an SSE-C key, or
+// without one if key is nil, as gofakes3 answers other reads.
+func serveWithKey(backend keyedObjects, w http.ResponseWriter, r *http.Request, bucket, object, versionID string, key *s3.CustomerKey) {
+	var obj *gofakes3.Object
+	var err error
+	if r.Method == http.MethodHead {
+		obj, err = backend.HeadObjectWithKey(bucket, object, versionID, key)
+	} else {
+		obj, err = backend.GetObjectWithKey(bucket, object, versionID, r.Header.Get("Range"), key)
+	}
+	if err != nil {
+		writeBackendError(w, r, err)
+		return
+	}
+	defer obj.Contents.Close()
+
+	if obj.VersionID != "" {
+		w.Header().Set("x-amz-version-id", string(obj.VersionID))
+	}
+	if obj.IsDeleteMarker {
+		w.Header().Set("x-amz-delete-marker", "true")
+		writeBackendError(w, r, gofakes3.KeyNotFound(object))
+		return
+	}
+
+	for k, v := range obj.Metadata {
+		w.Header().Set(k, v)
+	}
+	etag := gofakes3.FormatETag(obj.Hash)
+	w.Header().Set("ETag", etag)
+
+	lastModified, _ := time.Parse(http.TimeFormat, obj.Metadata["Last-Modified"])
+	ifModifiedSince, _ := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since"))
+	if r.Header.Get("If-None-Match") == etag || (!lastModified.IsZero() && !ifModifiedSince.Before(lastModified)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	status := http.StatusOK
+	if rng := obj.Range; rng != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.Start, rng.Start+rng.Length-1, obj.Size))
+		w.Header().Set("Content-Length", strconv.FormatInt(rng.Length, 10))
+		status = http.StatusPartialContent
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	}
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, obj.Contents); err != nil {
+		log.Printf("❌ Failed to send %s/%s: %v", bucket, object, err)
+	}
+}
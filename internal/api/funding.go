@@ -0,0 +1,63 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultTopUpsLimit = 100
+
+// listFunding lists the storage contracts with their balances and the dates
+// they run out, as last read by the balance keeper.
+func (s *AdminServer) listFunding(c *fiber.Ctx) error {
+	contracts, err := s.db.ListContractFunding(c.Context(), 1, 0)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(contracts)
+}
+
+// listTopUps lists the latest top-ups, of one contract with ?contract=.
+func (s *AdminServer) listTopUps(c *fiber.Ctx) error {
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultTopUpsLimit)))
+	if err != nil || limit <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid limit"})
+	}
+
+	topUps, err := s.db.ListTopUps(c.Context(), c.Query("contract"), limit)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(topUps)
+}
+
+// contractBalance reads the balance of the storage contract of a contract row
+// from the chain right away.
+func (s *AdminServer) contractBalance(c *fiber.Ctx) error {
+	id, _ := strconv.ParseInt(c.Params("id"), 10, 64)
+
+	contract, err := s.db.GetContractByID(c.Context(), id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Contract not found"})
+	}
+
+	state, err := s.tonSvc.FetchContractState(c.Context(), contract.ContractAddr)
+	if err != nil {
+		return c.Status(502).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	result := fiber.Map{
+		"contract_addr": contract.ContractAddr,
+		"balance_nano":  state.BalanceNano,
+		"accrued_nano":  state.AccruedNano,
+		"per_day_nano":  state.PerDayNano,
+		"providers":     state.Providers,
+		"expires_at":    nil,
+	}
+	if runway, ok := state.Runway(); ok {
+		result["expires_at"] = time.Now().Add(runway)
+	}
+	return c.JSON(result)
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strconv"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+const accessKeyAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+type createKeyRequest struct {
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	IsAdmin   bool   `json:"is_admin"`
+}
+
+type updateKeyRequest struct {
+	IsAdmin bool `json:"is_admin"`
+}
+
+type createGrantRequest struct {
+	Bucket  string   `json:"bucket"`
+	Prefix  string   `json:"prefix"`
+	Actions []string `json:"actions"`
+}
+
+func (s *AdminServer) listKeys(c *fiber.Ctx) error {
+	keys, err := s.db.ListAPIKeys(c.Context())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	result := make([]fiber.Map, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, fiber.Map{
+			"access_key": k.AccessKey,
+			"is_admin":   k.IsAdmin,
+			"created_at": k.CreatedAt,
+		})
+	}
+	return c.JSON(result)
+}
+
+// createKey stores a new key pair. Missing credentials are generated; the
+// secret is only ever returned by this call.
+func (s *AdminServer) createKey(c *fiber.Ctx) error {
+	var req createKeyRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON: " + err.Error()})
+		}
+	}
+
+	if req.AccessKey == "" {
+		req.AccessKey = randomAccessKey()
+	}
+	if req.SecretKey == "" {
+		req.SecretKey = randomSecretKey()
+	}
+	if len(req.AccessKey) > 50 || len(req.SecretKey) > 100 {
+		return c.Status(400).JSON(fiber.Map{"error": "access_key must be at most 50 and secret_key at most 100 characters"})
+	}
+
+	key := &models.APIKey{
+		AccessKey: req.AccessKey,
+		SecretKey: req.SecretKey,
+		IsAdmin:   req.IsAdmin,
+	}
+	if err := s.db.CreateAPIKey(c.Context(), key); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB Insert failed: " + err.Error()})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"access_key": key.AccessKey,
+		"secret_key": key.SecretKey,
+		"is_admin":   key.IsAdmin,
+		"created_at": key.CreatedAt,
+	})
+}
+
+func (s *AdminServer) updateKey(c *fiber.Ctx) error {
+	var req updateKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON: " + err.Error()})
+	}
+
+	err := s.db.SetAPIKeyAdmin(c.Context(), c.Params("key"), req.IsAdmin)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"access_key": c.Params("key"), "is_admin": req.IsAdmin})
+}
+
+func (s *AdminServer) deleteKey(c *fiber.Ctx) error {
+	err := s.db.DeleteAPIKey(c.Context(), c.Params("key"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"status": "deleted", "access_key": c.Params("key")})
+}
+
+func (s *AdminServer) listGrants(c *fiber.Ctx) error {
+	if _, err := s.db.GetAPIKey(c.Context(), c.Params("key")); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+	}
+
+	grants, err := s.db.ListAPIKeyGrants(c.Context(), c.Params("key"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(grants)
+}
+
+func (s *AdminServer) createGrant(c *fiber.Ctx) error {
+	var req createGrantRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON: " + err.Error()})
+	}
+
+	if req.Bucket == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "bucket is required (use \"*\" for every bucket)"})
+	}
+	if len(req.Actions) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "actions are required"})
+	}
+	for _, a := range req.Actions {
+		if !slices.Contains(GrantActions, a) {
+			return c.Status(400).JSON(fiber.Map{"error": "Unknown action: " + a, "allowed": GrantActions})
+		}
+	}
+
+	if _, err := s.db.GetAPIKey(c.Context(), c.Params("key")); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+	}
+
+	grant := &models.APIKeyGrant{
+		AccessKey:  c.Params("key"),
+		BucketName: req.Bucket,
+		Prefix:     req.Prefix,
+		Actions:    req.Actions,
+	}
+	if err := s.db.CreateAPIKeyGrant(c.Context(), grant); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB Insert failed: " + err.Error()})
+	}
+
+	return c.Status(201).JSON(grant)
+}
+
+func (s *AdminServer) deleteGrant(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	err = s.db.DeleteAPIKeyGrant(c.Context(), c.Params("key"), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(404).JSON(fiber.Map{"error": "Grant not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"status": "deleted", "id": id})
+}
+
+func randomAccessKey() string {
+	buf := make([]byte, 20)
+	rand.Read(buf)
+	for i, b := range buf {
+		buf[i] = accessKeyAlphabet[int(b)%len(accessKeyAlphabet)]
+	}
+	return "TON" + string(buf[3:])
+}
+
+func randomSecretKey() string {
+	buf := make([]byte, 30)
+	rand.Read(buf)
+	return base64.StdEncoding.EncodeToString(buf)
+}
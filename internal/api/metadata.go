@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"ton-storage-s3-cli/internal/s3"
+)
+
+// withObjectMetadata prepares object metadata headers for gofakes3, which only
+// forwards X-Amz-* and a few Content-* headers to the backend.
+func withObjectMetadata(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k := range r.Header {
+			if strings.HasPrefix(k, s3.PassthroughHeaderPrefix) {
+				r.Header.Del(k)
+			}
+		}
+
+		if r.Method == http.MethodPut || r.Method == http.MethodPost {
+			for _, h := range s3.PassthroughHeaders {
+				if v := r.Header.Get(h); v != "" {
+					r.Header.Set(s3.PassthroughHeaderPrefix+h, v)
+				}
+			}
+
+			if r.Header.Get("X-Amz-Copy-Source") != "" {
+				var keys []string
+				for k := range r.Header {
+					if s3.IsStoredHeader(strings.TrimPrefix(k, s3.PassthroughHeaderPrefix)) {
+						keys = append(keys, k)
+					}
+				}
+				r.Header.Set(s3.MetadataKeysHeader, strings.Join(keys, ","))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
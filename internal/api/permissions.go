@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// Actions a grant can allow. Bucket management (create, delete, versioning)
+// is reserved to admin keys.
+const (
+	ActionRead   = "read"
+	ActionWrite  = "write"
+	ActionDelete = "delete"
+	ActionList   = "list"
+
+	actionAdmin = "admin"
+
+	// AnyBucket in a grant matches every bucket.
+	AnyBucket = "*"
+)
+
+var GrantActions = []string{ActionRead, ActionWrite, ActionDelete, ActionList}
+
+// maxDeleteRequestSize bounds the DeleteObjects body read to check its keys.
+const maxDeleteRequestSize = 2 << 20
+
+// s3Access is one permission a request needs: an action on a bucket and an
+// object key, or a listing prefix for list actions.
+type s3Access struct {
+	action string
+	bucket string
+	key    string
+}
+
+// requiredAccess maps a request to the permissions it needs, following the
+// routing of gofakes3. The keys of a DeleteObjects request are read from its
+// body, which is restored for the handler.
+func requiredAccess(r *http.Request) ([]s3Access, error) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, object, _ := strings.Cut(path, "/")
+	query := r.URL.Query()
+
+	if bucket == "" {
+		return []s3Access{{action: ActionList, bucket: AnyBucket}}, nil
+	}
+
+	_, uploads := query["uploads"]
+	switch {
+	case query.Get("uploadId") != "":
+		return []s3Access{{action: ActionWrite, bucket: bucket, key: object}}, nil
+
+	case uploads && r.Method == http.MethodGet:
+		return []s3Access{{action: ActionList, bucket: bucket, key: query.Get("prefix")}}, nil
+
+	case uploads:
+		return []s3Access{{action: ActionWrite, bucket: bucket, key: object}}, nil
+
+	case query.Has("versioning") && r.Method == http.MethodGet:
+		return []s3Access{{action: ActionList, bucket: bucket}}, nil
+
+	case query.Has("versioning"):
+		return []s3Access{{action: actionAdmin, bucket: bucket}}, nil
+
+	case query.Has("versions"):
+		return []s3Access{{action: ActionList, bucket: bucket, key: query.Get("prefix")}}, nil
+	}
+
+	if object != "" {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			return []s3Access{{action: ActionRead, bucket: bucket, key: object}}, nil
+
+		case http.MethodDelete:
+			return []s3Access{{action: ActionDelete, bucket: bucket, key: object}}, nil
+
+		default:
+			// Restoring an offloaded object does not change it
+			if r.Method == http.MethodPost && query.Has("restore") {
+				return []s3Access{{action: ActionRead, bucket: bucket, key: object}}, nil
+			}
+
+			access := []s3Access{{action: ActionWrite, bucket: bucket, key: object}}
+			if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+				srcBucket, srcKey, _ := parseCopySource(src)
+				access = append(access, s3Access{action: ActionRead, bucket: srcBucket, key: srcKey})
+			}
+			return access, nil
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return []s3Access{{action: ActionList, bucket: bucket, key: query.Get("prefix")}}, nil
+
+	case http.MethodPost:
+		if query.Has("delete") {
+			return deleteObjectsAccess(r, bucket)
+		}
+		// Browser POST uploads name the key in the form body.
+		return []s3Access{{action: ActionWrite, bucket: bucket}}, nil
+
+	default:
+		return []s3Access{{action: actionAdmin, bucket: bucket}}, nil
+	}
+}
+
+// parseCopySource splits an X-Amz-Copy-Source header into bucket, key and
+// version ID.
+func parseCopySource(src string) (string, string, string) {
+	src, rawQuery, _ := strings.Cut(src, "?")
+	if unescaped, err := url.PathUnescape(src); err == nil {
+		src = unescaped
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+
+	query, _ := url.ParseQuery(rawQuery)
+	return bucket, key, query.Get("versionId")
+}
+
+func deleteObjectsAccess(r *http.Request, bucket string) ([]s3Access, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxDeleteRequestSize))
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var in gofakes3.DeleteRequest
+	if err := xml.Unmarshal(body, &in); err != nil {
+		// Let gofakes3 report the malformed document to a key that could
+		// delete anything in the bucket.
+		return []s3Access{{action: ActionDelete, bucket: bucket}}, nil
+	}
+
+	access := make([]s3Access, 0, len(in.Objects))
+	for _, o := range in.Objects {
+		access = append(access, s3Access{action: ActionDelete, bucket: bucket, key: o.Key})
+	}
+	return access, nil
+}
+
+// allowed reports whether a key may perform an access. Admin keys may do
+// anything; other keys need a grant on the bucket whose prefix covers the key.
+func allowed(key *models.APIKey, grants []models.APIKeyGrant, a s3Access) bool {
+	if key.IsAdmin {
+		return true
+	}
+	if a.action == actionAdmin {
+		return false
+	}
+
+	for _, g := range grants {
+		if g.BucketName != AnyBucket && g.BucketName != a.bucket {
+			continue
+		}
+		if strings.HasPrefix(a.key, g.Prefix) && slices.Contains(g.Actions, a.action) {
+			return true
+		}
+	}
+	return false
+}
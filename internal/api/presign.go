@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"ton-storage-s3-cli/internal/sigv4"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultPresignExpiry = time.Hour
+
+type presignRequest struct {
+	AccessKey string `json:"access_key"`
+	Method    string `json:"method"`
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	VersionID string `json:"version_id"`
+	ExpiresIn int64  `json:"expires_in"` // seconds
+}
+
+// presignURL issues a GET or PUT link signed with one of the stored keys. The
+// link carries that key's permissions, so it is refused up front if the key
+// could not perform the request itself.
+func (s *AdminServer) presignURL(c *fiber.Ctx) error {
+	var req presignRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON: " + err.Error()})
+	}
+
+	req.Method = strings.ToUpper(req.Method)
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+
+	var action string
+	switch req.Method {
+	case http.MethodGet:
+		action = ActionRead
+	case http.MethodPut:
+		action = ActionWrite
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "method must be GET or PUT"})
+	}
+
+	if req.Bucket == "" || req.Key == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "bucket and key are required"})
+	}
+
+	expires := defaultPresignExpiry
+	if req.ExpiresIn != 0 {
+		expires = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if expires < time.Second || expires > sigv4.MaxPresignExpiry {
+		return c.Status(400).JSON(fiber.Map{"error": "expires_in must be between 1 and 604800 seconds"})
+	}
+
+	key, err := s.db.GetAPIKey(c.Context(), req.AccessKey)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+	}
+
+	grants, err := s.db.ListAPIKeyGrants(c.Context(), key.AccessKey)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !allowed(key, grants, s3Access{action: action, bucket: req.Bucket, key: req.Key}) {
+		return c.Status(403).JSON(fiber.Map{"error": "Key is not allowed to " + action + " this object"})
+	}
+
+	base, err := url.Parse(s.s3URL)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Invalid S3 public URL: " + err.Error()})
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/" + req.Bucket + "/" + req.Key
+	if req.VersionID != "" && req.Method == http.MethodGet {
+		base.RawQuery = url.Values{"versionId": {req.VersionID}}.Encode()
+	}
+
+	now := time.Now()
+	signed, err := sigv4.Presign(base, sigv4.PresignOptions{
+		Method:    req.Method,
+		AccessKey: key.AccessKey,
+		SecretKey: key.SecretKey,
+		Expires:   expires,
+		Now:       now,
+	})
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"url":        signed.String(),
+		"method":     req.Method,
+		"expires_at": now.Add(expires).UTC(),
+	})
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"ton-storage-s3-cli/internal/ton"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type addProviderRequest struct {
+	Key string `json:"key"`
+}
+
+type updateProviderRequest struct {
+	Disabled bool `json:"disabled"`
+}
+
+func (s *AdminServer) listProviders(c *fiber.Ctx) error {
+	providers, err := s.db.ListProviders(c.Context())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(providers)
+}
+
+// addProvider adds a provider to hire from and probes it right away; the
+// discovery worker keeps probing it afterwards.
+func (s *AdminServer) addProvider(c *fiber.Ctx) error {
+	var req addProviderRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON: " + err.Error()})
+	}
+	key, err := ton.ParseProviderKey(req.Key)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if _, err := s.db.AddProviders(c.Context(), []string{key}, "admin"); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "DB Insert failed: " + err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	probeErr := ""
+	if result, err := s.tonSvc.ProbeProvider(ctx, key); err == nil {
+		err = s.db.RecordProviderProbe(c.Context(), result)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+	} else {
+		probeErr = err.Error()
+	}
+
+	p, err := s.db.GetProvider(c.Context(), key)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"provider": p, "probe_error": probeErr})
+}
+
+// updateProvider disables a provider, which is then neither hired nor probed,
+// or enables it again.
+func (s *AdminServer) updateProvider(c *fiber.Ctx) error {
+	var req updateProviderRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON: " + err.Error()})
+	}
+
+	found, err := s.db.SetProviderDisabled(c.Context(), c.Params("key"), req.Disabled)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Provider not found"})
+	}
+
+	p, err := s.db.GetProvider(c.Context(), c.Params("key"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(p)
+}
+
+// deleteProvider forgets a provider. Providers from PROVIDERS come back on
+// the next start; disable them instead.
+func (s *AdminServer) deleteProvider(c *fiber.Ctx) error {
+	found, err := s.db.DeleteProvider(c.Context(), c.Params("key"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Provider not found"})
+	}
+	return c.JSON(fiber.Map{"status": "deleted", "key": c.Params("key")})
+}
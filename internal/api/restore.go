@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"ton-storage-s3-cli/internal/s3"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+const maxRestoreRequestSize = 64 << 10
+
+type restoreRequest struct {
+	XMLName xml.Name `xml:"RestoreRequest"`
+	Days    int      `xml:"Days"`
+}
+
+// withRestore serves RestoreObject, which gofakes3 does not route, and
+// rejects reads of offloaded objects with InvalidObjectState before gofakes3
+// would turn the backend error into an internal one.
+func withRestore(backend *s3.TonBackend, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, object, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		query := r.URL.Query()
+
+		if object == "" || query.Has("uploadId") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var err error
+		switch {
+		case r.Method == http.MethodPost && query.Has("restore"):
+			serveRestore(backend, w, r, bucket, object)
+			return
+
+		case r.Method == http.MethodGet:
+			err = backend.CheckReadable(bucket, object, query.Get("versionId"), r.Header.Get("Range"))
+		}
+
+		var s3Err gofakes3.Error
+		if errors.As(err, &s3Err) && s3.ErrorStatus(s3Err.ErrorCode()) != s3Err.ErrorCode().Status() {
+			writeBackendError(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func serveRestore(backend *s3.TonBackend, w http.ResponseWriter, r *http.Request, bucket, object string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRestoreRequestSize))
+	if err != nil {
+		writeBackendError(w, r, err)
+		return
+	}
+
+	var req restoreRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeBackendError(w, r, gofakes3.ErrorMessage(gofakes3.ErrMalformedXML, err.Error()))
+		return
+	}
+
+	started, err := backend.RestoreObject(bucket, object, r.URL.Query().Get("versionId"), req.Days)
+	if err != nil {
+		writeBackendError(w, r, err)
+		return
+	}
+
+	if started {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func writeBackendError(w http.ResponseWriter, r *http.Request, err error) {
+	// Errors about a bucket or key are not plain ErrorResponses, but carry
+	// one all the same
+	var s3Err gofakes3.Error
+	if errors.As(err, &s3Err) && s3Err.ErrorCode() != gofakes3.ErrInternal {
+		resp := gofakes3.ErrorResultFromError(s3Err)
+		if resp.Message == "" {
+			resp.Message = string(resp.Code)
+		}
+		writeError(w, r, s3.ErrorStatus(resp.Code), resp.Code, resp.Message)
+		return
+	}
+
+	log.Printf("❌ S3 error for %s %s: %v", r.Method, r.URL.Path, err)
+	writeError(w, r, http.StatusInternalServerError, gofakes3.ErrInternal, "Internal Error")
+}
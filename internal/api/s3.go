@@ -6,6 +6,7 @@ import (
 
 	"ton-storage-s3-cli/internal/database"
 	"ton-storage-s3-cli/internal/s3"
+	"ton-storage-s3-cli/internal/staging"
 	"ton-storage-s3-cli/internal/ton"
 
 	"github.com/johannesboyne/gofakes3"
@@ -15,9 +16,9 @@ type S3Server struct {
 	server *http.Server
 }
 
-func NewS3Server(db *database.DB, tonSvc *ton.Service, rootDir string) *S3Server {
+func NewS3Server(db *database.DB, tonSvc *ton.Service, store *staging.Store, opts s3.Options) *S3Server {
 
-	backend := s3.NewTonBackend(db, tonSvc, rootDir)
+	backend := s3.NewTonBackend(db, tonSvc, store, opts)
 
 	faker := gofakes3.New(backend,
 		gofakes3.WithLogger(gofakes3.GlobalLog()),
@@ -26,7 +27,7 @@ func NewS3Server(db *database.DB, tonSvc *ton.Service, rootDir string) *S3Server
 
 	return &S3Server{
 		server: &http.Server{
-			Handler: faker.Server(),
+			Handler: withAuth(db, withBucketConfig(backend, withEncryption(backend, withRestore(backend, withObjectVersion(backend, withObjectMetadata(faker.Server())))))),
 		},
 	}
 }
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultTeardownsLimit = 100
+
+// listTeardowns lists the latest contract teardowns, of one status with
+// ?status=.
+func (s *AdminServer) listTeardowns(c *fiber.Ctx) error {
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultTeardownsLimit)))
+	if err != nil || limit <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid limit"})
+	}
+
+	teardowns, err := s.db.ListTeardowns(c.Context(), c.Query("status"), limit)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(teardowns)
+}
+
+// retryTeardown makes a pending teardown waiting out its backoff run at the
+// next pass of the teardown worker.
+func (s *AdminServer) retryTeardown(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid teardown id"})
+	}
+
+	found, err := s.db.RetryTeardown(c.Context(), id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Pending teardown not found"})
+	}
+	return c.JSON(fiber.Map{"status": "retry_scheduled"})
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// objectVersions is the part of the backend withObjectVersion serves from.
+type objectVersions interface {
+	keyedObjects
+	BucketExists(name string) (bool, error)
+	HeadObjectVersion(bucketName, objectName string, versionID gofakes3.VersionID) (*gofakes3.Object, error)
+	DeleteObjectVersion(bucketName, objectName string, versionID gofakes3.VersionID) (gofakes3.ObjectDeleteResult, error)
+}
+
+// withObjectVersion serves the object version requests gofakes3 gets wrong:
+// HEAD for a specific version, which it routes to the unversioned HeadObject,
+// and GET and DELETE for the null version, whose "null" version ID it drops
+// and then serves or deletes the latest version instead.
+func withObjectVersion(backend objectVersions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versionID := r.URL.Query().Get("versionId")
+		bucket, object, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+		if versionID == "" || object == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodHead:
+			headObjectVersion(backend, w, bucket, object, versionID)
+		case r.Method == http.MethodGet && versionID == "null":
+			serveWithKey(backend, w, r, bucket, object, versionID, nil)
+		case r.Method == http.MethodDelete && versionID == "null":
+			deleteNullVersion(backend, w, r, bucket, object)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func headObjectVersion(backend objectVersions, w http.ResponseWriter, bucket, object, versionID string) {
+	obj, err := backend.HeadObjectVersion(bucket, object, gofakes3.VersionID(versionID))
+	if err != nil {
+		status := http.StatusInternalServerError
+		var s3Err gofakes3.Error
+		if errors.As(err, &s3Err) {
+			status = s3Err.ErrorCode().Status()
+		}
+		w.WriteHeader(status)
+		return
+	}
+	defer obj.Contents.Close()
+
+	w.Header().Set("x-amz-version-id", versionID)
+	if obj.IsDeleteMarker {
+		w.Header().Set("x-amz-delete-marker", "true")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	for k, v := range obj.Metadata {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("ETag", gofakes3.FormatETag(obj.Hash))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func deleteNullVersion(backend objectVersions, w http.ResponseWriter, r *http.Request, bucket, object string) {
+	exists, err := backend.BucketExists(bucket)
+	if err == nil && !exists {
+		err = gofakes3.BucketNotFound(bucket)
+	}
+	if err != nil {
+		writeBackendError(w, r, err)
+		return
+	}
+
+	result, err := backend.DeleteObjectVersion(bucket, object, "null")
+	if err != nil {
+		writeBackendError(w, r, err)
+		return
+	}
+
+	w.Header().Set("x-amz-delete-marker", strconv.FormatBool(result.IsDeleteMarker))
+	w.Header().Set("x-amz-version-id", "null")
+	w.WriteHeader(http.StatusNoContent)
+}
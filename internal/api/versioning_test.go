@@ -0,0 +1,99 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ton-storage-s3-cli/internal/s3"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// fakeVersions serves one bucket holding a null version of every object and
+// records which versions it was asked for.
+type fakeVersions struct {
+	calls []string
+}
+
+func (b *fakeVersions) object(versionID string) *gofakes3.Object {
+	return &gofakes3.Object{
+		Name:      "key",
+		VersionID: gofakes3.VersionID(versionID),
+		Size:      4,
+		Contents:  io.NopCloser(strings.NewReader("null")),
+		Metadata:  map[string]string{},
+	}
+}
+
+func (b *fakeVersions) BucketExists(name string) (bool, error) {
+	return name == "bucket", nil
+}
+
+func (b *fakeVersions) GetObjectWithKey(bucketName, objectName, versionID, rangeHeader string, key *s3.CustomerKey) (*gofakes3.Object, error) {
+	b.calls = append(b.calls, "get "+versionID)
+	return b.object(versionID), nil
+}
+
+func (b *fakeVersions) HeadObjectWithKey(bucketName, objectName, versionID string, key *s3.CustomerKey) (*gofakes3.Object, error) {
+	b.calls = append(b.calls, "head with key "+versionID)
+	return b.object(versionID), nil
+}
+
+func (b *fakeVersions) HeadObjectVersion(bucketName, objectName string, versionID gofakes3.VersionID) (*gofakes3.Object, error) {
+	b.calls = append(b.calls, "head "+string(versionID))
+	return b.object(string(versionID)), nil
+}
+
+func (b *fakeVersions) DeleteObjectVersion(bucketName, objectName string, versionID gofakes3.VersionID) (gofakes3.ObjectDeleteResult, error) {
+	b.calls = append(b.calls, "delete "+string(versionID))
+	return gofakes3.ObjectDeleteResult{VersionID: versionID}, nil
+}
+
+func TestObjectVersionNull(t *testing.T) {
+	tests := []struct {
+		method, target string
+		call           string // what the backend is asked, "" if the request is passed on
+		status         int
+	}{
+		{http.MethodDelete, "/bucket/key?versionId=null", "delete null", http.StatusNoContent},
+		{http.MethodGet, "/bucket/key?versionId=null", "get null", http.StatusOK},
+		{http.MethodHead, "/bucket/key?versionId=null", "head null", http.StatusOK},
+		{http.MethodHead, "/bucket/key?versionId=0123abcd", "head 0123abcd", http.StatusOK},
+		{http.MethodDelete, "/other/key?versionId=null", "", http.StatusNotFound},
+
+		// Left to gofakes3
+		{http.MethodDelete, "/bucket/key", "", http.StatusTeapot},
+		{http.MethodDelete, "/bucket/key?versionId=0123abcd", "", http.StatusTeapot},
+		{http.MethodGet, "/bucket/key?versionId=0123abcd", "", http.StatusTeapot},
+		{http.MethodGet, "/bucket?versionId=null", "", http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		backend := &fakeVersions{}
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+
+		w := httptest.NewRecorder()
+		withObjectVersion(backend, next).ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.target, w.Code, tt.status)
+		}
+		var want []string
+		if tt.call != "" {
+			want = []string{tt.call}
+		}
+		if strings.Join(backend.calls, ", ") != strings.Join(want, ", ") {
+			t.Errorf("%s %s: backend got %q, want %q", tt.method, tt.target, backend.calls, want)
+		}
+		if tt.call != "" && w.Header().Get("x-amz-version-id") != tt.target[strings.Index(tt.target, "=")+1:] {
+			t.Errorf("%s %s: got version %q", tt.method, tt.target, w.Header().Get("x-amz-version-id"))
+		}
+		if tt.method == http.MethodGet && tt.call != "" && w.Body.String() != "null" {
+			t.Errorf("%s %s: got body %q", tt.method, tt.target, w.Body.String())
+		}
+	}
+}
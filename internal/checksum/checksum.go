@@ -0,0 +1,33 @@
+// Package checksum provides the hashes behind the x-amz-checksum-* headers.
+package checksum
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+)
+
+var (
+	crc32cTable    = crc32.MakeTable(crc32.Castagnoli)
+	crc64nvmeTable = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+)
+
+// New returns a hash for an algorithm named as in x-amz-checksum-<algorithm>,
+// in upper case. It reports false for an algorithm S3 does not know.
+func New(algo string) (hash.Hash, bool) {
+	switch algo {
+	case "CRC32":
+		return crc32.NewIEEE(), true
+	case "CRC32C":
+		return crc32.New(crc32cTable), true
+	case "CRC64NVME":
+		return crc64.New(crc64nvmeTable), true
+	case "SHA1":
+		return sha1.New(), true
+	case "SHA256":
+		return sha256.New(), true
+	}
+	return nil, false
+}
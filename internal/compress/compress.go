@@ -0,0 +1,234 @@
+// Package compress implements the seekable format objects are compressed
+// with before they are bagged.
+//
+// An object is split into frames of FrameSize bytes, each compressed on its
+// own with the object's codec, so that a range is decompressed from the
+// frames covering it alone. The compressed sizes of the frames make up the
+// object's index, which is kept in the catalog rather than in the bag.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs objects are compressed with.
+const (
+	Zstd = "zstd"
+	Gzip = "gzip"
+)
+
+// FrameSize is how many bytes of an object one frame holds.
+const FrameSize = 1 << 20
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(2*FrameSize))
+)
+
+// Valid reports whether codec is a codec objects can be compressed with.
+func Valid(codec string) bool {
+	return codec == Zstd || codec == Gzip
+}
+
+// compressedTypes are content types whose data is compressed already.
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zstd":             true,
+	"application/zip":              true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/pdf":              true,
+}
+
+// Compressible reports whether data of contentType is worth compressing:
+// images, audio, video and archives are compressed already.
+func Compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType == ""
+	}
+	if compressedTypes[mediaType] {
+		return false
+	}
+	major, minor, _ := strings.Cut(mediaType, "/")
+	switch major {
+	case "image":
+		return minor == "svg+xml" || minor == "bmp"
+	case "audio", "video":
+		return false
+	}
+	return true
+}
+
+func compressFrame(codec string, frame []byte) ([]byte, error) {
+	if codec == Zstd {
+		return zstdEncoder.EncodeAll(frame, nil), nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(frame); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressFrame(codec string, frame []byte, dst []byte) ([]byte, error) {
+	if codec == Zstd {
+		return zstdDecoder.DecodeAll(frame, dst[:0])
+	}
+	r, err := gzip.NewReader(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(dst[:0])
+	if _, err := io.Copy(buf, io.LimitReader(r, FrameSize+1)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Compress reads an object of size bytes from src and writes it compressed
+// with codec to dst. It returns the index of the frames and the size of the
+// compressed data.
+func Compress(dst io.Writer, src io.Reader, codec string, size int64) ([]byte, int64, error) {
+	if !Valid(codec) {
+		return nil, 0, fmt.Errorf("unknown compression codec %q", codec)
+	}
+
+	var index []byte
+	var written int64
+	buf := make([]byte, FrameSize)
+	for read := int64(0); read < size; {
+		n, err := io.ReadFull(src, buf[:min(FrameSize, size-read)])
+		if err != nil {
+			return nil, 0, err
+		}
+		read += int64(n)
+
+		frame, err := compressFrame(codec, buf[:n])
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := dst.Write(frame); err != nil {
+			return nil, 0, err
+		}
+		index = binary.AppendUvarint(index, uint64(len(frame)))
+		written += int64(len(frame))
+	}
+	return index, written, nil
+}
+
+// Index holds where each frame of a compressed object starts; its last entry
+// is the size of the compressed data.
+type Index []int64
+
+// ParseIndex decodes the index returned by Compress.
+func ParseIndex(raw []byte) (Index, error) {
+	index := Index{0}
+	for len(raw) > 0 {
+		n, k := binary.Uvarint(raw)
+		if k <= 0 {
+			return nil, errors.New("malformed frame index")
+		}
+		index = append(index, index[len(index)-1]+int64(n))
+		raw = raw[k:]
+	}
+	return index, nil
+}
+
+// Range returns the range of the compressed data holding the frames that
+// cover the range start+length of the object.
+func (ix Index) Range(start, length int64) (int64, int64) {
+	if length == 0 {
+		return 0, 0
+	}
+	first, last := start/FrameSize, (start+length-1)/FrameSize
+	return ix[first], ix[last+1] - ix[first]
+}
+
+// NewReader returns the range start+length of an object compressed with
+// codec. src reads the compressed data from the start of ix.Range on.
+func NewReader(src io.Reader, codec string, ix Index, start, length int64) io.Reader {
+	return &reader{
+		src:   src,
+		codec: codec,
+		index: ix,
+		frame: start / FrameSize,
+		skip:  start % FrameSize,
+		left:  length,
+	}
+}
+
+type reader struct {
+	src   io.Reader
+	codec string
+	index Index
+	frame int64 // index of the next frame to read
+	skip  int64 // bytes of the next frame before the range
+	left  int64 // bytes of the range not returned yet
+
+	buf, data []byte
+	plain     []byte // decompressed bytes not returned yet
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if len(r.plain) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain[:min(int64(len(r.plain)), r.left)])
+	r.plain = r.plain[n:]
+	r.left -= int64(n)
+	return n, nil
+}
+
+func (r *reader) next() error {
+	if r.frame+1 >= int64(len(r.index)) {
+		return io.ErrUnexpectedEOF
+	}
+	size := r.index[r.frame+1] - r.index[r.frame]
+	if int64(cap(r.buf)) < size {
+		r.buf = make([]byte, size)
+	}
+	frame := r.buf[:size]
+	if _, err := io.ReadFull(r.src, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	data, err := decompressFrame(r.codec, frame, r.data)
+	if err != nil {
+		return fmt.Errorf("frame %d: %w", r.frame, err)
+	}
+	if int64(len(data)) <= r.skip {
+		return fmt.Errorf("frame %d: short frame", r.frame)
+	}
+	r.data = data
+	r.plain = data[r.skip:]
+	r.frame++
+	r.skip = 0
+	return nil
+}
@@ -0,0 +1,201 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var codecs = []string{Zstd, Gzip}
+
+// sample returns size bytes that compress somewhat: random words of a small
+// alphabet.
+func sample(rng *rand.Rand, size int) []byte {
+	const alphabet = "abcdefgh \n"
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return data
+}
+
+func pack(t *testing.T, codec string, plain []byte) ([]byte, Index) {
+	t.Helper()
+	var packed bytes.Buffer
+	raw, written, err := Compress(&packed, bytes.NewReader(plain), codec, int64(len(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(packed.Len()) {
+		t.Fatalf("%s: compressed %d bytes into %d, reported %d", codec, len(plain), packed.Len(), written)
+	}
+
+	ix, err := ParseIndex(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := (len(plain) + FrameSize - 1) / FrameSize; len(ix) != frames+1 {
+		t.Fatalf("%s: %d bytes indexed in %d frames, want %d", codec, len(plain), len(ix)-1, frames)
+	}
+	if ix[len(ix)-1] != written {
+		t.Fatalf("%s: index ends at %d, want %d", codec, ix[len(ix)-1], written)
+	}
+	return packed.Bytes(), ix
+}
+
+// open decompresses the range start+length of an object from packed, reading
+// only the part ix.Range points at, or what is there of it.
+func open(codec string, packed []byte, ix Index, start, length int64) ([]byte, error) {
+	from, n := ix.Range(start, length)
+	to := min(from+n, int64(len(packed)))
+	return io.ReadAll(NewReader(bytes.NewReader(packed[from:to]), codec, ix, start, length))
+}
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for _, codec := range codecs {
+		for _, size := range []int{0, 1, FrameSize - 1, FrameSize, FrameSize + 1, 2*FrameSize + 17} {
+			plain := sample(rng, size)
+			packed, ix := pack(t, codec, plain)
+
+			got, err := open(codec, packed, ix, 0, int64(size))
+			if err != nil {
+				t.Fatalf("%s, size %d: %v", codec, size, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("%s, size %d: decompressed data differs", codec, size)
+			}
+		}
+	}
+}
+
+func TestRangeReads(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	const size = 3*FrameSize + 100
+	plain := sample(rng, size)
+
+	ranges := [][2]int64{
+		{0, 1},                            // the first byte
+		{0, size},                         // all of it
+		{10, 20},                          // inside the first frame
+		{FrameSize - 1, 1},                // the last byte of a frame
+		{FrameSize, 1},                    // the first byte of a frame
+		{FrameSize - 5, 10},               // across a frame boundary
+		{FrameSize + 1, FrameSize},        // from the middle of a frame to the middle of the next
+		{FrameSize / 2, 2 * FrameSize},    // across three frames
+		{2*FrameSize + 7, FrameSize + 93}, // up to the end
+		{3 * FrameSize, 100},              // the short last frame
+		{size - 1, 1},                     // the last byte
+		{5, 0},
+		{size, 0},
+	}
+	for _, codec := range codecs {
+		packed, ix := pack(t, codec, plain)
+		for _, rg := range ranges {
+			start, length := rg[0], rg[1]
+			got, err := open(codec, packed, ix, start, length)
+			if err != nil {
+				t.Fatalf("%s, range %d+%d: %v", codec, start, length, err)
+			}
+			if !bytes.Equal(got, plain[start:start+length]) {
+				t.Fatalf("%s, range %d+%d: decompressed data differs", codec, start, length)
+			}
+		}
+	}
+}
+
+func TestRangeReadsOnlyCoveringFrames(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	plain := sample(rng, 4*FrameSize)
+
+	for _, codec := range codecs {
+		_, ix := pack(t, codec, plain)
+
+		from, n := ix.Range(FrameSize-1, 2)
+		if from != ix[0] || n != ix[2]-ix[0] {
+			t.Errorf("%s: range across frames 0 and 1 reads %d+%d, want %d+%d", codec, from, n, ix[0], ix[2]-ix[0])
+		}
+		from, n = ix.Range(2*FrameSize, FrameSize)
+		if from != ix[2] || n != ix[3]-ix[2] {
+			t.Errorf("%s: frame 2 reads %d+%d, want %d+%d", codec, from, n, ix[2], ix[3]-ix[2])
+		}
+		if from, n = ix.Range(7, 0); from != 0 || n != 0 {
+			t.Errorf("%s: empty range reads %d+%d", codec, from, n)
+		}
+	}
+}
+
+func TestDamagedData(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+
+	const size = 3 * FrameSize
+	plain := sample(rng, size)
+	for _, codec := range codecs {
+		packed, ix := pack(t, codec, plain)
+
+		// Cut inside the last frame
+		if _, err := open(codec, packed[:len(packed)-1], ix, 0, size); err == nil {
+			t.Errorf("%s: truncated object decompressed", codec)
+		}
+
+		// Whole frames cut off, the index left as it was
+		if _, err := open(codec, packed[:ix[2]], ix, 0, size); err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: got %v for an object truncated at a frame boundary, want io.ErrUnexpectedEOF", codec, err)
+		}
+
+		// An index that ends before the range does
+		r := NewReader(bytes.NewReader(packed[ix[1]:]), codec, ix[:3], FrameSize, 2*FrameSize)
+		if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: got %v for a range past the index, want io.ErrUnexpectedEOF", codec, err)
+		}
+
+		// A flipped byte inside the second frame
+		flipped := append([]byte(nil), packed...)
+		flipped[(ix[1]+ix[2])/2] ^= 0xff
+		if got, err := open(codec, flipped, ix, FrameSize, 10); err == nil && bytes.Equal(got, plain[FrameSize:FrameSize+10]) {
+			t.Errorf("%s: modified frame decompressed", codec)
+		}
+	}
+}
+
+func TestCompressErrors(t *testing.T) {
+	var packed bytes.Buffer
+	if _, _, err := Compress(&packed, bytes.NewReader([]byte("data")), "lz4", 4); err == nil {
+		t.Error("compressed with an unknown codec")
+	}
+	if _, _, err := Compress(&packed, bytes.NewReader([]byte("data")), Zstd, 5); err == nil {
+		t.Error("compressed a source shorter than its size")
+	}
+	if _, err := ParseIndex([]byte{0x80}); err == nil {
+		t.Error("parsed a malformed index")
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"", true},
+		{"text/plain; charset=utf-8", true},
+		{"application/json", true},
+		{"application/octet-stream", true},
+		{"image/svg+xml", true},
+		{"image/bmp", true},
+		{"image/png", false},
+		{"video/mp4", false},
+		{"audio/mpeg", false},
+		{"application/zip", false},
+		{"application/gzip", false},
+		{"application/pdf", false},
+		{"not a type", false},
+	}
+	for _, tt := range tests {
+		if got := Compressible(tt.contentType); got != tt.want {
+			t.Errorf("Compressible(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
@@ -43,7 +43,7 @@ func RunAuditorWorker(ctx context.Context, workerID int, totalWorkers int, db *d
 	}
 }
 
-func processContract(ctx context.Context, workerID int, db *database.DB, tonSvc *ton.Service, c models.ContractWithMeta) {
+func processContract(ctx context.Context, workerID int, db *database.DB, tonSvc *ton.Service, c models.Contract) {
 	logPrefix := fmt.Sprintf("[Auditor %d | %s]", workerID, c.ProviderAddr)
 
 	report, err := tonSvc.AuditProvider(ctx, c.BagID, c.ProviderAddr)
@@ -52,6 +52,10 @@ func processContract(ctx context.Context, workerID int, db *database.DB, tonSvc
 		return
 	}
 
+	if err := db.RecordProviderAudit(ctx, c.ProviderAddr, report.IsHealthy); err != nil {
+		log.Printf("%s Failed to record audit: %v", logPrefix, err)
+	}
+
 	if report.IsHealthy {
 		if c.Status == "pending" {
 			if err := db.MarkContractActive(ctx, c.ID); err != nil {
@@ -59,8 +63,8 @@ func processContract(ctx context.Context, workerID int, db *database.DB, tonSvc
 			} else {
 				log.Printf("%s 🚀 Contract activated! Provider is verified online.", logPrefix)
 				
-				if err := db.UpgradeFileStatusIfNeeded(ctx, c.FileID); err != nil {
-					log.Printf("%s Failed to update file status: %v", logPrefix, err)
+				if err := db.UpgradeBagStatusIfNeeded(ctx, c.BagID); err != nil {
+					log.Printf("%s Failed to update bag status: %v", logPrefix, err)
 				}
 			}
 		} else {
@@ -84,8 +88,8 @@ func processContract(ctx context.Context, workerID int, db *database.DB, tonSvc
 	if err := db.MarkContractFailed(ctx, c.ID); err != nil {
 		log.Printf("%s Critical DB Error marking failed: %v", logPrefix, err)
 	} else {
-		if err := db.DowngradeFileStatusIfNeeded(ctx, c.FileID); err != nil {
-			log.Printf("%s Failed to downgrade file status: %v", logPrefix, err)
+		if err := db.DowngradeBagStatusIfNeeded(ctx, c.BagID); err != nil {
+			log.Printf("%s Failed to downgrade bag status: %v", logPrefix, err)
 		}
 	}
 }
\ No newline at end of file
@@ -3,14 +3,17 @@ package daemons
 import (
 	"context"
 	"encoding/hex"
+	"fmt"
 	"log"
 	"time"
 
 	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/staging"
 	"ton-storage-s3-cli/internal/ton"
 )
 
-func RunCleanerWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, tonSvc *ton.Service) {
+func RunCleanerWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, tonSvc *ton.Service, store *staging.Store, pieceCacheTTL time.Duration) {
 	log.Printf("[Cleaner %d] Worker started. Monitoring redundancy for offloading... 🧹", workerID)
 
 	minAge := 2 * time.Minute
@@ -30,17 +33,82 @@ func RunCleanerWorker(ctx context.Context, workerID int, totalWorkers int, db *d
 			}
 
 			for _, f := range files {
-				bagBytes, err := hex.DecodeString(f.BagID)
-				if err != nil {
+				if err := offloadFile(ctx, db, tonSvc, store, f); err != nil {
+					log.Printf("[Cleaner %d] ❌ Failed to offload %s: %v", workerID, f.ObjectKey, err)
 					continue
 				}
 
-				err = tonSvc.DeleteLocalFile(bagBytes)
-				if err != nil {
-					log.Printf("[Cleaner %d] ❌ Failed to offload %s: %v", workerID, f.ObjectKey, err)
+				if f.RestoreExpiresAt != nil {
+					log.Printf("[Cleaner %d] ❄️ Restored copy of %s expired, offloaded again", workerID, f.ObjectKey)
 				} else {
+					log.Printf("[Cleaner %d] ❄️ Offloaded %s", workerID, f.ObjectKey)
 				}
 			}
+
+			evictPieceCaches(ctx, workerID, totalWorkers, db, tonSvc, pieceCacheTTL)
+		}
+	}
+}
+
+// offloadFile drops the local copy of an object version's bag, or of all its
+// stripes' bags, and marks every version sharing them offloaded.
+func offloadFile(ctx context.Context, db *database.DB, tonSvc *ton.Service, store *staging.Store, f models.File) error {
+	bagIDs := []string{f.BagID}
+	if f.Striped {
+		stripes, err := db.GetFileStripes(ctx, f.ID)
+		if err != nil {
+			return fmt.Errorf("DB error: %w", err)
+		}
+		bagIDs = bagIDs[:0]
+		for _, s := range stripes {
+			bagIDs = append(bagIDs, s.BagID)
+		}
+	}
+
+	for _, bagID := range bagIDs {
+		bagBytes, err := hex.DecodeString(bagID)
+		if err != nil {
+			return err
+		}
+		if err := tonSvc.DeleteLocalFile(bagBytes); err != nil {
+			return err
+		}
+		if err := db.MarkBagOffloaded(ctx, bagID); err != nil {
+			return fmt.Errorf("DB error: %w", err)
 		}
 	}
-}
\ No newline at end of file
+
+	if err := store.PruneObject(f.BucketName, f.ObjectKey, f.VersionID); err != nil {
+		log.Printf("⚠️ Failed to remove staged copy of %s: %v", f.ObjectKey, err)
+	}
+	return nil
+}
+
+// evictPieceCaches drops pieces fetched for range reads of offloaded bags once
+// nobody has read them for ttl. Bags with running downloads keep theirs.
+func evictPieceCaches(ctx context.Context, workerID, totalWorkers int, db *database.DB, tonSvc *ton.Service, ttl time.Duration) {
+	caches, err := db.GetPieceCachesToEvict(ctx, ttl, totalWorkers, workerID, 50)
+	if err != nil {
+		log.Printf("[Cleaner %d] DB Error: %v", workerID, err)
+		return
+	}
+
+	for _, c := range caches {
+		bagBytes, err := hex.DecodeString(c.BagID)
+		if err != nil {
+			continue
+		}
+
+		if err := tonSvc.DropPieceCache(bagBytes); err != nil {
+			log.Printf("[Cleaner %d] ❌ Failed to drop piece cache of bag %s: %v", workerID, c.BagID, err)
+			continue
+		}
+
+		if err := db.DeletePieceCache(ctx, c.ID); err != nil {
+			log.Printf("[Cleaner %d] DB Error: %v", workerID, err)
+			continue
+		}
+
+		log.Printf("[Cleaner %d] 🧩 Dropped piece cache of bag %s (%d bytes fetched)", workerID, c.BagID, c.SizeBytes)
+	}
+}
@@ -0,0 +1,80 @@
+package daemons
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/ton"
+)
+
+// RunDiscoveryWorker keeps the providers table current: providers of our
+// contracts that are not in it yet are added, and every provider is probed
+// for its rates each interval. Providers that stop answering are marked
+// offline and are no longer hired.
+func RunDiscoveryWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, tonSvc *ton.Service, interval time.Duration) {
+	log.Printf("[Discovery %d] Worker started. Probing providers every %s 🔭", workerID, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		discoverProviders(ctx, workerID, db, tonSvc)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[Discovery %d] Stopping...", workerID)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func discoverProviders(ctx context.Context, workerID int, db *database.DB, tonSvc *ton.Service) {
+	if added, err := db.AddContractProviders(ctx); err != nil {
+		log.Printf("[Discovery %d] DB Error: %v", workerID, err)
+	} else if added > 0 {
+		log.Printf("[Discovery %d] Found %d new providers in contracts", workerID, added)
+	}
+
+	providers, err := db.ListProvidersToProbe(ctx)
+	if err != nil {
+		log.Printf("[Discovery %d] DB Error: %v", workerID, err)
+		return
+	}
+
+	for _, p := range providers {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := probeProvider(ctx, db, tonSvc, p.Key); err != nil {
+			if errors.Is(err, ton.ErrNoProbeBag) {
+				log.Printf("[Discovery %d] ⏳ %v, probing later", workerID, err)
+				return
+			}
+			log.Printf("[Discovery %d] ⚠️ Provider %s: %v", workerID, p.Key, err)
+		}
+	}
+}
+
+// probeProvider asks a provider for its rates and records the answer, or the
+// failure to get one.
+func probeProvider(ctx context.Context, db *database.DB, tonSvc *ton.Service, key string) error {
+	probeCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	result, err := tonSvc.ProbeProvider(probeCtx, key)
+	if errors.Is(err, ton.ErrNoProbeBag) {
+		return err
+	}
+	if err != nil {
+		if dbErr := db.RecordProviderProbeFailure(ctx, key, err.Error()); dbErr != nil {
+			return dbErr
+		}
+		return err
+	}
+	return db.RecordProviderProbe(ctx, result)
+}
@@ -0,0 +1,200 @@
+package daemons
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/big"
+	"time"
+
+	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/ton"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/xssnick/tonutils-go/tlb"
+)
+
+// topUpSettleTime is how long a top-up whose send failed may still reach its
+// contract. Wallet messages expire within minutes, so one that has not shown
+// up in the balance by then never will.
+const topUpSettleTime = time.Hour
+
+type KeeperConfig struct {
+	Interval       time.Duration // how often every contract is checked
+	Funding        ton.Funding   // how far contracts are topped up, unless their bucket says otherwise
+	TopUpBelowDays int           // contracts with less runway are topped up, 0 = never
+}
+
+// RunKeeperWorker keeps storage contracts funded: it reads the on-chain
+// balance of every contract and what its providers earn, stores them with
+// the date the balance runs out, and tops up contracts that run out sooner
+// than their bucket allows.
+func RunKeeperWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, tonSvc *ton.Service, cfg KeeperConfig) {
+	log.Printf("[Keeper %d] Worker started. Checking contract balances every %s 💰", workerID, cfg.Interval)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		keepContracts(ctx, workerID, totalWorkers, db, tonSvc, cfg)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[Keeper %d] Stopping...", workerID)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func keepContracts(ctx context.Context, workerID, totalWorkers int, db *database.DB, tonSvc *ton.Service, cfg KeeperConfig) {
+	contracts, err := db.ListContractFunding(ctx, totalWorkers, workerID)
+	if err != nil {
+		log.Printf("[Keeper %d] DB Error: %v", workerID, err)
+		return
+	}
+
+	bucketSettings := make(map[string]*models.BucketSettings)
+	for _, cf := range contracts {
+		if ctx.Err() != nil {
+			return
+		}
+
+		settings, ok := bucketSettings[cf.BucketName]
+		if !ok {
+			settings, err = db.GetBucketSettings(ctx, cf.BucketName)
+			if errors.Is(err, pgx.ErrNoRows) {
+				settings = &models.BucketSettings{}
+			} else if err != nil {
+				log.Printf("[Keeper %d] DB Error: %v", workerID, err)
+				continue
+			}
+			bucketSettings[cf.BucketName] = settings
+		}
+
+		keepContract(ctx, workerID, db, tonSvc, cf, settings, cfg)
+	}
+}
+
+// keepContract refreshes the balance of one contract and tops it up to the
+// storage days of its bucket if it runs out within the threshold of the
+// bucket.
+func keepContract(ctx context.Context, workerID int, db *database.DB, tonSvc *ton.Service, cf models.ContractFunding, settings *models.BucketSettings, cfg KeeperConfig) {
+	checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	state, err := tonSvc.FetchContractState(checkCtx, cf.ContractAddr)
+	cancel()
+	if err != nil {
+		log.Printf("[Keeper %d] ⚠️ Contract %s: %v", workerID, cf.ContractAddr, err)
+		return
+	}
+
+	if err := saveContractState(ctx, db, cf.ContractAddr, state); err != nil {
+		log.Printf("[Keeper %d] DB Error: %v", workerID, err)
+		return
+	}
+
+	settled, err := settleTopUp(ctx, workerID, db, cf.ContractAddr, state)
+	if err != nil {
+		log.Printf("[Keeper %d] DB Error: %v", workerID, err)
+		return
+	}
+	if !settled {
+		return
+	}
+
+	threshold := cfg.TopUpBelowDays
+	if settings.TopUpBelowDays > 0 {
+		threshold = settings.TopUpBelowDays
+	}
+	runway, ok := state.Runway()
+	if !ok || threshold <= 0 || runway >= time.Duration(threshold)*24*time.Hour {
+		return
+	}
+
+	funding := ton.BucketFunding(settings, cfg.Funding)
+	need := new(big.Int).Mul(big.NewInt(state.PerDayNano), big.NewInt(int64(funding.Days)))
+	need.Sub(need, big.NewInt(max(state.BalanceNano-state.AccruedNano, 0)))
+	if funding.MaxNano > 0 && need.Cmp(big.NewInt(funding.MaxNano)) > 0 {
+		need.SetInt64(funding.MaxNano)
+	}
+	if need.Sign() <= 0 {
+		return
+	}
+	if !need.IsInt64() {
+		log.Printf("[Keeper %d] ⚠️ Contract %s needs %s nanoTON, more than can be sent", workerID, cf.ContractAddr, need)
+		return
+	}
+	amount := need.Int64()
+
+	log.Printf("[Keeper %d] Contract %s of bag %s runs out in %s, topping up %d nanoTON...",
+		workerID, cf.ContractAddr, cf.BagID, runway.Round(time.Hour), amount)
+
+	topUp := &models.TopUp{ContractAddr: cf.ContractAddr, BagID: cf.BagID, AmountNano: amount, BalanceBeforeNano: state.BalanceNano}
+	if err := db.StartTopUp(ctx, topUp); err != nil {
+		log.Printf("[Keeper %d] DB Error: %v", workerID, err)
+		return
+	}
+
+	txHash, err := tonSvc.TopUpContract(ctx, cf.ContractAddr, tlb.FromNanoTON(big.NewInt(amount)))
+	if err != nil {
+		// The message may have gone out anyway: the next balance read tells
+		log.Printf("[Keeper %d] ❌ Top-up failed: %v", workerID, err)
+		if err := db.FinishTopUp(ctx, topUp.ID, "unknown", "", err.Error()); err != nil {
+			log.Printf("[Keeper %d] DB Error: %v", workerID, err)
+		}
+		return
+	}
+	if err := db.FinishTopUp(ctx, topUp.ID, "sent", txHash, ""); err != nil {
+		log.Printf("[Keeper %d] DB Error: %v", workerID, err)
+	}
+
+	log.Printf("[Keeper %d] ✅ Topped up %s. Tx: %s", workerID, cf.ContractAddr, txHash)
+	state.BalanceNano += amount
+	if err := saveContractState(ctx, db, cf.ContractAddr, state); err != nil {
+		log.Printf("[Keeper %d] DB Error: %v", workerID, err)
+	}
+}
+
+// settleTopUp tells from a fresh balance whether the last top-up of a
+// contract whose send failed or was cut off reached it. The balance has to
+// have grown by half the amount at least, as providers may have been paid out
+// of it since. It reports false while the top-up may still arrive: no other
+// top-up is sent meanwhile.
+func settleTopUp(ctx context.Context, workerID int, db *database.DB, contractAddr string, state *ton.ContractState) (bool, error) {
+	t, err := db.GetUnsettledTopUp(ctx, contractAddr)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if state.BalanceNano-t.BalanceBeforeNano >= t.AmountNano/2 {
+		log.Printf("[Keeper %d] Top-up %d of %s arrived after all", workerID, t.ID, contractAddr)
+		return true, db.FinishTopUp(ctx, t.ID, "sent", t.TxHash, t.Error)
+	}
+	if time.Since(t.CreatedAt) > topUpSettleTime {
+		log.Printf("[Keeper %d] Top-up %d of %s never arrived", workerID, t.ID, contractAddr)
+		return true, db.FinishTopUp(ctx, t.ID, "failed", t.TxHash, t.Error)
+	}
+
+	log.Printf("[Keeper %d] Waiting for top-up %d of %s to settle", workerID, t.ID, contractAddr)
+	return false, nil
+}
+
+// saveContractState stores the balance of a contract, what its providers
+// earn and when the balance runs out.
+func saveContractState(ctx context.Context, db *database.DB, contractAddr string, state *ton.ContractState) error {
+	perDay := make(map[string]int64, len(state.Providers))
+	for _, p := range state.Providers {
+		perDay[p.Key] = p.PerDayNano
+	}
+
+	var expiresAt *time.Time
+	if runway, ok := state.Runway(); ok {
+		t := time.Now().Add(runway)
+		expiresAt = &t
+	}
+	return db.UpdateContractFunding(ctx, contractAddr, state.BalanceNano, expiresAt, perDay)
+}
@@ -0,0 +1,46 @@
+package daemons
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/staging"
+)
+
+func RunMultipartCleanerWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, store *staging.Store, maxAge time.Duration) {
+	log.Printf("[Multipart GC %d] Worker started. Removing uploads older than %s 🧺", workerID, maxAge)
+
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+
+			uploads, err := db.GetStaleMultipartUploads(ctx, maxAge, totalWorkers, workerID, 100)
+			if err != nil {
+				log.Printf("[Multipart GC %d] DB Error: %v", workerID, err)
+				continue
+			}
+
+			for _, u := range uploads {
+				if err := db.DeleteMultipartUpload(ctx, u.UploadID); err != nil {
+					log.Printf("[Multipart GC %d] ❌ Failed to drop upload %s: %v", workerID, u.UploadID, err)
+					continue
+				}
+
+				if err := os.RemoveAll(store.MultipartDir(u.UploadID)); err != nil {
+					log.Printf("[Multipart GC %d] ⚠️ Failed to remove parts of %s: %v", workerID, u.UploadID, err)
+					continue
+				}
+
+				log.Printf("[Multipart GC %d] 🗑️ Abandoned upload %s (%s/%s) removed", workerID, u.UploadID, u.BucketName, u.ObjectKey)
+			}
+		}
+	}
+}
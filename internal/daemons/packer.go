@@ -0,0 +1,265 @@
+package daemons
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/staging"
+	"ton-storage-s3-cli/internal/ton"
+)
+
+// maxPackObjects bounds how many objects go into one pack.
+const maxPackObjects = 1000
+
+type PackerConfig struct {
+	MinObjects  int           // objects to collect before a pack is built
+	MaxWait     time.Duration // how long an object waits if fewer were collected
+	LivePercent int           // packs with less live data are repacked
+}
+
+// RunPackerWorker puts small objects waiting in the packing area into packs,
+// directory bags replicated as one, and repacks packs that deletes left
+// mostly dead.
+func RunPackerWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, tonSvc *ton.Service, store *staging.Store, cfg PackerConfig) {
+	log.Printf("[Packer %d] Worker started. Packing small objects 📦", workerID)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			packObjects(ctx, workerID, totalWorkers, db, tonSvc, store, cfg)
+			repackSparsePacks(ctx, workerID, totalWorkers, db, tonSvc, store, cfg)
+		}
+	}
+}
+
+// packObjects packs the waiting objects of each bucket separately: a pack is
+// hired and funded as one bag, under the settings of a single bucket.
+func packObjects(ctx context.Context, workerID, totalWorkers int, db *database.DB, tonSvc *ton.Service, store *staging.Store, cfg PackerConfig) {
+	buckets, err := db.GetPackingBuckets(ctx, totalWorkers, workerID)
+	if err != nil {
+		log.Printf("[Packer %d] DB Error: %v", workerID, err)
+		return
+	}
+
+	for _, bucket := range buckets {
+		if ctx.Err() != nil {
+			return
+		}
+		packBucket(ctx, workerID, totalWorkers, db, tonSvc, store, cfg, bucket)
+	}
+}
+
+func packBucket(ctx context.Context, workerID, totalWorkers int, db *database.DB, tonSvc *ton.Service, store *staging.Store, cfg PackerConfig, bucket string) {
+	files, err := db.GetUnpackedFiles(ctx, bucket, totalWorkers, workerID, maxPackObjects)
+	if err != nil {
+		log.Printf("[Packer %d] DB Error: %v", workerID, err)
+		return
+	}
+	if len(files) == 0 || (len(files) < cfg.MinObjects && time.Since(files[0].CreatedAt) < cfg.MaxWait) {
+		return
+	}
+
+	dir, packID, err := newPackDir(store)
+	if err != nil {
+		log.Printf("[Packer %d] ❌ Failed to create pack: %v", workerID, err)
+		return
+	}
+
+	var ids []int64
+	var names, staged []string
+	var size int64
+	for _, f := range files {
+		src, err := store.PackingPath(f.BagPath)
+		if err != nil {
+			log.Printf("[Packer %d] ⚠️ Invalid staged copy of %s: %v", workerID, f.ObjectKey, err)
+			continue
+		}
+
+		name := strconv.FormatInt(f.ID, 10)
+		if err := linkOrCopy(src, filepath.Join(dir, name)); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("[Packer %d] ⚠️ Failed to pack %s: %v", workerID, f.ObjectKey, err)
+			}
+			continue
+		}
+
+		ids = append(ids, f.ID)
+		names = append(names, name)
+		staged = append(staged, src)
+		size += f.SizeBytes
+	}
+
+	packed, err := buildPack(ctx, tonSvc, dir, func(bagID string) (int, error) {
+		return db.CreatePack(ctx, bagID, size, ids, names)
+	})
+	if err != nil {
+		log.Printf("[Packer %d] ❌ Failed to build pack %s: %v", workerID, packID, err)
+		return
+	}
+	if packed == 0 {
+		return
+	}
+
+	for _, path := range staged {
+		os.Remove(path)
+	}
+	log.Printf("[Packer %d] 📦 Packed %d objects of %s (%d bytes) into pack %s", workerID, packed, bucket, size, packID)
+}
+
+// repackSparsePacks moves the live objects of mostly dead packs into new
+// packs. Offloaded objects are downloaded file by file first.
+func repackSparsePacks(ctx context.Context, workerID, totalWorkers int, db *database.DB, tonSvc *ton.Service, store *staging.Store, cfg PackerConfig) {
+	packs, err := db.GetSparsePacks(ctx, cfg.LivePercent, totalWorkers, workerID, 5)
+	if err != nil {
+		log.Printf("[Packer %d] DB Error: %v", workerID, err)
+		return
+	}
+
+	for _, pack := range packs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := repack(ctx, workerID, db, tonSvc, store, pack); err != nil {
+			log.Printf("[Packer %d] ❌ Failed to repack %s: %v", workerID, pack.BagID, err)
+		}
+	}
+}
+
+func repack(ctx context.Context, workerID int, db *database.DB, tonSvc *ton.Service, store *staging.Store, pack models.Bag) error {
+	files, err := db.GetPackFiles(ctx, pack.BagID)
+	if err != nil {
+		return err
+	}
+	bagBytes, err := hex.DecodeString(pack.BagID)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if _, err := tonSvc.GetPathToBagFile(bagBytes, f.BagPath); err != nil {
+			if err := tonSvc.DownloadBagFile(ctx, bagBytes, f.BagPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	dir, packID, err := newPackDir(store)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var size int64
+	for _, f := range files {
+		src, err := tonSvc.WaitForFile(ctx, bagBytes, f.BagPath)
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		if err := linkOrCopy(src, filepath.Join(dir, f.BagPath)); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		names = append(names, f.BagPath)
+		size += f.SizeBytes
+	}
+
+	var orphaned []string
+	moved, err := buildPack(ctx, tonSvc, dir, func(bagID string) (n int, err error) {
+		n, orphaned, err = db.Repack(ctx, pack.BagID, bagID, size, names)
+		return n, err
+	})
+	if err != nil || moved == 0 {
+		return err
+	}
+
+	for _, bagID := range orphaned {
+		b, _ := hex.DecodeString(bagID)
+		if err := tonSvc.DeleteLocalFile(b); err != nil {
+			log.Printf("[Packer %d] ⚠️ Failed to delete local files of pack %s: %v", workerID, bagID, err)
+		}
+	}
+
+	log.Printf("[Packer %d] ♻️ Repacked %d files of %s (%d of %d bytes live) into pack %s",
+		workerID, moved, pack.BagID, size, pack.SizeBytes, packID)
+	return nil
+}
+
+// buildPack creates the bag of a pack directory and registers it with
+// register, which reports how many objects it holds. A pack holding none is
+// removed again.
+func buildPack(ctx context.Context, tonSvc *ton.Service, dir string, register func(bagID string) (int, error)) (int, error) {
+	entries, _ := os.ReadDir(dir)
+	if len(entries) == 0 {
+		os.RemoveAll(dir)
+		return 0, nil
+	}
+
+	bagIDBytes, err := tonSvc.CreateBag(ctx, filepath.ToSlash(dir))
+	if err != nil {
+		os.RemoveAll(dir)
+		return 0, err
+	}
+
+	n, err := register(hex.EncodeToString(bagIDBytes))
+	if err != nil || n == 0 {
+		if errDel := tonSvc.DeleteLocalFile(bagIDBytes); errDel != nil {
+			log.Printf("⚠️ Failed to drop unused pack %x: %v", bagIDBytes, errDel)
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+func newPackDir(store *staging.Store) (string, string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	packID := hex.EncodeToString(buf)
+
+	dir, err := store.PackDir(packID)
+	if err != nil {
+		return "", "", err
+	}
+	return dir, packID, os.MkdirAll(dir, 0755)
+}
+
+// linkOrCopy puts src at dst, hard-linking it when the file system allows.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil || errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -46,7 +46,7 @@ func RunPingerWorker(ctx context.Context, workerID int, totalWorkers int, db *da
 	}
 }
 
-func processPing(ctx context.Context, workerID int, tonSvc *ton.Service, c models.ContractWithMeta) {
+func processPing(ctx context.Context, workerID int, tonSvc *ton.Service, c models.Contract) {
 	logPrefix := fmt.Sprintf("[Pinger %d | %s]", workerID, c.ProviderAddr)
 
 	bagID, err := hex.DecodeString(c.BagID)
@@ -3,24 +3,22 @@ package daemons
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"log"
-	"math/big"
-	"math/rand"
 	"time"
 
 	"ton-storage-s3-cli/internal/database"
 	"ton-storage-s3-cli/internal/ton"
 	"ton-storage-s3-cli/internal/models"
 
-	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/jackc/pgx/v5"
 )
 
-func RunReplicatorWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, tonSvc *ton.Service) {
+// RunReplicatorWorker hires providers for bags short of replicas. Hires are
+// funded as the bucket of the bag sets, defaultFunding where it does not.
+func RunReplicatorWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, tonSvc *ton.Service, defaultFunding ton.Funding) {
 	log.Printf("[Replicator %d] Worker started. Monitoring file health 🚑", workerID)
 
-	source := rand.NewSource(time.Now().UnixNano() + int64(workerID))
-	rng := rand.New(source)
-
 	for {
 
 		select {
@@ -30,28 +28,55 @@ func RunReplicatorWorker(ctx context.Context, workerID int, totalWorkers int, db
 		default:
 		}
 
-		files, err := db.GetFilesNeedingReplication(ctx, totalWorkers, workerID)
+		bags, err := db.GetBagsNeedingReplication(ctx, totalWorkers, workerID)
 		if err != nil {
 			log.Printf("[Replicator %d] DB Error: %v", workerID, err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
 
-		if len(files) == 0 {
+		if len(bags) == 0 {
 			time.Sleep(10 * time.Second)
 			continue
 		}
 
-		for _, f := range files {
+		candidates, err := db.ListHireableProviders(ctx)
+		if err != nil {
+			log.Printf("[Replicator %d] DB Error: %v", workerID, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		bucketSettings := make(map[string]*models.BucketSettings)
+		for _, bag := range bags {
 			if ctx.Err() != nil {
 				return
 			}
-			processFile(ctx, workerID, db, tonSvc, f, rng)
+
+			settings, ok := bucketSettings[bag.BucketName]
+			if !ok {
+				settings, err = db.GetBucketSettings(ctx, bag.BucketName)
+				if errors.Is(err, pgx.ErrNoRows) {
+					settings = &models.BucketSettings{}
+				} else if err != nil {
+					log.Printf("[Replicator %d] DB Error: %v", workerID, err)
+					continue
+				}
+				bucketSettings[bag.BucketName] = settings
+			}
+
+			policy := ton.BucketPolicy(settings)
+			funding := ton.BucketFunding(settings, defaultFunding)
+			processBag(ctx, workerID, db, tonSvc, bag, candidates, policy, funding)
 		}
 	}
 }
 
-func processFile(ctx context.Context, workerID int, db *database.DB, tonSvc *ton.Service, f models.FileWithStatus, rng *rand.Rand) {
+// processBag hires providers for a bag among candidates until it has its
+// target replicas, choosing them by the policy and selection strategy of its
+// bucket and paying them as funding says. A provider that fails to be hired
+// is not tried again for the bag in this round.
+func processBag(ctx context.Context, workerID int, db *database.DB, tonSvc *ton.Service, f models.BagWithStatus, candidates []models.Provider, policy ton.ProviderPolicy, funding ton.Funding) {
 	needed := f.TargetReplicas - f.ActiveReplicas
 	if needed <= 0 {
 		return
@@ -63,53 +88,58 @@ func processFile(ctx context.Context, workerID int, db *database.DB, tonSvc *ton
 		return
 	}
 
-	log.Printf("[Replicator %d] File %s (ID: %d) needs %d new replicas (Active: %d)",
-		workerID, f.BagID, f.ID, needed, f.ActiveReplicas)
+	log.Printf("[Replicator %d] Bag %s (%d objects) needs %d new replicas (Active: %d)",
+		workerID, f.BagID, f.RefCount, needed, f.ActiveReplicas)
 
 	currentExcludes := make([]string, len(f.UsedProviders))
 	copy(currentExcludes, f.UsedProviders)
 
 	for i := 0; i < needed; i++ {
 
-		providerAddr, err := tonSvc.FindRandomProvider(ctx, currentExcludes)
+		providerAddr, err := ton.SelectProvider(candidates, currentExcludes, f.SizeBytes, policy)
 		if err != nil {
 			log.Printf("[Replicator %d] ⚠️ Failed to find suitable provider: %v", workerID, err)
 			break
 		}
 
-		balance := calcJitterBalance(rng)
+		log.Printf("[Replicator %d] Hiring provider %s for %d days...",
+			workerID, providerAddr, funding.Days)
 
-		log.Printf("[Replicator %d] Hiring provider %s for %s...",
-			workerID, providerAddr, balance.String())
-
-		contractAddr, err := tonSvc.HireProvider(ctx, bagBytes, providerAddr, balance)
+		hire, err := tonSvc.HireProvider(ctx, bagBytes, providerAddr, funding, policy.MaxRateNano)
 		if err != nil {
 			log.Printf("[Replicator %d] ❌ Hire failed: %v", workerID, err)
+			if !errors.Is(err, ton.ErrRateTooHigh) && !errors.Is(err, ton.ErrSpendLimit) && ctx.Err() == nil {
+				if err := db.RecordProviderHire(ctx, providerAddr, false); err != nil {
+					log.Printf("[Replicator %d] DB Error: %v", workerID, err)
+				}
+			}
+			currentExcludes = append(currentExcludes, providerAddr)
 			continue
 		}
 
+		if err := db.RecordProviderHire(ctx, providerAddr, true); err != nil {
+			log.Printf("[Replicator %d] DB Error: %v", workerID, err)
+		}
+
 		newContract := &models.Contract{
-			FileID:		f.ID,
+			BagID:		f.BagID,
 			ProviderAddr:	providerAddr,
-			ContractAddr:	contractAddr,
-			BalanceNano:	balance.Nano().Int64(),
+			ContractAddr:	hire.ContractAddr,
+			BalanceNano:	hire.Amount.Nano().Int64(),
 			Status:		"active",
+			ExpiresAt:	hire.ExpiresAt,
 		}
 
 		if err := db.RegisterContract(ctx, newContract); err != nil {
 			log.Printf("[Replicator %d] Critical: Failed to save contract to DB: %v", workerID, err)
 		} else {
-			log.Printf("[Replicator %d] ✅ Contract created: %s", workerID, contractAddr)
+			paidUntil := "no paid providers"
+			if hire.ExpiresAt != nil {
+				paidUntil = "paid until " + hire.ExpiresAt.Format(time.DateOnly)
+			}
+			log.Printf("[Replicator %d] ✅ Contract created: %s (%s TON, %s)",
+				workerID, hire.ContractAddr, hire.Amount.String(), paidUntil)
 			currentExcludes = append(currentExcludes, providerAddr)
 		}
 	}
 }
-
-func calcJitterBalance(rng *rand.Rand) tlb.Coins {
-	const baseNano = 100_000_000
-	const maxJitter = 10_000_000
-
-	jitter := rng.Int63n(maxJitter)
-	totalNano := big.NewInt(baseNano + jitter)
-	return tlb.FromNanoTON(totalNano)
-}
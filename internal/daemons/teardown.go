@@ -0,0 +1,141 @@
+package daemons
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/ton"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RunTeardownWorker takes back the balance of the storage contracts of
+// deleted bags, retrying failed withdrawals with a growing delay.
+func RunTeardownWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, tonSvc *ton.Service) {
+	log.Printf("[Teardown %d] Worker started. Reclaiming funds of deleted bags 🧾", workerID)
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("[Teardown %d] Stopping...", workerID)
+			return
+		case <-ticker.C:
+		}
+
+		teardowns, err := db.GetDueTeardowns(ctx, totalWorkers, workerID, 20)
+		if err != nil {
+			log.Printf("[Teardown %d] DB Error: %v", workerID, err)
+			continue
+		}
+
+		for _, t := range teardowns {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := tearDown(ctx, workerID, db, tonSvc, t); err != nil {
+				log.Printf("[Teardown %d] ⚠️ Contract %s (attempt %d): %v", workerID, t.ContractAddr, t.Attempts+1, err)
+				if err := db.FailTeardown(ctx, t.ID, err.Error()); err != nil {
+					log.Printf("[Teardown %d] DB Error: %v", workerID, err)
+				}
+			}
+		}
+	}
+}
+
+// tearDown withdraws what is left on the contract of a teardown. A contract
+// that is gone or empty needs nothing; one whose bag was uploaded again is
+// in use and is left alone.
+func tearDown(ctx context.Context, workerID int, db *database.DB, tonSvc *ton.Service, t models.Teardown) error {
+	_, err := db.GetBag(ctx, t.BagID)
+	if err == nil {
+		log.Printf("[Teardown %d] Bag %s is back in the catalog, keeping contract %s", workerID, t.BagID, t.ContractAddr)
+		return db.FinishTeardown(ctx, t.ID, "cancelled", "")
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	state, err := tonSvc.FetchContractState(checkCtx, t.ContractAddr)
+	cancel()
+	if errors.Is(err, ton.ErrNotDeployed) || (err == nil && state.BalanceNano == 0) {
+		log.Printf("[Teardown %d] Contract %s has nothing to withdraw", workerID, t.ContractAddr)
+		return db.FinishTeardown(ctx, t.ID, "done", "")
+	}
+	if err != nil {
+		return err
+	}
+
+	txHash, err := tonSvc.WithdrawContract(ctx, t.ContractAddr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[Teardown %d] ✅ Withdrew %d nanoTON from %s of bag %s. Tx: %s",
+		workerID, state.BalanceNano, t.ContractAddr, t.BagID, txHash)
+	return db.FinishTeardown(ctx, t.ID, "done", txHash)
+}
+
+// RunSweeperWorker looks for storage contracts owned by our wallet that the
+// catalog lost track of: it reads the new transactions of the wallet for
+// contracts it sent messages to, and queues the teardown of those whose bags
+// are not in the catalog.
+func RunSweeperWorker(ctx context.Context, workerID int, totalWorkers int, db *database.DB, tonSvc *ton.Service, interval time.Duration) {
+	log.Printf("[Sweeper %d] Worker started. Sweeping orphaned contracts every %s 🧹", workerID, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sweepContracts(ctx, workerID, db, tonSvc)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[Sweeper %d] Stopping...", workerID)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sweepContracts(ctx context.Context, workerID int, db *database.DB, tonSvc *ton.Service) {
+	walletAddr := tonSvc.WalletAddress()
+
+	afterLT, err := db.GetWalletScanLT(ctx, walletAddr)
+	if err != nil {
+		log.Printf("[Sweeper %d] DB Error: %v", workerID, err)
+		return
+	}
+
+	owned, lastLT, err := tonSvc.ScanOwnedContracts(ctx, afterLT)
+	if err != nil {
+		log.Printf("[Sweeper %d] ⚠️ Failed to scan wallet history: %v", workerID, err)
+		return
+	}
+
+	addrs := make([]string, len(owned))
+	bagIDs := make([]string, len(owned))
+	for i, c := range owned {
+		addrs[i], bagIDs[i] = c.ContractAddr, c.BagID
+	}
+	if err := db.SaveWalletScan(ctx, walletAddr, lastLT, addrs, bagIDs); err != nil {
+		log.Printf("[Sweeper %d] DB Error: %v", workerID, err)
+		return
+	}
+
+	queued, err := db.QueueOrphanedTeardowns(ctx)
+	if err != nil {
+		log.Printf("[Sweeper %d] DB Error: %v", workerID, err)
+		return
+	}
+	if queued > 0 {
+		log.Printf("[Sweeper %d] 🧹 Found %d orphaned contracts, queued for teardown", workerID, queued)
+	}
+}
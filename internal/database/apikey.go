@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (db *DB) CreateAPIKey(ctx context.Context, k *models.APIKey) error {
+	return db.pool.QueryRow(ctx, `
+		INSERT INTO api_keys (access_key, secret_key, is_admin)
+		VALUES ($1, $2, $3)
+		RETURNING created_at
+	`, k.AccessKey, k.SecretKey, k.IsAdmin).Scan(&k.CreatedAt)
+}
+
+func (db *DB) GetAPIKey(ctx context.Context, accessKey string) (*models.APIKey, error) {
+	k := &models.APIKey{}
+	err := db.pool.QueryRow(ctx, `
+		SELECT access_key, secret_key, is_admin, created_at FROM api_keys WHERE access_key = $1
+	`, accessKey).Scan(&k.AccessKey, &k.SecretKey, &k.IsAdmin, &k.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (db *DB) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT access_key, secret_key, is_admin, created_at FROM api_keys ORDER BY created_at, access_key
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.APIKey
+	for rows.Next() {
+		var k models.APIKey
+		if err := rows.Scan(&k.AccessKey, &k.SecretKey, &k.IsAdmin, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, k)
+	}
+	return result, nil
+}
+
+// SetAPIKeyAdmin returns pgx.ErrNoRows if the key does not exist.
+func (db *DB) SetAPIKeyAdmin(ctx context.Context, accessKey string, isAdmin bool) error {
+	tag, err := db.pool.Exec(ctx, `UPDATE api_keys SET is_admin = $2 WHERE access_key = $1`, accessKey, isAdmin)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteAPIKey removes a key together with its grants. It returns
+// pgx.ErrNoRows if the key does not exist.
+func (db *DB) DeleteAPIKey(ctx context.Context, accessKey string) error {
+	tag, err := db.pool.Exec(ctx, `DELETE FROM api_keys WHERE access_key = $1`, accessKey)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (db *DB) CreateAPIKeyGrant(ctx context.Context, g *models.APIKeyGrant) error {
+	return db.pool.QueryRow(ctx, `
+		INSERT INTO api_key_grants (access_key, bucket_name, prefix, actions)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, g.AccessKey, g.BucketName, g.Prefix, g.Actions).Scan(&g.ID, &g.CreatedAt)
+}
+
+func (db *DB) ListAPIKeyGrants(ctx context.Context, accessKey string) ([]models.APIKeyGrant, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT id, access_key, bucket_name, prefix, actions, created_at
+		FROM api_key_grants WHERE access_key = $1 ORDER BY id
+	`, accessKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.APIKeyGrant
+	for rows.Next() {
+		var g models.APIKeyGrant
+		if err := rows.Scan(&g.ID, &g.AccessKey, &g.BucketName, &g.Prefix, &g.Actions, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, g)
+	}
+	return result, nil
+}
+
+// DeleteAPIKeyGrant returns pgx.ErrNoRows if the key has no such grant.
+func (db *DB) DeleteAPIKeyGrant(ctx context.Context, accessKey string, id int64) error {
+	tag, err := db.pool.Exec(ctx, `DELETE FROM api_key_grants WHERE access_key = $1 AND id = $2`, accessKey, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/staging"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreateDedupFile stores f as a new version pointing at an existing bag with
+// the same content in the same bucket, if there is one whose data is still
+// local. Bags are hired and funded under the settings of their bucket, so
+// content of another bucket is never shared. It fills in the bag of f and
+// reports false, storing nothing, when there is no such bag.
+func (db *DB) CreateDedupFile(ctx context.Context, f *models.File) (bool, error) {
+	if f.SHA256 == "" {
+		return false, nil
+	}
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var bagID, status, siblingKey, bagPath, compression string
+	var compressedSize int64
+	var frameIndex []byte
+	err = tx.QueryRow(ctx, `
+		SELECT b.bag_id, b.status, s.object_key, s.bag_path, s.compression, s.compressed_size, s.frame_index
+		FROM bags b
+		JOIN files s ON s.bag_id = b.bag_id AND NOT s.is_delete_marker
+		WHERE b.sha256 = $1 AND s.size_bytes = $2 AND s.bucket_name = $3
+		  AND b.ref_count > 0
+		  AND NOT EXISTS (SELECT 1 FROM files o WHERE o.bag_id = b.bag_id AND o.offloaded)
+		ORDER BY b.id
+		LIMIT 1
+		FOR UPDATE OF b
+	`, f.SHA256, f.SizeBytes, f.BucketName).Scan(&bagID, &status, &siblingKey, &bagPath, &compression, &compressedSize, &frameIndex)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE bags
+		SET ref_count = ref_count + 1, target_replicas = GREATEST(target_replicas, $2)
+		WHERE bag_id = $1
+	`, bagID, f.TargetReplicas)
+	if err != nil {
+		return false, err
+	}
+
+	if bagPath == "" {
+		bagPath = staging.FileName(siblingKey)
+	}
+	f.BagID, f.BagPath, f.Status = bagID, bagPath, status
+	// The bag may hold the content compressed
+	f.Compression, f.CompressedSize, f.FrameIndex = compression, compressedSize, frameIndex
+
+	if f.ID, err = insertFile(ctx, tx, f); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// CreateFileRef stores f as a new version pointing at the bag of another one,
+// or at the same stripes, as a server-side copy does. It fails with
+// pgx.ErrNoRows if a bag has been dropped in the meantime.
+func (db *DB) CreateFileRef(ctx context.Context, f *models.File) (int64, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	bagIDs := []string{f.BagID}
+	if f.Striped {
+		bagIDs = bagIDs[:0]
+		for _, s := range f.Stripes {
+			bagIDs = append(bagIDs, s.BagID)
+		}
+	}
+
+	f.Status = "active"
+	for _, bagID := range bagIDs {
+		var status string
+		err = tx.QueryRow(ctx, `
+			UPDATE bags
+			SET ref_count = ref_count + 1, target_replicas = GREATEST(target_replicas, $2)
+			WHERE bag_id = $1 AND ref_count > 0
+			RETURNING status
+		`, bagID, f.TargetReplicas).Scan(&status)
+		if err != nil {
+			return 0, err
+		}
+		if status != "active" {
+			f.Status = status
+		}
+	}
+
+	id, err := insertFile(ctx, tx, f)
+	if err != nil {
+		return 0, err
+	}
+	if err := insertStripes(ctx, tx, id, f.Stripes); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit(ctx)
+}
+
+// releaseBags drops one reference per entry of bagIDs and deletes the bags
+// nothing points at anymore, together with their contracts, queueing the
+// teardown of the storage contracts. It returns the deleted bags.
+func releaseBags(ctx context.Context, tx pgx.Tx, bagIDs []string) ([]string, error) {
+	if len(bagIDs) == 0 {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(ctx, `
+		WITH released AS (
+			SELECT bag_id, COUNT(*) AS n FROM unnest($1::text[]) AS bag_id GROUP BY bag_id
+		)
+		UPDATE bags b
+		SET ref_count = GREATEST(b.ref_count - r.n, 0)
+		FROM released r
+		WHERE b.bag_id = r.bag_id
+		RETURNING b.bag_id, b.ref_count
+	`, bagIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphaned []string
+	for rows.Next() {
+		var bagID string
+		var refs int
+		if err := rows.Scan(&bagID, &refs); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if refs == 0 {
+			orphaned = append(orphaned, bagID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(orphaned) > 0 {
+		if err := queueTeardowns(ctx, tx, orphaned); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM bags WHERE bag_id = ANY($1)`, orphaned); err != nil {
+			return nil, err
+		}
+	}
+	return orphaned, nil
+}
+
+// GetBag returns a bag by its hex id, pgx.ErrNoRows if there is none.
+func (db *DB) GetBag(ctx context.Context, bagID string) (*models.Bag, error) {
+	b := &models.Bag{}
+	err := db.pool.QueryRow(ctx, `
+		SELECT id, bag_id, sha256, size_bytes, ref_count, target_replicas, status, is_pack, created_at
+		FROM bags WHERE bag_id = $1
+	`, bagID).Scan(&b.ID, &b.BagID, &b.SHA256, &b.SizeBytes, &b.RefCount, &b.TargetReplicas, &b.Status, &b.IsPack, &b.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (db *DB) GetBagsNeedingReplication(ctx context.Context, totalWorkers, workerID int) ([]models.BagWithStatus, error) {
+	query := `
+		SELECT
+			b.id, b.bag_id, b.sha256, b.size_bytes, b.ref_count, b.target_replicas, b.status, b.is_pack, b.created_at,
+			COUNT(c.id) as active_count,
+			COALESCE(array_agg(c.provider_addr) FILTER (WHERE c.provider_addr IS NOT NULL), '{}') || ARRAY(
+				-- Shards of an erasure-coded object go to different providers
+				SELECT sc.provider_addr
+				FROM file_stripes s
+				JOIN files f ON f.id = s.file_id AND f.erasure_data > 0
+				JOIN file_stripes sib ON sib.file_id = s.file_id AND sib.bag_id <> s.bag_id
+				JOIN contracts sc ON sc.bag_id = sib.bag_id AND sc.status IN ('active', 'pending')
+				WHERE s.bag_id = b.bag_id
+			) as used_providers,
+			COALESCE((
+				SELECT f.bucket_name FROM files f
+				WHERE f.bag_id = b.bag_id OR f.id IN (SELECT s.file_id FROM file_stripes s WHERE s.bag_id = b.bag_id)
+				ORDER BY f.id LIMIT 1
+			), '') as bucket_name
+		FROM bags b
+		LEFT JOIN contracts c ON b.bag_id = c.bag_id AND (c.status = 'active' OR c.status = 'pending')
+		WHERE b.ref_count > 0
+		  AND b.id % $1 = $2
+		GROUP BY b.id
+		HAVING COUNT(c.id) < b.target_replicas
+		LIMIT 50
+	`
+
+	rows, err := db.pool.Query(ctx, query, totalWorkers, workerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.BagWithStatus
+	for rows.Next() {
+		var item models.BagWithStatus
+		if err := rows.Scan(
+			&item.ID, &item.BagID, &item.SHA256, &item.SizeBytes, &item.RefCount, &item.TargetReplicas, &item.Status, &item.IsPack, &item.CreatedAt,
+			&item.ActiveReplicas, &item.UsedProviders, &item.BucketName,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// UpgradeBagStatusIfNeeded marks a bag active once enough of its contracts are
+// active. Every object version of the bag follows it.
+func (db *DB) UpgradeBagStatusIfNeeded(ctx context.Context, bagID string) error {
+	return db.setBagStatus(ctx, bagID, `
+		UPDATE bags b
+		SET status = 'active'
+		WHERE b.bag_id = $1
+		  AND b.status = 'pending'
+		  AND (
+			SELECT COUNT(*)
+			FROM contracts c
+			WHERE c.bag_id = b.bag_id AND c.status = 'active'
+		  ) >= b.target_replicas
+	`, "active")
+}
+
+// DowngradeBagStatusIfNeeded marks a bag pending again when it lost replicas.
+func (db *DB) DowngradeBagStatusIfNeeded(ctx context.Context, bagID string) error {
+	return db.setBagStatus(ctx, bagID, `
+		UPDATE bags b
+		SET status = 'pending'
+		WHERE b.bag_id = $1
+		  AND b.status = 'active'
+		  AND (
+			SELECT COUNT(*)
+			FROM contracts c
+			WHERE c.bag_id = b.bag_id AND c.status = 'active'
+		  ) < b.target_replicas
+	`, "pending")
+}
+
+func (db *DB) setBagStatus(ctx context.Context, bagID, query, status string) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, query, bagID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		_, err = tx.Exec(ctx, `
+			UPDATE files SET status = $2
+			WHERE bag_id = $1 AND NOT is_delete_marker AND status <> $2
+		`, bagID, status)
+		if err != nil {
+			return err
+		}
+
+		// A striped object is active once all of its stripes are
+		_, err = tx.Exec(ctx, `
+			UPDATE files f SET status = $2
+			WHERE f.id IN (SELECT file_id FROM file_stripes WHERE bag_id = $1)
+			  AND f.status <> $2
+			  AND ($2 = 'pending' OR NOT EXISTS (
+				SELECT 1 FROM file_stripes s JOIN bags b ON b.bag_id = s.bag_id
+				WHERE s.file_id = f.id AND b.status <> 'active'
+			  ))
+		`, bagID, status)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
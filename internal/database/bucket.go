@@ -3,6 +3,8 @@ package database
 import (
 	"context"
 	"time"
+
+	"ton-storage-s3-cli/internal/models"
 )
 
 type Bucket struct {
@@ -15,9 +17,38 @@ func (db *DB) CreateBucket(ctx context.Context, name string) error {
 	return err
 }
 
-func (db *DB) DeleteBucket(ctx context.Context, name string) error {
-	_, err := db.pool.Exec(ctx, "DELETE FROM buckets WHERE name=$1", name)
-	return err
+// DeleteBucket removes a bucket with all its object versions and returns the
+// bags no other bucket points at anymore.
+func (db *DB) DeleteBucket(ctx context.Context, name string) ([]string, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var bagIDs []string
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(array_agg(bag_id), '{}') FROM (
+			SELECT bag_id FROM files
+			WHERE bucket_name = $1 AND NOT is_delete_marker AND bag_id <> ''
+			UNION ALL
+			SELECT s.bag_id FROM file_stripes s JOIN files f ON f.id = s.file_id
+			WHERE f.bucket_name = $1
+		) refs
+	`, name).Scan(&bagIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM buckets WHERE name=$1", name); err != nil {
+		return nil, err
+	}
+
+	orphaned, err := releaseBags(ctx, tx, bagIDs)
+	if err != nil {
+		return nil, err
+	}
+	return orphaned, tx.Commit(ctx)
 }
 
 func (db *DB) BucketExists(ctx context.Context, name string) (bool, error) {
@@ -44,5 +75,98 @@ func (db *DB) ListBuckets(ctx context.Context) ([]Bucket, error) {
 	return result, nil
 }
 
+func (db *DB) GetBucketVersioning(ctx context.Context, name string) (string, error) {
+	var status string
+	err := db.pool.QueryRow(ctx, "SELECT versioning FROM buckets WHERE name=$1", name).Scan(&status)
+	return status, err
+}
+
+func (db *DB) SetBucketVersioning(ctx context.Context, name, status string) error {
+	_, err := db.pool.Exec(ctx, "UPDATE buckets SET versioning=$2 WHERE name=$1", name, status)
+	return err
+}
+
+// GetBucketErasure returns the erasure code new objects of a bucket are
+// stored with; 0 data shards means full replicas.
+func (db *DB) GetBucketErasure(ctx context.Context, name string) (int, int, error) {
+	var data, parity int
+	err := db.pool.QueryRow(ctx, "SELECT erasure_data, erasure_parity FROM buckets WHERE name=$1", name).Scan(&data, &parity)
+	return data, parity, err
+}
 
+// SetBucketErasure sets the erasure code of a bucket. It reports false if
+// there is no such bucket.
+func (db *DB) SetBucketErasure(ctx context.Context, name string, data, parity int) (bool, error) {
+	tag, err := db.pool.Exec(ctx, "UPDATE buckets SET erasure_data=$2, erasure_parity=$3 WHERE name=$1", name, data, parity)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
 
+// GetBucketSettings returns the settings of a bucket, pgx.ErrNoRows if there
+// is no such bucket.
+func (db *DB) GetBucketSettings(ctx context.Context, name string) (*models.BucketSettings, error) {
+	s := &models.BucketSettings{}
+	err := db.pool.QueryRow(ctx, `
+		SELECT default_replicas, allowed_providers, blocked_providers, max_rate_nano,
+		       erasure_data, erasure_parity, compression, encryption, offload_policy, offload_after_hours,
+		       selection_strategy, storage_days, max_funding_nano, topup_below_days
+		FROM buckets WHERE name=$1
+	`, name).Scan(
+		&s.DefaultReplicas, &s.AllowedProviders, &s.BlockedProviders, &s.MaxRateNano,
+		&s.ErasureData, &s.ErasureParity, &s.Compression, &s.Encryption, &s.OffloadPolicy, &s.OffloadAfterHours,
+		&s.SelectionStrategy, &s.StorageDays, &s.MaxFundingNano, &s.TopUpBelowDays,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetBucketSettings replaces the settings of a bucket. It reports false if
+// there is no such bucket.
+func (db *DB) SetBucketSettings(ctx context.Context, name string, s *models.BucketSettings) (bool, error) {
+	allowed, blocked := s.AllowedProviders, s.BlockedProviders
+	if allowed == nil {
+		allowed = []string{}
+	}
+	if blocked == nil {
+		blocked = []string{}
+	}
+
+	tag, err := db.pool.Exec(ctx, `
+		UPDATE buckets SET
+			default_replicas=$2, allowed_providers=$3, blocked_providers=$4, max_rate_nano=$5,
+			erasure_data=$6, erasure_parity=$7, compression=$8, encryption=$9, offload_policy=$10, offload_after_hours=$11,
+			selection_strategy=$12, storage_days=$13, max_funding_nano=$14,
+			topup_below_days=$15
+		WHERE name=$1
+	`, name,
+		s.DefaultReplicas, allowed, blocked, s.MaxRateNano,
+		s.ErasureData, s.ErasureParity, s.Compression, s.Encryption, s.OffloadPolicy, s.OffloadAfterHours,
+		s.SelectionStrategy, s.StorageDays, s.MaxFundingNano, s.TopUpBelowDays,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetBucketCompression returns the codec new objects of a bucket are
+// compressed with, "" for none.
+func (db *DB) GetBucketCompression(ctx context.Context, name string) (string, error) {
+	var codec string
+	err := db.pool.QueryRow(ctx, "SELECT compression FROM buckets WHERE name=$1", name).Scan(&codec)
+	return codec, err
+}
+
+// SetBucketCompression sets the codec of a bucket. It reports false if there
+// is no such bucket.
+func (db *DB) SetBucketCompression(ctx context.Context, name, codec string) (bool, error) {
+	tag, err := db.pool.Exec(ctx, "UPDATE buckets SET compression=$2 WHERE name=$1", name, codec)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
@@ -3,13 +3,41 @@ package database
 import (
 	"ton-storage-s3-cli/internal/models"
 	"context"
+
+	"github.com/jackc/pgx/v5"
 )
 
+const contractColumns = `c.id, c.bag_id, c.provider_addr, c.contract_addr, c.balance_nano_ton, c.status, c.last_check, c.expires_at,
+	c.per_day_nano, c.balance_checked_at`
+
+func scanContract(row pgx.Row, c *models.Contract) error {
+	return row.Scan(&c.ID, &c.BagID, &c.ProviderAddr, &c.ContractAddr, &c.BalanceNano, &c.Status, &c.LastCheck, &c.ExpiresAt,
+		&c.PerDayNano, &c.BalanceCheckedAt)
+}
+
+func (db *DB) queryContracts(ctx context.Context, query string, args ...any) ([]models.Contract, error) {
+	rows, err := db.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.Contract
+	for rows.Next() {
+		var c models.Contract
+		if err := scanContract(rows, &c); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
 func (db *DB) RegisterContract(ctx context.Context, c *models.Contract) error {
 	_, err := db.pool.Exec(ctx, `
-		INSERT INTO contracts (file_id, provider_addr, contract_addr, balance_nano_ton, status)
-		VALUES ($1, $2, $3, $4, 'pending')
-	`, c.FileID, c.ProviderAddr, c.ContractAddr, c.BalanceNano)
+		INSERT INTO contracts (bag_id, provider_addr, contract_addr, balance_nano_ton, status, expires_at)
+		VALUES ($1, $2, $3, $4, 'pending', $5)
+	`, c.BagID, c.ProviderAddr, c.ContractAddr, c.BalanceNano, c.ExpiresAt)
 	return err
 }
 
@@ -28,141 +56,73 @@ func (db *DB) UpdateContractCheck(ctx context.Context, contractID int64) error {
 	return err
 }
 
-func (db *DB) GetAllContracts(ctx context.Context, totalWorkers, workerID int) ([]models.ContractWithMeta, error) {
-	query := `
-		SELECT c.id, c.file_id, c.provider_addr, c.contract_addr, c.balance_nano_ton, c.last_check, f.bag_id
+func (db *DB) GetAllContracts(ctx context.Context, totalWorkers, workerID int) ([]models.Contract, error) {
+	return db.queryContracts(ctx, `
+		SELECT `+contractColumns+`
 		FROM contracts c
-		JOIN files f ON c.file_id = f.id
 		WHERE c.id % $1 = $2
-		ORDER BY c.last_check ASC 
+		ORDER BY c.last_check ASC
 		LIMIT 20
-	`
-	rows, err := db.pool.Query(ctx, query, totalWorkers, workerID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var result []models.ContractWithMeta
-	for rows.Next() {
-		var c models.ContractWithMeta
-		if err := rows.Scan(&c.ID, &c.FileID, &c.ProviderAddr, &c.ContractAddr, &c.BalanceNano, &c.LastCheck, &c.BagID); err != nil {
-			return nil, err
-		}
-		result = append(result, c)
-	}
-	return result, nil
+	`, totalWorkers, workerID)
 }
 
-func (db *DB) GetActiveContracts(ctx context.Context, totalWorkers, workerID int) ([]models.ContractWithMeta, error) {
-	query := `
-		SELECT c.id, c.file_id, c.provider_addr, c.contract_addr, c.balance_nano_ton, c.last_check, f.bag_id
+func (db *DB) GetActiveContracts(ctx context.Context, totalWorkers, workerID int) ([]models.Contract, error) {
+	return db.queryContracts(ctx, `
+		SELECT `+contractColumns+`
 		FROM contracts c
-		JOIN files f ON c.file_id = f.id
-		WHERE c.status = 'active' 
+		WHERE c.status = 'active'
 		  AND c.created_at < NOW() - INTERVAL '12 hours'
 		  AND c.id % $1 = $2
-		ORDER BY c.last_check ASC 
+		ORDER BY c.last_check ASC
 		LIMIT 20
-	`
-	rows, err := db.pool.Query(ctx, query, totalWorkers, workerID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var result []models.ContractWithMeta
-	for rows.Next() {
-		var c models.ContractWithMeta
-		if err := rows.Scan(&c.ID, &c.FileID, &c.ProviderAddr, &c.ContractAddr, &c.BalanceNano, &c.LastCheck, &c.BagID); err != nil {
-			return nil, err
-		}
-		result = append(result, c)
-	}
-	return result, nil
+	`, totalWorkers, workerID)
 }
 
-func (db *DB) GetContractByBagID(ctx context.Context, bagID string) (*models.ContractWithMeta, error) {
-	query := `
-		SELECT c.id, c.file_id, c.provider_addr, c.contract_addr, c.balance_nano_ton, c.last_check, f.bag_id
+func (db *DB) GetContractByBagID(ctx context.Context, bagID string) (*models.Contract, error) {
+	var c models.Contract
+	err := scanContract(db.pool.QueryRow(ctx, `
+		SELECT `+contractColumns+`
 		FROM contracts c
-		JOIN files f ON c.file_id = f.id
-		WHERE f.bag_id = $1
+		WHERE c.bag_id = $1
 		ORDER BY c.id DESC
 		LIMIT 1
-	`
-	var c models.ContractWithMeta
-	err := db.pool.QueryRow(ctx, query, bagID).Scan(
-		&c.ID, &c.FileID, &c.ProviderAddr, &c.ContractAddr, &c.BalanceNano, &c.LastCheck, &c.BagID,
-	)
+	`, bagID), &c)
 	if err != nil {
 		return nil, err
 	}
 	return &c, nil
 }
 
-func (db *DB) GetContractByID(ctx context.Context, id int64) (*models.ContractWithMeta, error) {
-	query := `
-		SELECT c.id, c.file_id, c.provider_addr, c.contract_addr, c.balance_nano_ton, c.last_check, f.bag_id
+func (db *DB) GetContractByID(ctx context.Context, id int64) (*models.Contract, error) {
+	var c models.Contract
+	err := scanContract(db.pool.QueryRow(ctx, `
+		SELECT `+contractColumns+`
 		FROM contracts c
-		JOIN files f ON c.file_id = f.id
 		WHERE c.id = $1
-	`
-	var c models.ContractWithMeta
-	err := db.pool.QueryRow(ctx, query, id).Scan(
-		&c.ID, &c.FileID, &c.ProviderAddr, &c.ContractAddr, &c.BalanceNano, &c.LastCheck, &c.BagID,
-	)
+	`, id), &c)
 	if err != nil {
 		return nil, err
 	}
 	return &c, nil
 }
 
-func (db *DB) GetFileContracts(ctx context.Context, fileID int64) ([]models.Contract, error) {
-	rows, err := db.pool.Query(ctx, `
-		SELECT id, file_id, provider_addr, contract_addr, balance_nano_ton, status, last_check
-		FROM contracts WHERE file_id=$1
-	`, fileID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var result []models.Contract
-	for rows.Next() {
-		var c models.Contract
-		if err := rows.Scan(&c.ID, &c.FileID, &c.ProviderAddr, &c.ContractAddr, &c.BalanceNano, &c.Status, &c.LastCheck); err != nil {
-			return nil, err
-		}
-		result = append(result, c)
-	}
-	return result, nil
+// GetBagContracts returns every contract of a bag, i.e. the replicas of all
+// object versions sharing it.
+func (db *DB) GetBagContracts(ctx context.Context, bagID string) ([]models.Contract, error) {
+	return db.queryContracts(ctx, `
+		SELECT `+contractColumns+`
+		FROM contracts c WHERE c.bag_id = $1
+	`, bagID)
 }
 
-func (db *DB) GetContractsForAudit(ctx context.Context, totalWorkers, workerID int) ([]models.ContractWithMeta, error) {
-	query := `
-		SELECT c.id, c.file_id, c.provider_addr, c.contract_addr, c.balance_nano_ton, c.last_check, f.bag_id, c.status
+func (db *DB) GetContractsForAudit(ctx context.Context, totalWorkers, workerID int) ([]models.Contract, error) {
+	return db.queryContracts(ctx, `
+		SELECT `+contractColumns+`
 		FROM contracts c
-		JOIN files f ON c.file_id = f.id
 		WHERE c.status IN ('active', 'pending')
 		  AND c.id % $1 = $2
 		  AND c.last_check < NOW() - INTERVAL '2 minutes'
-		ORDER BY c.last_check ASC 
+		ORDER BY c.last_check ASC
 		LIMIT 20
-	`
-	rows, err := db.pool.Query(ctx, query, totalWorkers, workerID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var result []models.ContractWithMeta
-	for rows.Next() {
-		var c models.ContractWithMeta
-		if err := rows.Scan(&c.ID, &c.FileID, &c.ProviderAddr, &c.ContractAddr, &c.BalanceNano, &c.LastCheck, &c.BagID, &c.Status); err != nil {
-			return nil, err
-		}
-		result = append(result, c)
-	}
-	return result, nil
-}
\ No newline at end of file
+	`, totalWorkers, workerID)
+}
@@ -17,6 +17,22 @@ func (db *DB) StartDownloadJob(ctx context.Context, fileID int64) (int64, error)
 	return jobID, nil
 }
 
+// StartRestoreJob registers a download that brings an offloaded object back
+// for days days. It returns pgx.ErrNoRows if a restore is already running.
+func (db *DB) StartRestoreJob(ctx context.Context, fileID int64, days int) (int64, error) {
+	var jobID int64
+	err := db.pool.QueryRow(ctx, `
+		INSERT INTO downloads (file_id, status, restore_days)
+		VALUES ($1, 'running', $2)
+		ON CONFLICT (file_id) WHERE status = 'running' AND restore_days > 0 DO NOTHING
+		RETURNING id
+	`, fileID, days).Scan(&jobID)
+	if err != nil {
+		return 0, err
+	}
+	return jobID, nil
+}
+
 func (db *DB) FinishDownloadJob(ctx context.Context, jobID int64, success bool, errorMsg string) error {
 	status := "completed"
 	if !success {
@@ -39,10 +55,31 @@ func (db *DB) FinishDownloadJob(ctx context.Context, jobID int64, success bool,
 	}
 
 	if success {
+		// A finished restore makes the data local again for every object that
+		// shares it: all of a bag, but only the restored file of a pack. Reads
+		// streamed during the restore do not. Copies of a striped object share
+		// no bag with it and are left as they are
 		_, err = tx.Exec(ctx, `
-			UPDATE files 
-			SET status = 'active' 
-			WHERE id = (SELECT file_id FROM downloads WHERE id = $1)
+			UPDATE files f
+			SET offloaded = FALSE
+			FROM downloads d JOIN files src ON src.id = d.file_id
+			WHERE d.id = $1 AND d.restore_days > 0
+			  AND (f.id = src.id OR (
+				src.bag_id <> '' AND f.bag_id = src.bag_id
+				AND (f.bag_path = src.bag_path OR NOT EXISTS (
+					SELECT 1 FROM bags b WHERE b.bag_id = src.bag_id AND b.is_pack
+				))
+			  ))
+		`, jobID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+			UPDATE files f
+			SET restore_expires_at = NOW() + make_interval(days => d.restore_days)
+			FROM downloads d
+			WHERE d.id = $1 AND f.id = d.file_id AND d.restore_days > 0
 		`, jobID)
 		if err != nil {
 			return err
@@ -70,4 +107,14 @@ func (db *DB) ResetStuckDownloads(ctx context.Context) error {
 		WHERE status = 'running'
 	`)
 	return err
-}
\ No newline at end of file
+}
+func (db *DB) IsFileRestoring(ctx context.Context, fileID int64) (bool, error) {
+	var exists bool
+	err := db.pool.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM downloads
+			WHERE file_id = $1 AND status = 'running' AND restore_days > 0
+		)
+	`, fileID).Scan(&exists)
+	return exists, err
+}
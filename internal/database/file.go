@@ -2,60 +2,144 @@ package database
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"ton-storage-s3-cli/internal/models"
+
+	"github.com/jackc/pgx/v5"
 )
 
+const fileColumns = `id, bucket_name, object_key, bag_id, size_bytes, target_replicas, status, created_at, md5, sha256, crc32c, metadata, version_id, is_latest, is_delete_marker, bag_path, striped, erasure_data, erasure_parity, compression, compressed_size, frame_index, sse, sse_key, sse_key_md5, offloaded, restore_expires_at`
+
+func scanFile(row pgx.Row, f *models.File) error {
+	return row.Scan(
+		&f.ID, &f.BucketName, &f.ObjectKey, &f.BagID, &f.SizeBytes,
+		&f.TargetReplicas, &f.Status, &f.CreatedAt, &f.MD5, &f.SHA256, &f.CRC32C, &f.Metadata,
+		&f.VersionID, &f.IsLatest, &f.IsDeleteMarker, &f.BagPath, &f.Striped, &f.ErasureData, &f.ErasureParity,
+		&f.Compression, &f.CompressedSize, &f.FrameIndex, &f.Encryption, &f.EncryptedKey, &f.CustomerKeyMD5, &f.Offloaded, &f.RestoreExpiresAt,
+	)
+}
 
+// CreateFile inserts a new version of an object and makes it the latest one.
+// The version takes a reference on its bag, or on the bag of each of its
+// stripes, which is registered on first use.
 func (db *DB) CreateFile(ctx context.Context, f *models.File) (int64, error) {
-	var id int64
-	err := db.pool.QueryRow(ctx, `
-		INSERT INTO files (bucket_name, object_key, bag_id, size_bytes, target_replicas, status)
-		VALUES ($1, $2, $3, $4, $5, 'pending')
-		RETURNING id
-	`, f.BucketName, f.ObjectKey, f.BagID, f.SizeBytes, f.TargetReplicas).Scan(&id)
-	return id, err
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// The bag of an encrypted object holds ciphertext, which deduplication
+	// must not match by the digest of the plaintext
+	sha256 := f.SHA256
+	if f.Encryption != "" {
+		sha256 = ""
+	}
+
+	// The bag of a compressed object holds the compressed data
+	size := f.SizeBytes
+	if f.Compression != "" {
+		size = f.CompressedSize
+	}
+
+	// Objects waiting to be packed have no bag yet
+	if !f.IsDeleteMarker && f.BagID != "" {
+		if err := addBagRef(ctx, tx, f.BagID, sha256, size, f.TargetReplicas, f.Status); err != nil {
+			return 0, err
+		}
+	}
+	for _, s := range f.Stripes {
+		if err := addBagRef(ctx, tx, s.BagID, "", s.SizeBytes, f.TargetReplicas, f.Status); err != nil {
+			return 0, err
+		}
+	}
+
+	id, err := insertFile(ctx, tx, f)
+	if err != nil {
+		return 0, err
+	}
+	if err := insertStripes(ctx, tx, id, f.Stripes); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit(ctx)
 }
 
-func (db *DB) GetFilesNeedingReplication(ctx context.Context, totalWorkers, workerID int) ([]models.FileWithStatus, error) {
-	query := `
-		SELECT 
-			f.id, f.bucket_name, f.object_key, f.bag_id, f.target_replicas, 
-			COUNT(c.id) as active_count,
-			COALESCE(array_agg(c.provider_addr) FILTER (WHERE c.provider_addr IS NOT NULL), '{}') as used_providers
-		FROM files f
-		LEFT JOIN contracts c ON f.id = c.file_id AND (c.status = 'active' OR c.status = 'pending')
-		WHERE f.status != 'deleted' 
-		  AND f.id % $1 = $2
-		GROUP BY f.id
-		HAVING COUNT(c.id) < f.target_replicas
-		LIMIT 50
-	`
+func addBagRef(ctx context.Context, tx pgx.Tx, bagID, sha256 string, sizeBytes int64, replicas int, status string) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO bags (bag_id, sha256, size_bytes, ref_count, target_replicas, status)
+		VALUES ($1, $2, $3, 1, $4, $5)
+		ON CONFLICT (bag_id) DO UPDATE
+		SET ref_count = bags.ref_count + 1,
+		    target_replicas = GREATEST(bags.target_replicas, EXCLUDED.target_replicas)
+	`, bagID, sha256, sizeBytes, replicas, status)
+	return err
+}
 
-	rows, err := db.pool.Query(ctx, query, totalWorkers, workerID)
+func insertStripes(ctx context.Context, tx pgx.Tx, fileID int64, stripes []models.Stripe) error {
+	for _, s := range stripes {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO file_stripes (file_id, idx, bag_id, bag_path, offset_bytes, size_bytes)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, fileID, s.Index, s.BagID, s.BagPath, s.Offset, s.SizeBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFileStripes returns the stripes, or the shards, of a striped object
+// version in order.
+func (db *DB) GetFileStripes(ctx context.Context, fileID int64) ([]models.Stripe, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT idx, bag_id, bag_path, offset_bytes, size_bytes
+		FROM file_stripes
+		WHERE file_id = $1
+		ORDER BY idx
+	`, fileID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var result []models.FileWithStatus
+	var result []models.Stripe
 	for rows.Next() {
-		var item models.FileWithStatus
-		if err := rows.Scan(
-			&item.ID, &item.BucketName, &item.ObjectKey, &item.BagID, &item.TargetReplicas,
-			&item.ActiveReplicas, &item.UsedProviders,
-		); err != nil {
+		var s models.Stripe
+		if err := rows.Scan(&s.Index, &s.BagID, &s.BagPath, &s.Offset, &s.SizeBytes); err != nil {
 			return nil, err
 		}
-		result = append(result, item)
+		result = append(result, s)
 	}
-	return result, nil
+	return result, rows.Err()
+}
+
+func insertFile(ctx context.Context, tx pgx.Tx, f *models.File) (int64, error) {
+	_, err := tx.Exec(ctx, `
+		UPDATE files SET is_latest = FALSE
+		WHERE bucket_name = $1 AND object_key = $2 AND is_latest
+	`, f.BucketName, f.ObjectKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO files (bucket_name, object_key, bag_id, size_bytes, target_replicas, status, md5, sha256, crc32c, metadata, version_id, is_latest, is_delete_marker, bag_path, striped, erasure_data, erasure_parity, compression, compressed_size, frame_index, sse, sse_key, sse_key_md5, offloaded)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, TRUE, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)
+		RETURNING id
+	`, f.BucketName, f.ObjectKey, f.BagID, f.SizeBytes, f.TargetReplicas, f.Status, f.MD5, f.SHA256, f.CRC32C, f.Metadata, f.VersionID, f.IsDeleteMarker, f.BagPath, f.Striped, f.ErasureData, f.ErasureParity,
+		f.Compression, f.CompressedSize, f.FrameIndex, f.Encryption, f.EncryptedKey, f.CustomerKeyMD5, f.Offloaded).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
 }
 
 func (db *DB) ListFiles(ctx context.Context, limit, offset int) ([]models.File, error) {
 	rows, err := db.pool.Query(ctx, `
-		SELECT id, bucket_name, object_key, bag_id, size_bytes, target_replicas, status, created_at 
+		SELECT `+fileColumns+`
 		FROM files 
 		ORDER BY created_at DESC 
 		LIMIT $1 OFFSET $2
@@ -69,7 +153,7 @@ func (db *DB) ListFiles(ctx context.Context, limit, offset int) ([]models.File,
 	for rows.Next() {
 		var f models.File
 
-		if err := rows.Scan(&f.ID, &f.BucketName, &f.ObjectKey, &f.BagID, &f.SizeBytes, &f.TargetReplicas, &f.Status, &f.CreatedAt); err != nil {
+		if err := scanFile(rows, &f); err != nil {
 			return nil, err
 		}
 		result = append(result, f)
@@ -79,25 +163,34 @@ func (db *DB) ListFiles(ctx context.Context, limit, offset int) ([]models.File,
 
 func (db *DB) GetFileByID(ctx context.Context, id int64) (*models.File, error) {
 	f := &models.File{}
-	err := db.pool.QueryRow(ctx, `
-		SELECT id, bucket_name, object_key, bag_id, size_bytes, target_replicas, status, created_at
+	err := scanFile(db.pool.QueryRow(ctx, `
+		SELECT `+fileColumns+`
 		FROM files WHERE id=$1
-	`, id).Scan(&f.ID, &f.BucketName, &f.ObjectKey, &f.BagID, &f.SizeBytes, &f.TargetReplicas, &f.Status, &f.CreatedAt)
+	`, id), f)
 	if err != nil {
 		return nil, err
 	}
 	return f, nil
 }
 
+// GetFilesReadyForCleaning returns versions whose local copy can be dropped:
+// older than interval and the offload delay of their bucket, with no version
+// sharing their bag in a bucket that never offloads, and not being read or
+// restored.
 func (db *DB) GetFilesReadyForCleaning(ctx context.Context, interval time.Duration, totalWorkers, workerID, limit int) ([]models.File, error) {
 	query := `
-		SELECT f.id, f.bucket_name, f.object_key, f.bag_id, f.size_bytes, f.target_replicas, f.status, f.created_at
+		SELECT ` + fileColumns + `
 		FROM files f
-		LEFT JOIN downloads d ON f.id = d.file_id AND d.status = 'running'
+		JOIN buckets bk ON bk.name = f.bucket_name
 		WHERE f.created_at < (NOW() - $1::interval)
+		  AND f.created_at < (NOW() - make_interval(hours => bk.offload_after_hours))
 		  AND f.id % $2 = $3
 		  AND f.status = 'active'
-		  AND d.id IS NULL
+		  AND NOT f.offloaded
+		  AND NOT EXISTS (SELECT 1 FROM downloads d JOIN files df ON df.id = d.file_id WHERE (df.bag_id = f.bag_id AND f.bag_id <> '' OR df.id = f.id) AND d.status = 'running')
+		  AND NOT EXISTS (SELECT 1 FROM files r WHERE (r.bag_id = f.bag_id AND f.bag_id <> '' OR r.id = f.id) AND r.restore_expires_at > NOW())
+		  AND NOT EXISTS (SELECT 1 FROM files r WHERE (r.bag_id = f.bag_id AND f.bag_id <> '' OR r.id = f.id) AND r.created_at >= (NOW() - $1::interval))
+		  AND NOT EXISTS (SELECT 1 FROM files r JOIN buckets rb ON rb.name = r.bucket_name WHERE (r.bag_id = f.bag_id AND f.bag_id <> '' OR r.id = f.id) AND rb.offload_policy = 'never')
 		ORDER BY f.created_at ASC
 		LIMIT $4
 	`
@@ -111,10 +204,7 @@ func (db *DB) GetFilesReadyForCleaning(ctx context.Context, interval time.Durati
 	var result []models.File
 	for rows.Next() {
 		var f models.File
-		if err := rows.Scan(
-			&f.ID, &f.BucketName, &f.ObjectKey, &f.BagID, &f.SizeBytes, 
-			&f.TargetReplicas, &f.Status, &f.CreatedAt,
-		); err != nil {
+		if err := scanFile(rows, &f); err != nil {
 			return nil, err
 		}
 		result = append(result, f)
@@ -122,56 +212,166 @@ func (db *DB) GetFilesReadyForCleaning(ctx context.Context, interval time.Durati
 	return result, nil
 }
 
-func (db *DB) DeleteFile(ctx context.Context, bucketName, objectKey string) error {
-	_, err := db.pool.Exec(ctx, `
-		DELETE FROM files 
-		WHERE bucket_name = $1 AND object_key = $2
-	`, bucketName, objectKey)
-	return err
+// DeleteFile permanently removes one version of an object. If it was the
+// latest version, the newest remaining one takes its place. It returns the
+// bags the version held the last reference on; they are dropped together with
+// their contracts, and their data can be removed.
+func (db *DB) DeleteFile(ctx context.Context, id int64) ([]string, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// The stripes go with the version
+	var bagIDs []string
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(array_agg(bag_id), '{}') FROM file_stripes WHERE file_id = $1
+	`, id).Scan(&bagIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var bucketName, objectKey, bagID string
+	var wasLatest, isDeleteMarker bool
+	err = tx.QueryRow(ctx, `
+		DELETE FROM files WHERE id = $1
+		RETURNING bucket_name, object_key, bag_id, is_latest, is_delete_marker
+	`, id).Scan(&bucketName, &objectKey, &bagID, &wasLatest, &isDeleteMarker)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if wasLatest {
+		_, err = tx.Exec(ctx, `
+			UPDATE files SET is_latest = TRUE
+			WHERE id = (
+				SELECT id FROM files
+				WHERE bucket_name = $1 AND object_key = $2
+				ORDER BY id DESC
+				LIMIT 1
+			)
+		`, bucketName, objectKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !isDeleteMarker && bagID != "" {
+		bagIDs = append(bagIDs, bagID)
+	}
+	orphaned, err := releaseBags(ctx, tx, bagIDs)
+	if err != nil {
+		return nil, err
+	}
+	return orphaned, tx.Commit(ctx)
 }
 
+// GetFileMeta returns the latest version of an object, which may be a delete marker.
 func (db *DB) GetFileMeta(ctx context.Context, bucketName, objectKey string) (*models.File, error) {
 	f := &models.File{}
-	err := db.pool.QueryRow(ctx, `
-		SELECT id, bucket_name, object_key, bag_id, size_bytes, target_replicas, status, created_at
+	err := scanFile(db.pool.QueryRow(ctx, `
+		SELECT `+fileColumns+`
 		FROM files 
-		WHERE bucket_name = $1 AND object_key = $2
-	`, bucketName, objectKey).Scan(
-		&f.ID, &f.BucketName, &f.ObjectKey, &f.BagID, &f.SizeBytes, 
-		&f.TargetReplicas, &f.Status, &f.CreatedAt,
-	)
+		WHERE bucket_name = $1 AND object_key = $2 AND is_latest
+	`, bucketName, objectKey), f)
 	if err != nil {
 		return nil, err
 	}
 	return f, nil
 }
 
-func (db *DB) UpgradeFileStatusIfNeeded(ctx context.Context, fileID int64) error {
+func (db *DB) GetFileVersion(ctx context.Context, bucketName, objectKey, versionID string) (*models.File, error) {
+	f := &models.File{}
+	err := scanFile(db.pool.QueryRow(ctx, `
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE bucket_name = $1 AND object_key = $2 AND version_id = $3
+	`, bucketName, objectKey, versionID), f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ListFileVersions returns versions of the objects under prefix ordered by key
+// and from newest to oldest, starting after the (keyMarker, idMarker) pair.
+// An idMarker of 0 skips all versions of keyMarker.
+func (db *DB) ListFileVersions(ctx context.Context, bucketName, prefix, keyMarker string, idMarker int64, limit int) ([]models.File, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE bucket_name = $1
+		  AND starts_with(object_key, $2)
+		  AND (object_key COLLATE "C" > $3 OR (object_key = $3 AND id < $4))
+		ORDER BY object_key COLLATE "C", id DESC
+		LIMIT $5
+	`, bucketName, prefix, keyMarker, idMarker, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.File
+	for rows.Next() {
+		var f models.File
+		if err := scanFile(rows, &f); err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// ListLatestFiles returns the current, non-deleted versions of objects whose
+// key starts with prefix and lies in [from, to), in binary key order. An empty
+// to means no upper bound.
+func (db *DB) ListLatestFiles(ctx context.Context, bucketName, prefix, from, to string, limit int) ([]models.File, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE bucket_name = $1
+		  AND is_latest AND NOT is_delete_marker
+		  AND starts_with(object_key, $2)
+		  AND object_key COLLATE "C" >= $3
+		  AND ($4 = '' OR object_key COLLATE "C" < $4)
+		ORDER BY object_key COLLATE "C"
+		LIMIT $5
+	`, bucketName, prefix, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.File
+	for rows.Next() {
+		var f models.File
+		if err := scanFile(rows, &f); err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// MarkBagOffloaded records that the local copy of a bag is gone. Restored
+// copies of any object sharing the bag, or striped across it, are dropped
+// with it.
+func (db *DB) MarkBagOffloaded(ctx context.Context, bagID string) error {
 	_, err := db.pool.Exec(ctx, `
-		UPDATE files f
-		SET status = 'active'
-		WHERE f.id = $1
-		  AND f.status = 'pending'
-		  AND (
-			SELECT COUNT(*) 
-			FROM contracts c 
-			WHERE c.file_id = f.id AND c.status = 'active'
-		  ) >= f.target_replicas
-	`, fileID)
+		UPDATE files SET offloaded = TRUE, restore_expires_at = NULL
+		WHERE bag_id = $1 OR id IN (SELECT file_id FROM file_stripes WHERE bag_id = $1)
+	`, bagID)
 	return err
 }
 
-func (db *DB) DowngradeFileStatusIfNeeded(ctx context.Context, fileID int64) error {
+// ExtendRestore keeps an already restored copy for another days days.
+func (db *DB) ExtendRestore(ctx context.Context, fileID int64, days int) error {
 	_, err := db.pool.Exec(ctx, `
-		UPDATE files f
-		SET status = 'pending'
-		WHERE f.id = $1
-		  AND f.status = 'active'
-		  AND (
-			SELECT COUNT(*) 
-			FROM contracts c 
-			WHERE c.file_id = f.id AND c.status = 'active'
-		  ) < f.target_replicas
-	`, fileID)
+		UPDATE files SET restore_expires_at = NOW() + make_interval(days => $2) WHERE id = $1
+	`, fileID, days)
 	return err
-}
\ No newline at end of file
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ListContractFunding returns the storage contracts with active or pending
+// providers, those running out first first.
+func (db *DB) ListContractFunding(ctx context.Context, totalWorkers, workerID int) ([]models.ContractFunding, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT
+			c.contract_addr, c.bag_id,
+			COALESCE((
+				SELECT f.bucket_name FROM files f
+				WHERE f.bag_id = c.bag_id OR f.id IN (SELECT s.file_id FROM file_stripes s WHERE s.bag_id = c.bag_id)
+				ORDER BY f.id LIMIT 1
+			), '') as bucket_name,
+			MAX(COALESCE(c.balance_nano_ton, 0)), SUM(c.per_day_nano), MIN(c.expires_at), MAX(c.balance_checked_at),
+			COUNT(*)
+		FROM contracts c
+		WHERE c.status IN ('active', 'pending') AND c.contract_addr <> ''
+		GROUP BY c.contract_addr, c.bag_id
+		HAVING MIN(c.id) % $1 = $2
+		ORDER BY MIN(c.expires_at) ASC NULLS LAST
+	`, totalWorkers, workerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.ContractFunding
+	for rows.Next() {
+		var cf models.ContractFunding
+		if err := rows.Scan(
+			&cf.ContractAddr, &cf.BagID, &cf.BucketName,
+			&cf.BalanceNano, &cf.PerDayNano, &cf.ExpiresAt, &cf.CheckedAt, &cf.Providers,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, cf)
+	}
+	return result, rows.Err()
+}
+
+// UpdateContractFunding stores the on-chain balance of a storage contract and
+// when it runs out (nil = never) on its active and pending rows, and what
+// each provider earns per day: perDay by provider key. Providers no longer
+// in the contract earn nothing.
+func (db *DB) UpdateContractFunding(ctx context.Context, contractAddr string, balanceNano int64, expiresAt *time.Time, perDay map[string]int64) error {
+	keys := make([]string, 0, len(perDay))
+	rates := make([]int64, 0, len(perDay))
+	for k, v := range perDay {
+		keys = append(keys, k)
+		rates = append(rates, v)
+	}
+
+	_, err := db.pool.Exec(ctx, `
+		UPDATE contracts c SET
+			balance_nano_ton = $2, expires_at = $3, balance_checked_at = NOW(),
+			per_day_nano = COALESCE((
+				SELECT r.per_day FROM unnest($4::text[], $5::bigint[]) AS r(key, per_day)
+				WHERE r.key = lower(regexp_replace(c.provider_addr, '^-?[0-9]+:', ''))
+			), 0)
+		WHERE c.contract_addr = $1 AND c.status IN ('active', 'pending')
+	`, contractAddr, balanceNano, expiresAt, keys, rates)
+	return err
+}
+
+const topUpColumns = `id, contract_addr, bag_id, amount_nano, balance_before_nano, status, tx_hash, error, created_at`
+
+func scanTopUp(row pgx.Row, t *models.TopUp) error {
+	return row.Scan(&t.ID, &t.ContractAddr, &t.BagID, &t.AmountNano, &t.BalanceBeforeNano, &t.Status, &t.TxHash, &t.Error, &t.CreatedAt)
+}
+
+// StartTopUp stores a top-up about to be sent as pending and fills in its id.
+func (db *DB) StartTopUp(ctx context.Context, t *models.TopUp) error {
+	t.Status = "pending"
+	return db.pool.QueryRow(ctx, `
+		INSERT INTO contract_topups (contract_addr, bag_id, amount_nano, balance_before_nano, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, t.ContractAddr, t.BagID, t.AmountNano, t.BalanceBeforeNano, t.Status).Scan(&t.ID, &t.CreatedAt)
+}
+
+// FinishTopUp sets the outcome of a top-up: sent with its transaction,
+// unknown with the error sending it, or failed.
+func (db *DB) FinishTopUp(ctx context.Context, id int64, status, txHash, reason string) error {
+	_, err := db.pool.Exec(ctx, `
+		UPDATE contract_topups SET status = $2, tx_hash = $3, error = $4
+		WHERE id = $1
+	`, id, status, txHash, reason)
+	return err
+}
+
+// GetUnsettledTopUp returns the latest top-up of a contract that may or may
+// not have reached it: pending or unknown. It returns pgx.ErrNoRows if there
+// is none.
+func (db *DB) GetUnsettledTopUp(ctx context.Context, contractAddr string) (*models.TopUp, error) {
+	t := &models.TopUp{}
+	err := scanTopUp(db.pool.QueryRow(ctx, `
+		SELECT `+topUpColumns+` FROM contract_topups
+		WHERE contract_addr = $1 AND status IN ('pending', 'unknown')
+		ORDER BY id DESC
+		LIMIT 1
+	`, contractAddr), t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListTopUps returns the latest top-ups, of one contract unless contractAddr
+// is empty.
+func (db *DB) ListTopUps(ctx context.Context, contractAddr string, limit int) ([]models.TopUp, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+topUpColumns+`
+		FROM contract_topups
+		WHERE $1 = '' OR contract_addr = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, contractAddr, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.TopUp
+	for rows.Next() {
+		var t models.TopUp
+		if err := scanTopUp(rows, &t); err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"ton-storage-s3-cli/internal/models"
+)
+
+func (db *DB) CreateMultipartUpload(ctx context.Context, u *models.MultipartUpload) error {
+	return db.pool.QueryRow(ctx, `
+		INSERT INTO multipart_uploads (upload_id, bucket_name, object_key, metadata)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, u.UploadID, u.BucketName, u.ObjectKey, u.Metadata).Scan(&u.ID, &u.CreatedAt)
+}
+
+func (db *DB) GetMultipartUpload(ctx context.Context, uploadID string) (*models.MultipartUpload, error) {
+	u := &models.MultipartUpload{}
+	err := db.pool.QueryRow(ctx, `
+		SELECT id, upload_id, bucket_name, object_key, metadata, created_at
+		FROM multipart_uploads WHERE upload_id = $1
+	`, uploadID).Scan(&u.ID, &u.UploadID, &u.BucketName, &u.ObjectKey, &u.Metadata, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (db *DB) DeleteMultipartUpload(ctx context.Context, uploadID string) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM multipart_uploads WHERE upload_id = $1`, uploadID)
+	return err
+}
+
+// ListMultipartUploads returns up to limit in-progress uploads of a bucket
+// ordered by key and initiation order, starting after the (keyMarker, idMarker)
+// pair.
+func (db *DB) ListMultipartUploads(ctx context.Context, bucketName, prefix, keyMarker string, idMarker int64, limit int) ([]models.MultipartUpload, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT id, upload_id, bucket_name, object_key, metadata, created_at
+		FROM multipart_uploads
+		WHERE bucket_name = $1
+		  AND starts_with(object_key, $2)
+		  AND (object_key COLLATE "C" > $3 OR (object_key = $3 AND id > $4))
+		ORDER BY object_key COLLATE "C", id
+		LIMIT $5
+	`, bucketName, prefix, keyMarker, idMarker, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.MultipartUpload
+	for rows.Next() {
+		var u models.MultipartUpload
+		if err := rows.Scan(&u.ID, &u.UploadID, &u.BucketName, &u.ObjectKey, &u.Metadata, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, nil
+}
+
+func (db *DB) GetStaleMultipartUploads(ctx context.Context, maxAge time.Duration, totalWorkers, workerID, limit int) ([]models.MultipartUpload, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT id, upload_id, bucket_name, object_key, metadata, created_at
+		FROM multipart_uploads
+		WHERE created_at < (NOW() - $1::interval)
+		  AND id % $2 = $3
+		ORDER BY created_at ASC
+		LIMIT $4
+	`, maxAge, totalWorkers, workerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.MultipartUpload
+	for rows.Next() {
+		var u models.MultipartUpload
+		if err := rows.Scan(&u.ID, &u.UploadID, &u.BucketName, &u.ObjectKey, &u.Metadata, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, nil
+}
+
+func (db *DB) ListBucketMultipartUploadIDs(ctx context.Context, bucketName string) ([]string, error) {
+	rows, err := db.pool.Query(ctx, `SELECT upload_id FROM multipart_uploads WHERE bucket_name = $1`, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		result = append(result, id)
+	}
+	return result, nil
+}
+
+func (db *DB) PutMultipartPart(ctx context.Context, p *models.MultipartPart) error {
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO multipart_parts (upload_id, part_number, etag, size_bytes)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (upload_id, part_number)
+		DO UPDATE SET etag = EXCLUDED.etag, size_bytes = EXCLUDED.size_bytes, created_at = NOW()
+	`, p.UploadID, p.PartNumber, p.ETag, p.SizeBytes)
+	return err
+}
+
+func (db *DB) ListMultipartParts(ctx context.Context, uploadID string, marker, limit int) ([]models.MultipartPart, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT upload_id, part_number, etag, size_bytes, created_at
+		FROM multipart_parts
+		WHERE upload_id = $1 AND part_number > $2
+		ORDER BY part_number
+		LIMIT $3
+	`, uploadID, marker, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.MultipartPart
+	for rows.Next() {
+		var p models.MultipartPart
+		if err := rows.Scan(&p.UploadID, &p.PartNumber, &p.ETag, &p.SizeBytes, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
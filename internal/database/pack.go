@@ -0,0 +1,231 @@
+package database
+
+import (
+	"context"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetPackingBuckets returns the buckets with small objects waiting to be
+// packed. Each bucket gets its own packs, hired under its own settings.
+func (db *DB) GetPackingBuckets(ctx context.Context, totalWorkers, workerID int) ([]string, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT DISTINCT bucket_name
+		FROM files
+		WHERE bag_id = '' AND NOT striped AND NOT is_delete_marker
+		  AND id % $1 = $2
+		ORDER BY bucket_name
+	`, totalWorkers, workerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		result = append(result, name)
+	}
+	return result, rows.Err()
+}
+
+// GetUnpackedFiles returns small objects of a bucket waiting to be packed,
+// oldest first.
+func (db *DB) GetUnpackedFiles(ctx context.Context, bucketName string, totalWorkers, workerID, limit int) ([]models.File, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+fileColumns+`
+		FROM files
+		WHERE bag_id = '' AND NOT striped AND NOT is_delete_marker
+		  AND bucket_name = $1
+		  AND id % $2 = $3
+		ORDER BY id ASC
+		LIMIT $4
+	`, bucketName, totalWorkers, workerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.File
+	for rows.Next() {
+		var f models.File
+		if err := scanFile(rows, &f); err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// CreatePack registers a pack built from the staged files of the given object
+// versions, names[i] being the file of ids[i] in the pack. Versions deleted
+// while the pack was built are left out; it returns how many were packed, and
+// the pack is not registered if none was.
+func (db *DB) CreatePack(ctx context.Context, bagID string, sizeBytes int64, ids []int64, names []string) (int, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO bags (bag_id, size_bytes, is_pack)
+		VALUES ($1, $2, TRUE)
+	`, bagID, sizeBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	packed, err := movePackMembers(ctx, tx, bagID, `
+		UPDATE files f
+		SET bag_id = $1, bag_path = m.name
+		FROM unnest($2::bigint[], $3::text[]) AS m(id, name)
+		WHERE f.id = m.id AND f.bag_id = ''
+		RETURNING f.target_replicas
+	`, bagID, ids, names)
+	if err != nil || packed == 0 {
+		return 0, err
+	}
+	return packed, tx.Commit(ctx)
+}
+
+// GetSparsePacks returns packs in which deleted objects left less than
+// livePercent percent of the data alive. Packs being read are skipped.
+func (db *DB) GetSparsePacks(ctx context.Context, livePercent, totalWorkers, workerID, limit int) ([]models.Bag, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT b.id, b.bag_id, b.sha256, b.size_bytes, b.ref_count, b.target_replicas, b.status, b.is_pack, b.created_at
+		FROM bags b
+		WHERE b.is_pack AND b.ref_count > 0
+		  AND b.id % $2 = $3
+		  AND (
+			SELECT COALESCE(SUM(m.size_bytes), 0)
+			FROM (
+				SELECT DISTINCT ON (bag_path) size_bytes FROM files
+				WHERE bag_id = b.bag_id AND NOT is_delete_marker
+			) m
+		  ) * 100 < b.size_bytes * $1
+		  AND NOT EXISTS (
+			SELECT 1 FROM downloads d JOIN files df ON df.id = d.file_id
+			WHERE df.bag_id = b.bag_id AND d.status = 'running'
+		  )
+		ORDER BY b.id ASC
+		LIMIT $4
+	`, livePercent, totalWorkers, workerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.Bag
+	for rows.Next() {
+		var b models.Bag
+		if err := rows.Scan(&b.ID, &b.BagID, &b.SHA256, &b.SizeBytes, &b.RefCount, &b.TargetReplicas, &b.Status, &b.IsPack, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// GetPackFiles returns the files of a pack that some object version still
+// points at, each once.
+func (db *DB) GetPackFiles(ctx context.Context, bagID string) ([]models.File, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT DISTINCT ON (bag_path) `+fileColumns+`
+		FROM files
+		WHERE bag_id = $1 AND NOT is_delete_marker
+		ORDER BY bag_path, id
+	`, bagID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.File
+	for rows.Next() {
+		var f models.File
+		if err := scanFile(rows, &f); err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// Repack moves the object versions stored under names in the pack oldBagID
+// to the new pack newBagID, which keeps the same file names. It returns how
+// many versions were moved and the old pack if nothing points at it anymore.
+func (db *DB) Repack(ctx context.Context, oldBagID, newBagID string, sizeBytes int64, names []string) (int, []string, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO bags (bag_id, size_bytes, is_pack)
+		VALUES ($1, $2, TRUE)
+	`, newBagID, sizeBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	moved, err := movePackMembers(ctx, tx, newBagID, `
+		UPDATE files
+		SET bag_id = $1, status = 'pending', offloaded = FALSE, restore_expires_at = NULL
+		WHERE bag_id = $2 AND bag_path = ANY($3) AND NOT is_delete_marker
+		RETURNING target_replicas
+	`, newBagID, oldBagID, names)
+	if err != nil || moved == 0 {
+		return 0, nil, err
+	}
+
+	released := make([]string, moved)
+	for i := range released {
+		released[i] = oldBagID
+	}
+	orphaned, err := releaseBags(ctx, tx, released)
+	if err != nil {
+		return 0, nil, err
+	}
+	return moved, orphaned, tx.Commit(ctx)
+}
+
+// movePackMembers points object versions at a newly inserted pack with query,
+// which returns their target replicas, and sets the pack's references. If
+// nothing was moved, the caller rolls the pack back.
+func movePackMembers(ctx context.Context, tx pgx.Tx, bagID, query string, args ...any) (int, error) {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	moved, replicas := 0, 1
+	for rows.Next() {
+		var n int
+		if err := rows.Scan(&n); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		moved++
+		replicas = max(replicas, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if moved == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE bags SET ref_count = $2, target_replicas = $3 WHERE bag_id = $1
+	`, bagID, moved, replicas)
+	return moved, err
+}
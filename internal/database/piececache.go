@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"ton-storage-s3-cli/internal/models"
+)
+
+// MarkDownloadPartial records that a download job reads a range of an
+// offloaded bag through the piece cache, and that the bag's cache is in use.
+func (db *DB) MarkDownloadPartial(ctx context.Context, jobID int64, bagID string) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE downloads SET partial = TRUE WHERE id = $1`, jobID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO piece_caches (bag_id) VALUES ($1)
+		ON CONFLICT (bag_id) DO UPDATE SET last_access_at = NOW()
+	`, bagID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// AddFetchedBytes accounts piece data a partial download pulled from TON to
+// the job and to the bag's piece cache.
+func (db *DB) AddFetchedBytes(ctx context.Context, jobID int64, bagID string, n int64) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE downloads SET fetched_bytes = fetched_bytes + $2 WHERE id = $1`, jobID, n); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE piece_caches SET size_bytes = size_bytes + $2, last_access_at = NOW() WHERE bag_id = $1
+	`, bagID, n)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetPieceCachesToEvict returns piece caches unused for ttl whose bag is not
+// being read or restored, and has no restored files (of a pack) to keep.
+func (db *DB) GetPieceCachesToEvict(ctx context.Context, ttl time.Duration, totalWorkers, workerID, limit int) ([]models.PieceCache, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT c.id, c.bag_id, c.size_bytes, c.last_access_at
+		FROM piece_caches c
+		WHERE c.last_access_at < (NOW() - $1::interval)
+		  AND c.id % $2 = $3
+		  AND NOT EXISTS (
+			SELECT 1 FROM downloads d JOIN files f ON f.id = d.file_id
+			WHERE (f.bag_id = c.bag_id OR f.id IN (SELECT file_id FROM file_stripes WHERE bag_id = c.bag_id))
+			  AND d.status = 'running'
+		  )
+		  AND NOT EXISTS (
+			SELECT 1 FROM files r
+			WHERE (r.bag_id = c.bag_id OR r.id IN (SELECT file_id FROM file_stripes WHERE bag_id = c.bag_id))
+			  AND r.restore_expires_at > NOW()
+		  )
+		ORDER BY c.last_access_at ASC
+		LIMIT $4
+	`, ttl, totalWorkers, workerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.PieceCache
+	for rows.Next() {
+		var c models.PieceCache
+		if err := rows.Scan(&c.ID, &c.BagID, &c.SizeBytes, &c.LastAccessAt); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
+
+func (db *DB) DeletePieceCache(ctx context.Context, id int64) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM piece_caches WHERE id = $1`, id)
+	return err
+}
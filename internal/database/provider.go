@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// offlineAfterFailures is how many probes in a row a provider fails before it
+// is no longer hired.
+const offlineAfterFailures = 3
+
+const providerColumns = `key, source, status, last_seen_at, checked_at, rate_nano, min_bounty_nano,
+	max_bag_bytes, min_span, max_span, probe_failures, last_error, created_at,
+	audits_passed, audits_failed, hire_failures, last_hire_failure_at`
+
+func scanProvider(row pgx.Row, p *models.Provider) error {
+	return row.Scan(
+		&p.Key, &p.Source, &p.Status, &p.LastSeenAt, &p.CheckedAt, &p.RateNano, &p.MinBountyNano,
+		&p.MaxBagBytes, &p.MinSpan, &p.MaxSpan, &p.ProbeFailures, &p.LastError, &p.CreatedAt,
+		&p.AuditsPassed, &p.AuditsFailed, &p.HireFailures, &p.LastHireFailureAt,
+	)
+}
+
+func (db *DB) queryProviders(ctx context.Context, query string, args ...any) ([]models.Provider, error) {
+	rows, err := db.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.Provider
+	for rows.Next() {
+		var p models.Provider
+		if err := scanProvider(rows, &p); err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// AddProviders adds the providers with keys not known yet, noting where they
+// were learnt from. It returns how many were added.
+func (db *DB) AddProviders(ctx context.Context, keys []string, source string) (int64, error) {
+	tag, err := db.pool.Exec(ctx, `
+		INSERT INTO providers (key, source)
+		SELECT DISTINCT lower(k), $2 FROM unnest($1::text[]) k
+		ON CONFLICT DO NOTHING
+	`, keys, source)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// AddContractProviders adds the providers of our contracts not known yet,
+// such as those hired before the providers table existed.
+func (db *DB) AddContractProviders(ctx context.Context) (int64, error) {
+	tag, err := db.pool.Exec(ctx, `
+		INSERT INTO providers (key, source)
+		SELECT DISTINCT lower(regexp_replace(provider_addr, '^-?[0-9]+:', '')), 'contract'
+		FROM contracts
+		WHERE provider_addr ~ '^(-?[0-9]+:)?[0-9a-fA-F]{64}$'
+		ON CONFLICT DO NOTHING
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (db *DB) ListProviders(ctx context.Context) ([]models.Provider, error) {
+	return db.queryProviders(ctx, `SELECT `+providerColumns+` FROM providers ORDER BY created_at, key`)
+}
+
+// ListHireableProviders returns the providers that accepted bags at their
+// last probe, and those not probed yet.
+func (db *DB) ListHireableProviders(ctx context.Context) ([]models.Provider, error) {
+	return db.queryProviders(ctx, `
+		SELECT `+providerColumns+` FROM providers
+		WHERE status IN ('new', 'active')
+		ORDER BY key
+	`)
+}
+
+// ListProvidersToProbe returns every provider not disabled by an admin.
+func (db *DB) ListProvidersToProbe(ctx context.Context) ([]models.Provider, error) {
+	return db.queryProviders(ctx, `
+		SELECT `+providerColumns+` FROM providers
+		WHERE status <> 'disabled'
+		ORDER BY checked_at NULLS FIRST
+	`)
+}
+
+func (db *DB) GetProvider(ctx context.Context, key string) (*models.Provider, error) {
+	p := &models.Provider{}
+	err := scanProvider(db.pool.QueryRow(ctx, `SELECT `+providerColumns+` FROM providers WHERE key = $1`, key), p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// RecordProviderProbe stores the status and rates a provider answered a
+// probe with. Disabled providers stay disabled.
+func (db *DB) RecordProviderProbe(ctx context.Context, p *models.Provider) error {
+	_, err := db.pool.Exec(ctx, `
+		UPDATE providers SET
+			status = CASE WHEN status = 'disabled' THEN status ELSE $2 END,
+			last_seen_at = NOW(), checked_at = NOW(),
+			rate_nano = $3, min_bounty_nano = $4, max_bag_bytes = $5, min_span = $6, max_span = $7,
+			probe_failures = 0, last_error = ''
+		WHERE key = $1
+	`, p.Key, p.Status, p.RateNano, p.MinBountyNano, p.MaxBagBytes, p.MinSpan, p.MaxSpan)
+	return err
+}
+
+// RecordProviderProbeFailure notes a probe a provider did not answer. After
+// offlineAfterFailures of them in a row it is marked offline.
+func (db *DB) RecordProviderProbeFailure(ctx context.Context, key, reason string) error {
+	_, err := db.pool.Exec(ctx, `
+		UPDATE providers SET
+			probe_failures = probe_failures + 1,
+			status = CASE WHEN status <> 'disabled' AND probe_failures + 1 >= $3 THEN 'offline' ELSE status END,
+			checked_at = NOW(), last_error = $2
+		WHERE key = $1
+	`, key, reason, offlineAfterFailures)
+	return err
+}
+
+// RecordProviderAudit counts an audit of one of the contracts of a provider,
+// given by key or address, into its uptime history.
+func (db *DB) RecordProviderAudit(ctx context.Context, addr string, healthy bool) error {
+	_, err := db.pool.Exec(ctx, `
+		UPDATE providers SET
+			audits_passed = audits_passed + CASE WHEN $2 THEN 1 ELSE 0 END,
+			audits_failed = audits_failed + CASE WHEN $2 THEN 0 ELSE 1 END
+		WHERE key = lower(regexp_replace($1, '^-?[0-9]+:', ''))
+	`, addr, healthy)
+	return err
+}
+
+// RecordProviderHire notes whether hiring a provider succeeded. A success
+// clears the failures in a row.
+func (db *DB) RecordProviderHire(ctx context.Context, key string, ok bool) error {
+	_, err := db.pool.Exec(ctx, `
+		UPDATE providers SET
+			hire_failures = CASE WHEN $2 THEN 0 ELSE hire_failures + 1 END,
+			last_hire_failure_at = CASE WHEN $2 THEN last_hire_failure_at ELSE NOW() END
+		WHERE key = lower($1)
+	`, key, ok)
+	return err
+}
+
+// SetProviderDisabled disables a provider, or enables it again to be probed
+// as a new one. It reports false if there is no such provider.
+func (db *DB) SetProviderDisabled(ctx context.Context, key string, disabled bool) (bool, error) {
+	tag, err := db.pool.Exec(ctx, `
+		UPDATE providers SET
+			status = CASE WHEN $2 THEN 'disabled' WHEN status = 'disabled' THEN 'new' ELSE status END,
+			probe_failures = 0
+		WHERE key = $1
+	`, key, disabled)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// DeleteProvider forgets a provider; its contracts are kept. It reports false
+// if there is no such provider.
+func (db *DB) DeleteProvider(ctx context.Context, key string) (bool, error) {
+	tag, err := db.pool.Exec(ctx, `DELETE FROM providers WHERE key = $1`, key)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
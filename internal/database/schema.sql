@@ -17,8 +17,7 @@ CREATE TABLE IF NOT EXISTS files (
                        size_bytes BIGINT NOT NULL,
                        target_replicas INT DEFAULT 3,
                        status VARCHAR(50) DEFAULT 'pending', -- 'pending', 'active'
-                       created_at TIMESTAMP DEFAULT NOW(),
-                       UNIQUE(bucket_name, object_key)
+                       created_at TIMESTAMP DEFAULT NOW()
 );
 
 ALTER TABLE files
@@ -52,4 +51,261 @@ CREATE TABLE IF NOT EXISTS downloads (
 
 CREATE INDEX IF NOT EXISTS idx_downloads_active ON downloads(file_id) WHERE status = 'running';
 CREATE INDEX IF NOT EXISTS idx_files_status ON files(status);
-CREATE INDEX IF NOT EXISTS idx_contracts_status_check ON contracts(status, last_check);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_contracts_status_check ON contracts(status, last_check);
+CREATE TABLE IF NOT EXISTS multipart_uploads (
+    id BIGSERIAL PRIMARY KEY,
+    upload_id VARCHAR(64) NOT NULL UNIQUE,
+    bucket_name VARCHAR(255) NOT NULL REFERENCES buckets(name) ON DELETE CASCADE,
+    object_key VARCHAR(1024) NOT NULL,
+    metadata JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS multipart_parts (
+    upload_id VARCHAR(64) NOT NULL REFERENCES multipart_uploads(upload_id) ON DELETE CASCADE,
+    part_number INT NOT NULL,
+    etag VARCHAR(64) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (upload_id, part_number)
+);
+
+CREATE INDEX IF NOT EXISTS idx_multipart_uploads_key ON multipart_uploads(bucket_name, object_key, id);
+CREATE INDEX IF NOT EXISTS idx_multipart_uploads_created ON multipart_uploads(created_at);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS md5 VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS sha256 VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS crc32c VARCHAR(8) NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS versioning VARCHAR(16) NOT NULL DEFAULT ''; -- '', 'Enabled', 'Suspended'
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS version_id VARCHAR(64) NOT NULL DEFAULT ''; -- '' = null version
+ALTER TABLE files ADD COLUMN IF NOT EXISTS is_latest BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS is_delete_marker BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE files DROP CONSTRAINT IF EXISTS files_bucket_name_object_key_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_files_version ON files(bucket_name, object_key, version_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_files_latest ON files(bucket_name, object_key) WHERE is_latest;
+CREATE INDEX IF NOT EXISTS idx_files_bag ON files(bag_id);
+CREATE INDEX IF NOT EXISTS idx_files_listing ON files(bucket_name, object_key COLLATE "C") WHERE is_latest AND NOT is_delete_marker;
+
+-- Keys created before grants existed keep full access; new keys start unprivileged.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE api_keys ALTER COLUMN is_admin SET DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS api_key_grants (
+    id BIGSERIAL PRIMARY KEY,
+    access_key VARCHAR(50) NOT NULL REFERENCES api_keys(access_key) ON DELETE CASCADE,
+    bucket_name VARCHAR(63) NOT NULL, -- '*' = any bucket
+    prefix VARCHAR(1024) NOT NULL DEFAULT '',
+    actions TEXT[] NOT NULL, -- read, write, delete, list
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_key_grants_key ON api_key_grants(access_key);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS offloaded BOOLEAN NOT NULL DEFAULT FALSE; -- local copy removed by the cleaner
+ALTER TABLE files ADD COLUMN IF NOT EXISTS restore_expires_at TIMESTAMP; -- restored copy is kept until then
+ALTER TABLE downloads ADD COLUMN IF NOT EXISTS restore_days INT NOT NULL DEFAULT 0; -- 0 = plain read of a local copy
+CREATE UNIQUE INDEX IF NOT EXISTS idx_downloads_restore ON downloads(file_id) WHERE status = 'running' AND restore_days > 0;
+
+-- Pieces of offloaded bags fetched for range reads, see internal/ton/stream.go
+CREATE TABLE IF NOT EXISTS piece_caches (
+    id BIGSERIAL PRIMARY KEY,
+    bag_id VARCHAR(64) NOT NULL UNIQUE,
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    last_access_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE downloads ADD COLUMN IF NOT EXISTS partial BOOLEAN NOT NULL DEFAULT FALSE; -- range read served from the piece cache
+ALTER TABLE downloads ADD COLUMN IF NOT EXISTS fetched_bytes BIGINT NOT NULL DEFAULT 0; -- piece data pulled from TON for the job
+
+-- Object versions with identical content share one bag; replication and
+-- contracts belong to the bag, which lives as long as something points at it.
+CREATE TABLE IF NOT EXISTS bags (
+    id BIGSERIAL PRIMARY KEY,
+    bag_id VARCHAR(64) NOT NULL UNIQUE,
+    sha256 VARCHAR(64) NOT NULL DEFAULT '', -- content of a single-object bag, '' = not deduplicated
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    ref_count INT NOT NULL DEFAULT 0, -- object versions pointing at the bag
+    target_replicas INT NOT NULL DEFAULT 1,
+    status VARCHAR(50) NOT NULL DEFAULT 'pending', -- 'pending', 'active'
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_bags_content ON bags(sha256, size_bytes) WHERE sha256 <> '';
+
+INSERT INTO bags (bag_id, sha256, size_bytes, ref_count, target_replicas, status, created_at)
+SELECT bag_id, MAX(sha256), MAX(size_bytes), COUNT(*), MAX(target_replicas),
+       CASE WHEN bool_and(status = 'active') THEN 'active' ELSE 'pending' END, MIN(created_at)
+FROM files
+WHERE NOT is_delete_marker AND bag_id <> ''
+GROUP BY bag_id
+ON CONFLICT (bag_id) DO NOTHING;
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS bag_path VARCHAR(1024) NOT NULL DEFAULT ''; -- file inside the bag, '' = last segment of the key
+
+ALTER TABLE contracts ADD COLUMN IF NOT EXISTS bag_id VARCHAR(64);
+UPDATE contracts c SET bag_id = f.bag_id FROM files f WHERE c.file_id = f.id AND c.bag_id IS NULL;
+
+ALTER TABLE contracts
+DROP CONSTRAINT IF EXISTS contracts_file_id_fkey;
+
+ALTER TABLE contracts
+DROP CONSTRAINT IF EXISTS contracts_bag_id_fkey;
+
+ALTER TABLE contracts
+ADD CONSTRAINT contracts_bag_id_fkey
+    FOREIGN KEY (bag_id)
+    REFERENCES bags(bag_id)
+    ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_contracts_bag ON contracts(bag_id);
+
+-- Small objects are packed into shared directory bags. Until then their bag_id
+-- is '' and bag_path names their file in the packing area.
+ALTER TABLE bags ADD COLUMN IF NOT EXISTS is_pack BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_files_unpacked ON files(id) WHERE bag_id = '' AND NOT is_delete_marker;
+
+-- Large objects are split into stripes, each stored and replicated as a bag of
+-- its own. Striped versions have no bag_id.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS striped BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS file_stripes (
+    file_id BIGINT NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    idx INT NOT NULL,
+    bag_id VARCHAR(64) NOT NULL,
+    bag_path VARCHAR(1024) NOT NULL, -- file of the stripe inside its bag
+    offset_bytes BIGINT NOT NULL, -- where the stripe starts in the object
+    size_bytes BIGINT NOT NULL,
+    PRIMARY KEY (file_id, idx)
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_stripes_bag ON file_stripes(bag_id);
+
+-- Erasure coding: objects of buckets with data shards set are stored as
+-- erasure_data + erasure_parity shard bags, listed in file_stripes
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS erasure_data INT NOT NULL DEFAULT 0;
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS erasure_parity INT NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS erasure_data INT NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS erasure_parity INT NOT NULL DEFAULT 0;
+
+-- Server-side encryption: the bags of encrypted versions hold ciphertext under
+-- a data key of their own, stored wrapped in sse_key
+ALTER TABLE files ADD COLUMN IF NOT EXISTS sse VARCHAR(16) NOT NULL DEFAULT ''; -- '', 'AES256' (SSE-S3) or 'SSE-C'
+ALTER TABLE files ADD COLUMN IF NOT EXISTS sse_key TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS sse_key_md5 TEXT NOT NULL DEFAULT ''; -- MD5 of the SSE-C customer key
+
+-- Compression: compressed versions keep their original size in size_bytes;
+-- frame_index lists the compressed size of every frame for range reads
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS compression VARCHAR(8) NOT NULL DEFAULT ''; -- '', 'zstd' or 'gzip'
+ALTER TABLE files ADD COLUMN IF NOT EXISTS compression VARCHAR(8) NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS compressed_size BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS frame_index BYTEA;
+
+-- Bucket settings: defaults for new objects and the policy their bags are
+-- replicated and offloaded with. Zero values fall back to the gateway config
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS default_replicas INT NOT NULL DEFAULT 0; -- 0 = DEFAULT_REPLICAS
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS allowed_providers TEXT[] NOT NULL DEFAULT '{}'; -- empty = any provider
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS blocked_providers TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS max_rate_nano BIGINT NOT NULL DEFAULT 0; -- per MB per day, 0 = no limit
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS encryption VARCHAR(16) NOT NULL DEFAULT ''; -- '' = gateway default, 'AES256' or 'none'
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS offload_policy VARCHAR(8) NOT NULL DEFAULT 'auto'; -- 'auto' or 'never'
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS offload_after_hours INT NOT NULL DEFAULT 0;
+
+-- Storage providers the replicator hires from, seeded from PROVIDERS, added
+-- through the admin API or found in our contracts, and probed periodically
+CREATE TABLE IF NOT EXISTS providers (
+    key VARCHAR(64) PRIMARY KEY, -- hex ADNL key
+    source VARCHAR(16) NOT NULL DEFAULT 'config', -- 'config', 'admin' or 'contract'
+    status VARCHAR(16) NOT NULL DEFAULT 'new', -- 'new', 'active', 'unavailable', 'offline' or 'disabled'
+    last_seen_at TIMESTAMP, -- last answer to a probe
+    checked_at TIMESTAMP,
+    rate_nano BIGINT NOT NULL DEFAULT 0, -- per MB per day
+    min_bounty_nano BIGINT NOT NULL DEFAULT 0,
+    max_bag_bytes BIGINT NOT NULL DEFAULT 0, -- space the provider has left, 0 = unknown
+    min_span INT NOT NULL DEFAULT 0, -- seconds between storage proofs
+    max_span INT NOT NULL DEFAULT 0,
+    probe_failures INT NOT NULL DEFAULT 0, -- probes failed in a row
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_providers_status ON providers(status);
+
+-- Provider selection: outcomes of audits and hires the strategies rank
+-- providers by, and the strategy of each bucket
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS audits_passed INT NOT NULL DEFAULT 0;
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS audits_failed INT NOT NULL DEFAULT 0;
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS hire_failures INT NOT NULL DEFAULT 0; -- hires failed in a row
+ALTER TABLE providers ADD COLUMN IF NOT EXISTS last_hire_failure_at TIMESTAMP;
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS selection_strategy VARCHAR(16) NOT NULL DEFAULT ''; -- '' = 'weighted', 'cheapest' or 'reliable'
+
+-- Contract funding: providers are paid for storage_days of storage at their
+-- rate, but no more than max_funding_nano per hire. Zero values fall back to
+-- STORAGE_DAYS and MAX_FUNDING_NANO
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS storage_days INT NOT NULL DEFAULT 0;
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS max_funding_nano BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE contracts ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP; -- when the funding runs out, NULL for older contracts
+
+-- Balance keeper: on-chain balances of storage contracts, what each provider
+-- earns per day, and the top-ups sent when a contract runs low. Every row of
+-- a contract carries the balance of the whole contract
+ALTER TABLE contracts ADD COLUMN IF NOT EXISTS per_day_nano BIGINT NOT NULL DEFAULT 0; -- earned by this provider per day
+ALTER TABLE contracts ADD COLUMN IF NOT EXISTS balance_checked_at TIMESTAMP;
+ALTER TABLE buckets ADD COLUMN IF NOT EXISTS topup_below_days INT NOT NULL DEFAULT 0; -- 0 = TOPUP_BELOW_DAYS
+
+CREATE TABLE IF NOT EXISTS contract_topups (
+    id BIGSERIAL PRIMARY KEY,
+    contract_addr VARCHAR(255) NOT NULL,
+    bag_id VARCHAR(64) NOT NULL,
+    amount_nano BIGINT NOT NULL,
+    tx_hash VARCHAR(64) NOT NULL DEFAULT '', -- empty if the top-up failed
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_contract_topups_addr ON contract_topups(contract_addr, created_at);
+
+-- A top-up is written before it is sent, so that one whose send failed after
+-- the message may have gone out is not sent again until a balance read
+-- settles it: 'pending' while sending, 'sent', 'unknown' if sending failed,
+-- 'failed' once the balance shows it never arrived
+ALTER TABLE contract_topups ADD COLUMN IF NOT EXISTS status VARCHAR(16);
+UPDATE contract_topups SET status = CASE WHEN tx_hash <> '' THEN 'sent' ELSE 'failed' END WHERE status IS NULL;
+ALTER TABLE contract_topups ALTER COLUMN status SET NOT NULL;
+ALTER TABLE contract_topups ADD COLUMN IF NOT EXISTS balance_before_nano BIGINT NOT NULL DEFAULT 0; -- on-chain balance when it was sent
+
+-- Teardown: storage contracts of deleted bags whose balance is taken back to
+-- our wallet, retried until it succeeds. The sweeper also finds contracts
+-- owned by our wallet on-chain and queues those of bags we no longer have
+CREATE TABLE IF NOT EXISTS contract_teardowns (
+    id BIGSERIAL PRIMARY KEY,
+    contract_addr VARCHAR(255) NOT NULL UNIQUE,
+    bag_id VARCHAR(64) NOT NULL,
+    source VARCHAR(16) NOT NULL DEFAULT 'delete', -- 'delete' or 'sweep'
+    status VARCHAR(16) NOT NULL DEFAULT 'pending', -- 'pending', 'done' or 'cancelled' (the bag was uploaded again)
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    tx_hash VARCHAR(64) NOT NULL DEFAULT '', -- withdrawal, empty if there was nothing to withdraw
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    done_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_contract_teardowns_due ON contract_teardowns(status, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS owned_contracts (
+    contract_addr VARCHAR(255) PRIMARY KEY,
+    bag_id VARCHAR(64) NOT NULL,
+    found_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- How far the sweeper has read the history of each wallet
+CREATE TABLE IF NOT EXISTS wallet_scans (
+    wallet_addr VARCHAR(255) PRIMARY KEY,
+    last_lt BIGINT NOT NULL DEFAULT 0,
+    scanned_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// maxTeardownBackoffMinutes caps the wait between attempts of a teardown,
+// which doubles with every failure.
+const maxTeardownBackoffMinutes = 360
+
+const teardownColumns = `id, contract_addr, bag_id, source, status, attempts, next_attempt_at, tx_hash, last_error, created_at, done_at`
+
+func (db *DB) queryTeardowns(ctx context.Context, query string, args ...any) ([]models.Teardown, error) {
+	rows, err := db.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.Teardown
+	for rows.Next() {
+		var t models.Teardown
+		if err := rows.Scan(
+			&t.ID, &t.ContractAddr, &t.BagID, &t.Source, &t.Status, &t.Attempts, &t.NextAttemptAt,
+			&t.TxHash, &t.LastError, &t.CreatedAt, &t.DoneAt,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+// queueTeardowns queues the teardown of the storage contracts of bags about
+// to be deleted. A contract torn down before, for an earlier upload of the
+// same bag, is queued again.
+func queueTeardowns(ctx context.Context, tx pgx.Tx, bagIDs []string) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO contract_teardowns (contract_addr, bag_id, source)
+		SELECT DISTINCT contract_addr, bag_id, 'delete' FROM contracts
+		WHERE bag_id = ANY($1) AND contract_addr <> ''
+		ON CONFLICT (contract_addr) DO UPDATE SET
+			bag_id = EXCLUDED.bag_id, source = EXCLUDED.source, status = 'pending', attempts = 0,
+			next_attempt_at = NOW(), tx_hash = '', last_error = '', done_at = NULL
+	`, bagIDs)
+	return err
+}
+
+// GetDueTeardowns returns pending teardowns whose next attempt is due.
+func (db *DB) GetDueTeardowns(ctx context.Context, totalWorkers, workerID, limit int) ([]models.Teardown, error) {
+	return db.queryTeardowns(ctx, `
+		SELECT `+teardownColumns+` FROM contract_teardowns
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		  AND id % $1 = $2
+		ORDER BY next_attempt_at ASC
+		LIMIT $3
+	`, totalWorkers, workerID, limit)
+}
+
+// ListTeardowns returns the latest teardowns, with one status unless status
+// is empty.
+func (db *DB) ListTeardowns(ctx context.Context, status string, limit int) ([]models.Teardown, error) {
+	return db.queryTeardowns(ctx, `
+		SELECT `+teardownColumns+` FROM contract_teardowns
+		WHERE $1 = '' OR status = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, status, limit)
+}
+
+// FinishTeardown closes a teardown as done, with the withdrawal transaction
+// if anything was withdrawn, or as cancelled.
+func (db *DB) FinishTeardown(ctx context.Context, id int64, status, txHash string) error {
+	_, err := db.pool.Exec(ctx, `
+		UPDATE contract_teardowns SET
+			status = $2, tx_hash = $3, attempts = attempts + 1, last_error = '', done_at = NOW()
+		WHERE id = $1
+	`, id, status, txHash)
+	return err
+}
+
+// FailTeardown notes a failed attempt; the next one waits twice as long as
+// the previous, up to maxTeardownBackoffMinutes.
+func (db *DB) FailTeardown(ctx context.Context, id int64, reason string) error {
+	_, err := db.pool.Exec(ctx, `
+		UPDATE contract_teardowns SET
+			attempts = attempts + 1, last_error = $2,
+			next_attempt_at = NOW() + make_interval(mins => LEAST(POWER(2, LEAST(attempts, 16))::int, $3))
+		WHERE id = $1
+	`, id, reason, maxTeardownBackoffMinutes)
+	return err
+}
+
+// RetryTeardown makes a pending teardown due right away. It reports false if
+// there is no such pending teardown.
+func (db *DB) RetryTeardown(ctx context.Context, id int64) (bool, error) {
+	tag, err := db.pool.Exec(ctx, `
+		UPDATE contract_teardowns SET next_attempt_at = NOW()
+		WHERE id = $1 AND status = 'pending'
+	`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetWalletScanLT returns the logical time up to which the history of a
+// wallet was scanned for owned contracts, 0 if it never was.
+func (db *DB) GetWalletScanLT(ctx context.Context, walletAddr string) (uint64, error) {
+	var lt int64
+	err := db.pool.QueryRow(ctx, `SELECT last_lt FROM wallet_scans WHERE wallet_addr = $1`, walletAddr).Scan(&lt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return uint64(lt), err
+}
+
+// SaveWalletScan stores the storage contracts found in the history of a
+// wallet, given as parallel lists of addresses and bags, and how far the
+// history was scanned.
+func (db *DB) SaveWalletScan(ctx context.Context, walletAddr string, lastLT uint64, contractAddrs, bagIDs []string) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO owned_contracts (contract_addr, bag_id)
+		SELECT * FROM unnest($1::text[], $2::text[])
+		ON CONFLICT (contract_addr) DO UPDATE SET bag_id = EXCLUDED.bag_id
+	`, contractAddrs, bagIDs)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO wallet_scans (wallet_addr, last_lt) VALUES ($1, $2)
+		ON CONFLICT (wallet_addr) DO UPDATE SET last_lt = EXCLUDED.last_lt, scanned_at = NOW()
+	`, walletAddr, int64(lastLT))
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// QueueOrphanedTeardowns queues the teardown of the owned contracts whose bags
+// are not in the catalog and that were never queued. It returns how many
+// were queued.
+func (db *DB) QueueOrphanedTeardowns(ctx context.Context) (int64, error) {
+	tag, err := db.pool.Exec(ctx, `
+		INSERT INTO contract_teardowns (contract_addr, bag_id, source)
+		SELECT o.contract_addr, o.bag_id, 'sweep' FROM owned_contracts o
+		WHERE NOT EXISTS (SELECT 1 FROM bags b WHERE b.bag_id = o.bag_id)
+		ON CONFLICT (contract_addr) DO NOTHING
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
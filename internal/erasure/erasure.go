@@ -0,0 +1,144 @@
+// Package erasure implements the code objects are erasure-coded with: a
+// systematic Reed-Solomon code whose k data shards hold the data as it is and
+// whose m parity shards are computed from them, so that any k of the k+m
+// shards restore the data.
+//
+// RaptorQ, which tonutils uses for its transfers, is a fountain code and may
+// need more than k symbols to decode; the code here only shares its GF(256)
+// arithmetic.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/xssnick/raptorq/discmath"
+)
+
+// MaxShards is the largest number of shards a code can have.
+const MaxShards = 256
+
+var ErrTooFewShards = errors.New("too few shards to reconstruct the data")
+
+type Code struct {
+	data, parity int
+	// Parity rows of the encoding matrix, a Cauchy matrix: every square
+	// matrix made of its rows and rows of the identity is invertible.
+	matrix [][]byte
+}
+
+// New returns a code with data data shards and parity parity shards.
+func New(data, parity int) (*Code, error) {
+	if data < 1 || parity < 0 || data+parity > MaxShards {
+		return nil, fmt.Errorf("invalid erasure code %d+%d: need at least 1 data shard and at most %d shards", data, parity, MaxShards)
+	}
+
+	matrix := make([][]byte, parity)
+	for i := range matrix {
+		matrix[i] = make([]byte, data)
+		for j := range matrix[i] {
+			matrix[i][j] = discmath.OctInverse(uint8(data+i) ^ uint8(j))
+		}
+	}
+	return &Code{data: data, parity: parity, matrix: matrix}, nil
+}
+
+func (c *Code) DataShards() int   { return c.data }
+func (c *Code) ParityShards() int { return c.parity }
+
+// Encode computes the parity shards of shards from its data shards. All
+// shards have the same length.
+func (c *Code) Encode(shards [][]byte) {
+	for i, row := range c.matrix {
+		out := shards[c.data+i]
+		clear(out)
+		for j, coef := range row {
+			discmath.OctVecMulAdd(out, shards[j], coef)
+		}
+	}
+}
+
+// Reconstruct fills in the missing (nil) data shards of shards, each size
+// bytes long, from any data shards present. Parity shards are not restored.
+func (c *Code) Reconstruct(shards [][]byte, size int) error {
+	var missing []int
+	for j := 0; j < c.data; j++ {
+		if shards[j] == nil {
+			missing = append(missing, j)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// The first data shards present, the rows of the encoding matrix they
+	// were made with
+	rows := make([]int, 0, c.data)
+	for i := 0; i < len(shards) && len(rows) < c.data; i++ {
+		if shards[i] != nil {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < c.data {
+		return ErrTooFewShards
+	}
+
+	m := make([][]byte, c.data)
+	for t, i := range rows {
+		if i < c.data {
+			m[t] = make([]byte, c.data)
+			m[t][i] = 1
+		} else {
+			m[t] = append([]byte(nil), c.matrix[i-c.data]...)
+		}
+	}
+	inv, err := invert(m)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range missing {
+		out := make([]byte, size)
+		for t, i := range rows {
+			discmath.OctVecMulAdd(out, shards[i], inv[j][t])
+		}
+		shards[j] = out
+	}
+	return nil
+}
+
+// invert returns the inverse of the square matrix m, which it destroys.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular erasure matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := discmath.OctInverse(m[col][col])
+		discmath.OctVecMul(m[col], scale)
+		discmath.OctVecMul(inv[col], scale)
+
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			factor := m[row][col]
+			discmath.OctVecMulAdd(m[row], m[col], factor)
+			discmath.OctVecMulAdd(inv[row], inv[col], factor)
+		}
+	}
+	return inv, nil
+}
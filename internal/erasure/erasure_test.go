@@ -0,0 +1,134 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+const shardSize = 37
+
+func encoded(t *testing.T, c *Code, rng *rand.Rand) [][]byte {
+	t.Helper()
+	shards := make([][]byte, c.DataShards()+c.ParityShards())
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if i < c.DataShards() {
+			rng.Read(shards[i])
+		}
+	}
+	c.Encode(shards)
+	return shards
+}
+
+// forEachLoss calls fn with every set of at most max of the n shards, in
+// increasing order.
+func forEachLoss(n, max int, fn func(lost []int)) {
+	var walk func(from int, lost []int)
+	walk = func(from int, lost []int) {
+		fn(lost)
+		if len(lost) == max {
+			return
+		}
+		for i := from; i < n; i++ {
+			walk(i+1, append(lost, i))
+		}
+	}
+	walk(0, nil)
+}
+
+// checkLoss drops the shards in lost, reconstructs and compares the data
+// shards with the original ones.
+func checkLoss(t *testing.T, c *Code, original [][]byte, lost []int) {
+	t.Helper()
+	shards := make([][]byte, len(original))
+	for i, s := range original {
+		shards[i] = append([]byte(nil), s...)
+	}
+	for _, i := range lost {
+		shards[i] = nil
+	}
+
+	if err := c.Reconstruct(shards, shardSize); err != nil {
+		t.Fatalf("%d+%d, lost %v: %v", c.DataShards(), c.ParityShards(), lost, err)
+	}
+	for j := 0; j < c.DataShards(); j++ {
+		if !bytes.Equal(shards[j], original[j]) {
+			t.Fatalf("%d+%d, lost %v: data shard %d differs", c.DataShards(), c.ParityShards(), lost, j)
+		}
+	}
+}
+
+func TestReconstructEveryLoss(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	codes := [][2]int{
+		{1, 0}, {1, 1}, {1, 3}, {2, 1}, {3, 2}, {4, 4}, {6, 3}, {10, 4},
+		// Boundary code: data+parity == MaxShards
+		{MaxShards - 1, 1},
+	}
+	for _, k := range codes {
+		c, err := New(k[0], k[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		original := encoded(t, c, rng)
+		forEachLoss(len(original), c.ParityShards(), func(lost []int) {
+			checkLoss(t, c, original, lost)
+		})
+	}
+}
+
+func TestReconstructFromAnyDataShards(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	// Every single shard restores the one data shard
+	c, err := New(1, MaxShards-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := encoded(t, c, rng)
+	for keep := range original {
+		var lost []int
+		for i := range original {
+			if i != keep {
+				lost = append(lost, i)
+			}
+		}
+		checkLoss(t, c, original, lost)
+	}
+
+	// Random losses of as many shards as there are parity shards, in codes
+	// too large to try every loss
+	for _, k := range [][2]int{{MaxShards - 2, 2}, {MaxShards / 2, MaxShards / 2}} {
+		c, err = New(k[0], k[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		original = encoded(t, c, rng)
+		for range 20 {
+			lost := rng.Perm(len(original))[:c.ParityShards()]
+			checkLoss(t, c, original, lost)
+		}
+	}
+}
+
+func TestReconstructTooFewShards(t *testing.T) {
+	c, err := New(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := encoded(t, c, rand.New(rand.NewSource(3)))
+	shards[0], shards[2], shards[5] = nil, nil, nil
+
+	if err := c.Reconstruct(shards, shardSize); err != ErrTooFewShards {
+		t.Fatalf("got %v, want ErrTooFewShards", err)
+	}
+}
+
+func TestNewRejectsInvalidCodes(t *testing.T) {
+	for _, k := range [][2]int{{0, 1}, {1, -1}, {MaxShards, 1}, {1, MaxShards}} {
+		if _, err := New(k[0], k[1]); err == nil {
+			t.Errorf("New(%d, %d) succeeded", k[0], k[1])
+		}
+	}
+}
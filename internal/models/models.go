@@ -11,25 +11,196 @@ type File struct {
 	TargetReplicas	int
 	Status		string
 	CreatedAt	time.Time
+	MD5		string	// hex, пустая строка для файлов, загруженных до подсчета хешей
+	SHA256		string	// hex
+	CRC32C		string	// hex, big-endian
+	Metadata	map[string]string	// Content-Type, Cache-Control, x-amz-meta-* и т.п.
+	VersionID	string	// пустая строка = null-версия
+	IsLatest	bool
+	IsDeleteMarker	bool
+
+	BagPath		string	// Файл объекта внутри бэга, пустая строка = последний сегмент ключа;
+				// пока объект ждет упаковки (BagID пуст) — его файл в .packing
+
+	Striped		bool		// Объект лежит в нескольких бэгах (полосы или шарды); BagID пуст
+	Stripes		[]Stripe	// Полосы или шарды для CreateFile (не хранится в files)
+	ErasureData	int		// Если > 0, Stripes — шарды кода: столько шардов данных
+	ErasureParity	int		// и столько шардов четности, любые ErasureData восстанавливают объект
+
+	Compression	string	// "" = без сжатия, "zstd" или "gzip"; SizeBytes — исходный размер
+	CompressedSize	int64	// Размер сжатых данных
+	FrameIndex	[]byte	// Размеры сжатых кадров (uvarint), кадр — compress.FrameSize байт объекта
+
+	Encryption	string	// "" = без шифрования, "AES256" = SSE-S3, "SSE-C" = ключ клиента
+	EncryptedKey	string	// Ключ данных, зашифрованный мастер-ключом или ключом клиента (base64)
+	CustomerKeyMD5	string	// MD5 ключа клиента для SSE-C (base64)
+
+	Offloaded		bool		// Локальная копия удалена клинером, данные только в TON
+	RestoreExpiresAt	*time.Time	// До какого момента держим восстановленную копию
+	Restoring		bool		// Идет восстановление (не хранится в files)
+}
+
+// Stripe — часть большого объекта или шард кода, хранящаяся в отдельном бэге.
+type Stripe struct {
+	Index		int
+	BagID		string
+	BagPath		string	// файл полосы внутри бэга
+	Offset		int64	// смещение полосы в объекте
+	SizeBytes	int64
+}
+
+// Bag — бэг в TON, на который ссылаются версии объектов с одинаковым содержимым.
+// Репликация и контракты ведутся по бэгу, а не по строкам files.
+type Bag struct {
+	ID		int64
+	BagID		string
+	SHA256		string	// hex содержимого, пустая строка = бэг не участвует в дедупликации
+	SizeBytes	int64
+	RefCount	int
+	TargetReplicas	int
+	Status		string
+	IsPack		bool	// пак: бэг-каталог из многих мелких объектов
+	CreatedAt	time.Time
+}
+
+type BagWithStatus struct {
+	Bag
+	ActiveReplicas	int
+	UsedProviders	[]string
+	BucketName	string	// бакет первого объекта бэга, по его настройкам нанимаются провайдеры
+}
+
+// BucketSettings — настройки бакета. Нулевые значения означают настройки шлюза.
+type BucketSettings struct {
+	DefaultReplicas		int		`json:"default_replicas"`		// 0 = DEFAULT_REPLICAS
+	AllowedProviders	[]string	`json:"allowed_providers"`	// ключи провайдеров (hex), пусто = любые
+	BlockedProviders	[]string	`json:"blocked_providers"`
+	MaxRateNano		int64		`json:"max_rate_nano"`		// предельная цена за МБ в день (nanoTON), 0 = без ограничения
+	ErasureData		int		`json:"erasure_data"`		// 0 = полные реплики
+	ErasureParity		int		`json:"erasure_parity"`
+	Compression		string		`json:"compression"`		// "", "zstd" или "gzip"
+	Encryption		string		`json:"encryption"`		// "" = как настроен шлюз, "AES256" или "none"
+	OffloadPolicy		string		`json:"offload_policy"`		// "auto" или "never" — не выгружать локальные копии
+	OffloadAfterHours	int		`json:"offload_after_hours"`	// выгружать не раньше, чем через столько часов
+	SelectionStrategy	string		`json:"selection_strategy"`	// как выбирать провайдеров: "" = "weighted", "cheapest" или "reliable"
+	StorageDays		int		`json:"storage_days"`		// на сколько дней хранения пополняется контракт, 0 = STORAGE_DAYS
+	MaxFundingNano		int64		`json:"max_funding_nano"`	// сколько можно потратить на один найм (nanoTON), 0 = MAX_FUNDING_NANO
+	TopUpBelowDays		int		`json:"topup_below_days"`	// пополнять контракт, когда денег осталось меньше чем на столько дней, 0 = TOPUP_BELOW_DAYS
 }
 
 type Contract struct {
 	ID		int64
-	FileID		int64
+	BagID		string
 	ProviderAddr	string
 	ContractAddr	string
 	BalanceNano	int64
 	Status		string
 	LastCheck	time.Time
+	ExpiresAt	*time.Time	// когда закончатся деньги по цене провайдера, nil для старых контрактов
+	PerDayNano	int64		// сколько провайдер зарабатывает в день, по данным контракта в блокчейне
+	BalanceCheckedAt	*time.Time	// когда баланс последний раз читался из блокчейна
 }
 
-type ContractWithMeta struct {
-	Contract
-	BagID	string
+// ContractFunding — контракт хранения бэга со всеми его провайдерами: баланс
+// общий, провайдерам по контракту соответствуют строки contracts.
+type ContractFunding struct {
+	ContractAddr	string		`json:"contract_addr"`
+	BagID		string		`json:"bag_id"`
+	BucketName	string		`json:"bucket_name"`	// бакет первого объекта бэга, по его настройкам пополняется контракт
+	BalanceNano	int64		`json:"balance_nano"`
+	PerDayNano	int64		`json:"per_day_nano"`	// сколько все провайдеры зарабатывают в день
+	ExpiresAt	*time.Time	`json:"expires_at"`	// когда закончатся деньги
+	CheckedAt	*time.Time	`json:"checked_at"`
+	Providers	int		`json:"providers"`
 }
 
-type FileWithStatus struct {
-	File
-	ActiveReplicas	int
-	UsedProviders	[]string
+// TopUp — пополнение контракта хранения хранителем балансов.
+type TopUp struct {
+	ID		int64		`json:"id"`
+	ContractAddr	string		`json:"contract_addr"`
+	BagID		string		`json:"bag_id"`
+	AmountNano	int64		`json:"amount_nano"`
+	BalanceBeforeNano	int64	`json:"balance_before_nano"`	// баланс контракта перед отправкой
+	Status		string		`json:"status"`	// pending, sent, unknown (отправка упала, деньги могли уйти) или failed
+	TxHash		string		`json:"tx_hash"`	// пусто, если транзакция не известна
+	Error		string		`json:"error"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+// Teardown — вывод денег из контракта хранения удаленного бэга.
+type Teardown struct {
+	ID		int64		`json:"id"`
+	ContractAddr	string		`json:"contract_addr"`
+	BagID		string		`json:"bag_id"`
+	Source		string		`json:"source"`		// "delete" — бэг удален, "sweep" — контракт найден в блокчейне
+	Status		string		`json:"status"`		// "pending", "done" или "cancelled"
+	Attempts	int		`json:"attempts"`
+	NextAttemptAt	time.Time	`json:"next_attempt_at"`
+	TxHash		string		`json:"tx_hash"`	// транзакция вывода, пусто — выводить было нечего
+	LastError	string		`json:"last_error"`
+	CreatedAt	time.Time	`json:"created_at"`
+	DoneAt		*time.Time	`json:"done_at"`
+}
+
+// Provider — провайдер хранения TON, у которого репликатор нанимает бэги.
+type Provider struct {
+	Key		string		`json:"key"`		// hex ключ ADNL
+	Source		string		`json:"source"`		// откуда узнали: "config", "admin" или "contract"
+	Status		string		`json:"status"`		// "new", "active", "unavailable", "offline" или "disabled"
+	LastSeenAt	*time.Time	`json:"last_seen_at"`	// последний ответ на проверку
+	CheckedAt	*time.Time	`json:"checked_at"`
+	RateNano	int64		`json:"rate_nano"`		// цена за МБ в день
+	MinBountyNano	int64		`json:"min_bounty_nano"`
+	MaxBagBytes	int64		`json:"max_bag_bytes"`		// сколько места у провайдера осталось, 0 = неизвестно
+	MinSpan		uint32		`json:"min_span"`		// секунд между доказательствами хранения
+	MaxSpan		uint32		`json:"max_span"`
+	ProbeFailures	int		`json:"probe_failures"`	// проверок подряд без ответа
+	LastError	string		`json:"last_error"`
+	CreatedAt	time.Time	`json:"created_at"`
+
+	AuditsPassed		int		`json:"audits_passed"`		// проверки аудитора, где бэги были на месте
+	AuditsFailed		int		`json:"audits_failed"`
+	HireFailures		int		`json:"hire_failures"`		// неудачных наймов подряд
+	LastHireFailureAt	*time.Time	`json:"last_hire_failure_at"`
+}
+
+type MultipartUpload struct {
+	ID		int64
+	UploadID	string
+	BucketName	string
+	ObjectKey	string
+	Metadata	map[string]string
+	CreatedAt	time.Time
+}
+
+type MultipartPart struct {
+	UploadID	string
+	PartNumber	int
+	ETag		string
+	SizeBytes	int64
+	CreatedAt	time.Time
+}
+
+type APIKey struct {
+	AccessKey	string
+	SecretKey	string
+	IsAdmin		bool
+	CreatedAt	time.Time
+}
+
+type APIKeyGrant struct {
+	ID		int64
+	AccessKey	string
+	BucketName	string	// "*" — любой бакет
+	Prefix		string
+	Actions		[]string
+	CreatedAt	time.Time
+}
+
+// PieceCache — куски выгруженного бэга, скачанные для чтения диапазонов
+type PieceCache struct {
+	ID		int64
+	BagID		string
+	SizeBytes	int64
+	LastAccessAt	time.Time
 }
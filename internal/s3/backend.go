@@ -3,18 +3,23 @@ package s3
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
 	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/erasure"
 	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/sse"
+	"ton-storage-s3-cli/internal/staging"
 	"ton-storage-s3-cli/internal/ton"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/johannesboyne/gofakes3"
 )
 
@@ -25,18 +30,28 @@ var (
 type TonBackend struct {
 	db		*database.DB
 	ton		*ton.Service
-	rootDir		string
+	store		*staging.Store
 	timeSource	gofakes3.TimeSource
+	opts		Options
+}
+
+// Options — как бэкенд раскладывает объекты по бэгам.
+type Options struct {
+	PackMaxSize	int64	// объекты не больше этого размера ждут упаковки, 0 = без упаковки
+	StripeSize	int64	// объекты больше этого размера режутся на полосы, 0 = без полос
+	MasterKey	[]byte	// ключ SSE-S3, которым шифруются все объекты, nil = без шифрования
+	DefaultReplicas	int	// реплик на объект, если ни клиент, ни бакет не задали
 }
 
 var _ gofakes3.Backend = &TonBackend{}
 
-func NewTonBackend(db *database.DB, tonSvc *ton.Service, rootDir string) *TonBackend {
+func NewTonBackend(db *database.DB, tonSvc *ton.Service, store *staging.Store, opts Options) *TonBackend {
 	return &TonBackend{
 		db:		db,
 		ton:		tonSvc,
-		rootDir:	rootDir,
+		store:		store,
 		timeSource:	gofakes3.DefaultTimeSource(),
+		opts:		opts,
 	}
 }
 
@@ -57,10 +72,12 @@ func (b *TonBackend) ListBuckets() ([]gofakes3.BucketInfo, error) {
 }
 
 func (b *TonBackend) ListBucket(name string, prefix *gofakes3.Prefix, page gofakes3.ListBucketPage) (*gofakes3.ObjectList, error) {
+	ctx := context.Background()
+
 	if prefix == nil {
 		prefix = emptyPrefix
 	}
-	exists, err := b.db.BucketExists(context.Background(), name)
+	exists, err := b.db.BucketExists(ctx, name)
 	if err != nil {
 		return nil, err
 	}
@@ -68,36 +85,82 @@ func (b *TonBackend) ListBucket(name string, prefix *gofakes3.Prefix, page gofak
 		return nil, gofakes3.BucketNotFound(name)
 	}
 
-	objects := gofakes3.NewObjectList()
+	maxKeys := page.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = gofakes3.DefaultMaxBucketKeys
+	}
 
-	files, err := b.db.ListFiles(context.Background(), 2000, 0)
-	if err != nil {
-		return nil, err
+	from := prefix.Prefix
+	to, _ := prefixSuccessor(prefix.Prefix)
+
+	if page.HasMarker && page.Marker >= from {
+		from = keyAfter(page.Marker)
+		// Маркер внутри свернутого префикса: весь префикс уже был отдан
+		if cp, ok := commonPrefix(page.Marker, prefix); ok {
+			if next, ok := prefixSuccessor(cp); ok {
+				from = next
+			}
+		}
 	}
 
-	var match gofakes3.PrefixMatch
+	objects := gofakes3.NewObjectList()
+	var count int64
+	var lastPrefix string
 
-	for _, f := range files {
-		if f.BucketName != name {
-			continue
+	for {
+		files, err := b.db.ListLatestFiles(ctx, name, prefix.Prefix, from, to, listPageSize)
+		if err != nil {
+			return nil, err
 		}
 
-		if !prefix.Match(f.ObjectKey, &match) {
-			continue
-		} else if match.CommonPrefix {
-			objects.AddPrefix(match.MatchedPart)
-		} else {
-			item := &gofakes3.Content{
+		restart := false
+		for i := range files {
+			f := &files[i]
+
+			if lastPrefix != "" && strings.HasPrefix(f.ObjectKey, lastPrefix) {
+				continue
+			}
+
+			if count >= maxKeys {
+				objects.IsTruncated = true
+				return objects, nil
+			}
+			count++
+
+			if cp, ok := commonPrefix(f.ObjectKey, prefix); ok {
+				objects.AddPrefix(cp)
+				objects.NextMarker = cp
+				lastPrefix = cp
+
+				// Перескакиваем все ключи под префиксом одним запросом
+				if next, ok := prefixSuccessor(cp); ok {
+					from = next
+					restart = true
+					break
+				}
+				continue
+			}
+
+			objects.Add(&gofakes3.Content{
 				Key:		f.ObjectKey,
 				LastModified:	gofakes3.NewContentTime(f.CreatedAt),
-				ETag:		f.BagID,
+				ETag:		fileETag(f),
 				Size:		f.SizeBytes,
-				StorageClass:	gofakes3.StorageStandard,
-			}
-			objects.Add(item)
+				StorageClass:	storageClass(f),
+			})
+			objects.NextMarker = f.ObjectKey
+		}
+
+		if restart {
+			continue
+		}
+		if len(files) < listPageSize {
+			break
 		}
+		from = keyAfter(files[len(files)-1].ObjectKey)
 	}
 
+	objects.NextMarker = ""
 	return objects, nil
 }
 
@@ -114,30 +177,76 @@ func (b *TonBackend) BucketExists(name string) (bool, error) {
 }
 
 func (b *TonBackend) DeleteBucket(name string) error {
-	return b.db.DeleteBucket(context.Background(), name)
+	return b.deleteBucket(context.Background(), name)
 }
 
 func (b *TonBackend) ForceDeleteBucket(name string) error {
-	return b.db.DeleteBucket(context.Background(), name)
+	return b.deleteBucket(context.Background(), name)
+}
+
+func (b *TonBackend) deleteBucket(ctx context.Context, name string) error {
+	b.abortBucketUploads(ctx, name)
+
+	orphaned, err := b.db.DeleteBucket(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, bagID := range orphaned {
+		b.dropBag(bagID)
+	}
+	return nil
+}
+
+func (b *TonBackend) abortBucketUploads(ctx context.Context, name string) {
+	uploadIDs, err := b.db.ListBucketMultipartUploadIDs(ctx, name)
+	if err != nil {
+		log.Printf("⚠️ Failed to list multipart uploads of bucket %s: %v", name, err)
+		return
+	}
+	for _, id := range uploadIDs {
+		if err := b.removeUpload(ctx, id); err != nil {
+			log.Printf("⚠️ Failed to abort multipart upload %s: %v", id, err)
+		}
+	}
 }
 
 func (b *TonBackend) HeadObject(bucketName, objectName string) (*gofakes3.Object, error) {
-	fMeta, err := b.db.GetFileMeta(context.Background(), bucketName, objectName)
+	ctx := context.Background()
+
+	fMeta, err := b.db.GetFileMeta(ctx, bucketName, objectName)
 	if err != nil {
 		return nil, gofakes3.KeyNotFound(objectName)
 	}
+	if err := b.loadRestoreState(ctx, fMeta); err != nil {
+		return nil, err
+	}
 
-	bagBytes, _ := hex.DecodeString(fMeta.BagID)
+	return headObject(fMeta), nil
+}
 
-	return &gofakes3.Object{
-		Name:		objectName,
-		Size:		fMeta.SizeBytes,
-		Hash:		bagBytes,
+// BagPath is the file holding an object version's data inside its bag.
+func BagPath(f *models.File) string {
+	if f.BagPath != "" {
+		return f.BagPath
+	}
+	return staging.FileName(f.ObjectKey)
+}
+
+func headObject(fMeta *models.File) *gofakes3.Object {
+	obj := &gofakes3.Object{
+		Name:		fMeta.ObjectKey,
+		VersionID:	gofakes3.VersionID(fMeta.VersionID),
+		IsDeleteMarker:	fMeta.IsDeleteMarker,
 		Contents:	io.NopCloser(strings.NewReader("")),
-		Metadata: map[string]string{
-			"Last-Modified": fMeta.CreatedAt.Format(time.RFC1123),
-		},
-	}, nil
+	}
+	if fMeta.IsDeleteMarker {
+		return obj
+	}
+
+	obj.Size = fMeta.SizeBytes
+	obj.Hash = fileHash(fMeta)
+	obj.Metadata = objectMetadata(fMeta, true)
+	return obj
 }
 
 type JobTrackingReader struct {
@@ -160,84 +269,50 @@ func (b *TonBackend) GetObject(bucketName, objectName string, rangeRequest *gofa
 		return nil, gofakes3.KeyNotFound(objectName)
 	}
 
-	jobID, err := b.db.StartDownloadJob(ctx, fMeta.ID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to register download job: %v", err)
-	}
+	return b.getObject(ctx, fMeta, rangeRequest, nil)
+}
 
-	failJob := func(msg string) {
-		b.db.FinishDownloadJob(ctx, jobID, false, msg)
+// getObject reads an object version; key is the client's key for SSE-C
+// objects.
+func (b *TonBackend) getObject(ctx context.Context, fMeta *models.File, rangeRequest *gofakes3.ObjectRangeRequest, key *CustomerKey) (*gofakes3.Object, error) {
+	if fMeta.IsDeleteMarker {
+		return headObject(fMeta), nil
 	}
+	objectName := fMeta.ObjectKey
 
-	bagBytes, _ := hex.DecodeString(fMeta.BagID)
-
-	localPath := filepath.Join(b.rootDir, objectName)
-	downloadPath := filepath.Join(b.rootDir, fMeta.BagID, objectName)
-	finalPath := ""
-
-	if _, err := os.Stat(localPath); err == nil {
-		finalPath = localPath
-	} else if _, err := os.Stat(downloadPath); err == nil {
-		finalPath = downloadPath
-	} else {
-		if err := b.ton.DownloadBag(ctx, bagBytes); err != nil {
-			failJob(err.Error())
-			return nil, fmt.Errorf("TON download init failed: %v", err)
-		}
-		
-		path, err := b.ton.WaitForFile(ctx, bagBytes, objectName)
-		if err != nil {
-			failJob("Wait timeout: " + err.Error())
-			return nil, fmt.Errorf("timeout restoring file from TON: %v", err)
-		}
-		finalPath = path
+	dataKey, err := b.dataKey(fMeta, key)
+	if err != nil {
+		return nil, err
 	}
 
-	f, err := os.Open(finalPath)
+	responseRange, err := rangeRequest.Range(fMeta.SizeBytes)
 	if err != nil {
-		failJob("File open error: " + err.Error())
-		return nil, gofakes3.ErrInternal
+		return nil, err
 	}
-	stat, _ := f.Stat()
 
-	var readerToWrap io.ReadCloser = f
-	var responseRange *gofakes3.ObjectRange
-
-	if rangeRequest != nil {
-		if _, err := f.Seek(rangeRequest.Start, io.SeekStart); err != nil {
-			f.Close()
-			failJob("Seek error")
-			return nil, err
-		}
-		
-		length := rangeRequest.End - rangeRequest.Start + 1
-		
-		readerToWrap = &struct {
-			io.Reader
-			io.Closer
-		}{
-			Reader: io.LimitReader(f, length),
-			Closer: f,
-		}
+	// The running job keeps the cleaner away while the copy is read
+	jobID, err := b.db.StartDownloadJob(ctx, fMeta.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register download job: %v", err)
+	}
 
-		responseRange = &gofakes3.ObjectRange{
-			Start:  rangeRequest.Start,
-			Length: length,
-		}
+	contents, err := b.openObject(ctx, fMeta, jobID, responseRange, dataKey)
+	if err != nil {
+		b.db.FinishDownloadJob(ctx, jobID, false, err.Error())
+		return nil, err
 	}
 
 	return &gofakes3.Object{
 		Name:     objectName,
-		Size:     stat.Size(), 
-		Hash:     bagBytes,
+		VersionID: gofakes3.VersionID(fMeta.VersionID),
+		Size:     fMeta.SizeBytes,
+		Hash:     fileHash(fMeta),
 		Contents: &JobTrackingReader{
-			ReadCloser: readerToWrap,
+			ReadCloser: contents,
 			db:         b.db,
 			jobID:      jobID,
 		},
-		Metadata: map[string]string{
-			"Last-Modified": fMeta.CreatedAt.Format(time.RFC1123),
-		},
+		Metadata: objectMetadata(fMeta, responseRange == nil),
 		Range: responseRange,
 	}, nil
 }
@@ -249,79 +324,354 @@ func (b *TonBackend) PutObject(
 	size int64,
 	conditions *gofakes3.PutConditions,
 ) (result gofakes3.PutObjectResult, err error) {
-
 	ctx := context.Background()
 
-	exists, err := b.db.BucketExists(ctx, bucketName)
+	if conditions != nil {
+		info := &gofakes3.ConditionalObjectInfo{}
+		if fMeta, err := b.db.GetFileMeta(ctx, bucketName, objectName); err == nil && !fMeta.IsDeleteMarker {
+			info.Exists = true
+			info.Hash = fileHash(fMeta)
+		}
+		if err := gofakes3.CheckPutConditions(conditions, info); err != nil {
+			return result, err
+		}
+	}
+
+	file, err := b.putObject(ctx, bucketName, objectName, meta, input, size)
 	if err != nil {
 		return result, err
 	}
-	if !exists {
-		return result, gofakes3.BucketNotFound(bucketName)
+	result.VersionID = gofakes3.VersionID(file.VersionID)
+	return result, nil
+}
+
+func (b *TonBackend) putObject(
+	ctx context.Context,
+	bucketName, objectName string,
+	meta map[string]string,
+	input io.Reader,
+	size int64,
+) (*models.File, error) {
+
+	versionID, err := b.nextVersionID(ctx, bucketName)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = b.db.GetFileMeta(ctx, bucketName, objectName)
-	if err == nil {
-		b.DeleteObject(bucketName, objectName)
+	digest, err := newDigester(meta)
+	if err != nil {
+		return nil, err
 	}
 
-	localPath := filepath.Join(b.rootDir, objectName)
-	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
-		return result, err
+	settings, err := b.bucketSettings(ctx, bucketName)
+	if err != nil {
+		return nil, err
 	}
 
-	tmpFile, err := os.Create(localPath)
+	encryption, customerKey, err := b.uploadEncryption(metaGetter(meta), settings.Encryption)
 	if err != nil {
-		return result, err
+		return nil, err
+	}
+
+	localPath, err := b.store.ObjectPath(bucketName, objectName, versionID)
+	if err != nil {
+		return nil, gofakes3.ErrorInvalidArgument("key", objectName, err.Error())
 	}
 
+	tmpFile, err := b.store.CreateTemp()
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	w := io.MultiWriter(tmpFile, digest)
+
 	if size == -1 {
-		copied, err := io.Copy(tmpFile, input)
+		copied, err := io.Copy(w, input)
 		if err != nil {
 			tmpFile.Close()
-			return result, err
+			return nil, err
 		}
 		size = copied
 	} else {
-		if _, err := io.CopyN(tmpFile, input, size); err != nil {
+		if _, err := io.CopyN(w, input, size); err != nil {
 			tmpFile.Close()
-			return result, err
+			return nil, err
+		}
+		// Дочитываем до EOF: gofakes3 сверяет Content-MD5 только в конце потока
+		if _, err := io.Copy(io.Discard, input); err != nil {
+			tmpFile.Close()
+			return nil, err
 		}
 	}
 	tmpFile.Close()
 
-	pathForTon := strings.ReplaceAll(localPath, "\\", "/")
-	bagIDBytes, err := b.ton.CreateBag(ctx, pathForTon)
-	if err != nil {
-		return result, fmt.Errorf("TON create bag failed: %w", err)
+	if err := digest.Verify(); err != nil {
+		return nil, err
 	}
-	bagIDHex := hex.EncodeToString(bagIDBytes)
 
-	targetReplicas := 1
-	if val, ok := meta["replicas"]; ok {
-		if n, err := strconv.Atoi(val); err == nil && n > 0 {
-			targetReplicas = n
+	if versionID == "" {
+		if err := b.removeNullVersion(ctx, bucketName, objectName); err != nil {
+			return nil, err
 		}
 	}
 
 	file := &models.File{
 		BucketName:     bucketName,
 		ObjectKey:      objectName,
-		BagID:          bagIDHex,
 		SizeBytes:      size,
-		TargetReplicas: targetReplicas,
+		TargetReplicas: b.targetReplicas(meta, settings),
 		Status:         "pending",
+		MD5:            digest.MD5(),
+		SHA256:         digest.SHA256(),
+		CRC32C:         digest.CRC32C(),
+		Metadata:       storableMetadata(meta),
+		VersionID:      versionID,
 	}
 
-	if _, err := b.db.CreateFile(ctx, file); err != nil {
-		return result, fmt.Errorf("DB error: %w", err)
+	// Identical content already stored locally in the bucket is not stored
+	// again: the new version points at the existing bag and its contracts.
+	// Encrypted content is unique to its data key, and erasure-coded content
+	// is never kept as a single bag.
+	if encryption == "" && settings.ErasureData == 0 {
+		deduped, err := b.db.CreateDedupFile(ctx, file)
+		if err != nil {
+			return nil, fmt.Errorf("DB error: %w", err)
+		}
+		if deduped {
+			log.Printf("♻️ %s/%s has the content of bag %s, stored as a reference", bucketName, objectName, file.BagID)
+			return file, nil
+		}
+	}
+
+	// Objects are laid out by the size of the data stored for them, which is
+	// compressed first and encrypted then
+	storedSize, err := b.compressUpload(file, tmpFile.Name(), settings.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if encryption != "" {
+		if storedSize, err = b.encryptUpload(file, tmpFile.Name(), storedSize, encryption, customerKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.opts.PackMaxSize > 0 && size <= b.opts.PackMaxSize {
+		return b.stageForPacking(ctx, file, tmpFile.Name())
+	}
+
+	// The directory of a replaced null version still holds its data while a
+	// deduplicated copy points at its bag
+	if entries, _ := os.ReadDir(filepath.Dir(localPath)); len(entries) > 0 {
+		dirID, err := randomID()
+		if err != nil {
+			return nil, err
+		}
+		if localPath, err = b.store.ObjectPath(bucketName, objectName, dirID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return nil, err
+	}
+
+	if settings.ErasureData > 0 && size > 0 {
+		code, err := erasure.New(settings.ErasureData, settings.ErasureParity)
+		if err != nil {
+			return nil, err
+		}
+		return b.storeErasure(ctx, file, tmpFile.Name(), localPath, storedSize, code)
+	}
+
+	if b.opts.StripeSize > 0 && storedSize > b.opts.StripeSize {
+		return b.storeStriped(ctx, file, tmpFile.Name(), localPath, storedSize)
+	}
+
+	if err := os.Rename(tmpFile.Name(), localPath); err != nil {
+		return nil, err
+	}
+
+	pathForTon := strings.ReplaceAll(localPath, "\\", "/")
+	bagIDBytes, err := b.ton.CreateBag(ctx, pathForTon)
+	if err != nil {
+		return nil, fmt.Errorf("TON create bag failed: %w", err)
 	}
+	file.BagID = hex.EncodeToString(bagIDBytes)
 
-	return gofakes3.PutObjectResult{}, nil
+	if file.ID, err = b.db.CreateFile(ctx, file); err != nil {
+		return nil, fmt.Errorf("DB error: %w", err)
+	}
+
+	return file, nil
 }
 
 func (b *TonBackend) CopyObject(srcBucket, srcKey, dstBucket, dstKey string, meta map[string]string) (result gofakes3.CopyObjectResult, err error) {
-	return gofakes3.CopyObject(b, srcBucket, srcKey, dstBucket, dstKey, meta)
+	src, err := b.db.GetFileMeta(context.Background(), srcBucket, srcKey)
+	if err != nil || src.IsDeleteMarker {
+		return result, gofakes3.KeyNotFound(srcKey)
+	}
+
+	// gofakes3 merges the source headers into meta, so only the keys the
+	// client sent are taken on REPLACE; COPY keeps the stored metadata as is.
+	dstMeta := map[string]string{}
+	switch strings.ToUpper(meta["X-Amz-Metadata-Directive"]) {
+	case "", "COPY":
+		for k, v := range src.Metadata {
+			dstMeta[k] = v
+		}
+	case "REPLACE":
+		for _, k := range strings.Split(meta[MetadataKeysHeader], ",") {
+			if v, ok := meta[k]; ok {
+				dstMeta[k] = v
+			}
+		}
+	default:
+		return result, gofakes3.ErrorInvalidArgument("x-amz-metadata-directive", meta["X-Amz-Metadata-Directive"], "Unknown metadata directive.")
+	}
+
+	if srcBucket == dstBucket && srcKey == dstKey && !strings.EqualFold(meta["X-Amz-Metadata-Directive"], "REPLACE") {
+		return result, gofakes3.ErrorMessage(gofakes3.ErrInvalidArgument,
+			"This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata.")
+	}
+
+	sourceKey, err := ParseCustomerKey(metaGetter(meta), CopySourcePrefix)
+	if err != nil {
+		return result, err
+	}
+	if src.Encryption == EncryptionCustomer && (sourceKey == nil || sourceKey.MD5 != src.CustomerKeyMD5) {
+		// gofakes3 reports the statuses of GET as internal errors here
+		return result, gofakes3.ErrorInvalidArgument(CopySourcePrefix+SSECustomerKeyHeader, "",
+			"The key of the copy source is missing or is not the key it was encrypted with.")
+	}
+	srcDataKey, err := b.dataKey(src, sourceKey)
+	if err != nil {
+		return result, err
+	}
+
+	dstSettings, err := b.bucketSettings(context.Background(), dstBucket)
+	if err != nil {
+		return result, err
+	}
+	encryption, dstCustomerKey, err := b.uploadEncryption(metaGetter(meta), dstSettings.Encryption)
+	if err != nil {
+		return result, err
+	}
+
+	// Objects waiting to be packed have no bag to point at yet; they are small
+	// enough to be copied as data. So is data that has to be encrypted for
+	// the copy, or decrypted.
+	if (src.BagID == "" && !src.Striped) || (src.Encryption == "") != (encryption == "") {
+		for k, v := range meta {
+			if strings.HasPrefix(k, SSEHeader) {
+				dstMeta[k] = v
+			}
+		}
+		return b.copyData(context.Background(), src, sourceKey, dstBucket, dstKey, dstMeta)
+	}
+
+	// The copy shares the encrypted data and its data key, wrapped with the
+	// key of the copy
+	var wrapped string
+	if srcDataKey != nil {
+		if wrapped, err = sse.WrapKey(b.keyEncryptionKey(encryption, dstCustomerKey), srcDataKey); err != nil {
+			return result, err
+		}
+	}
+
+	return b.copyObject(context.Background(), src, dstBucket, dstKey, dstMeta, &models.File{
+		Encryption:     encryption,
+		EncryptedKey:   wrapped,
+		CustomerKeyMD5: customerKeyMD5(dstCustomerKey),
+	})
+}
+
+// copyData copies src, read with the SSE-C key srcKey, by uploading its data
+// again as dstKey.
+func (b *TonBackend) copyData(ctx context.Context, src *models.File, srcKey *CustomerKey, dstBucket, dstKey string, meta map[string]string) (result gofakes3.CopyObjectResult, err error) {
+	obj, err := b.getObject(ctx, src, nil, srcKey)
+	if err != nil {
+		return result, err
+	}
+	defer obj.Contents.Close()
+
+	file, err := b.putObject(ctx, dstBucket, dstKey, meta, obj.Contents, obj.Size)
+	if err != nil {
+		return result, err
+	}
+	return gofakes3.CopyObjectResult{
+		ETag:         fileETag(file),
+		LastModified: gofakes3.NewContentTime(time.Now()),
+	}, nil
+}
+
+// copyObject stores a new version of dstKey pointing at the bag of src. The
+// data is neither read nor uploaded again, so offloaded objects are copied
+// without a restore. The encryption fields of enc are those of the copy.
+func (b *TonBackend) copyObject(ctx context.Context, src *models.File, dstBucket, dstKey string, meta map[string]string, enc *models.File) (result gofakes3.CopyObjectResult, err error) {
+	if err := staging.ValidateKey(dstKey); err != nil {
+		return result, gofakes3.ErrorInvalidArgument("key", dstKey, err.Error())
+	}
+
+	versionID, err := b.nextVersionID(ctx, dstBucket)
+	if err != nil {
+		return result, err
+	}
+
+	// The replaced null version is removed only once the copy holds its own
+	// reference, as it may be the source itself
+	var replaced *models.File
+	if versionID == "" {
+		replaced, _ = b.db.GetFileVersion(ctx, dstBucket, dstKey, "")
+	}
+
+	file := &models.File{
+		BucketName:     dstBucket,
+		ObjectKey:      dstKey,
+		BagID:          src.BagID,
+		BagPath:        BagPath(src),
+		SizeBytes:      src.SizeBytes,
+		TargetReplicas: src.TargetReplicas,
+		MD5:            src.MD5,
+		SHA256:         src.SHA256,
+		CRC32C:         src.CRC32C,
+		Metadata:       storableMetadata(meta),
+		VersionID:      versionID,
+		Compression:    src.Compression,
+		CompressedSize: src.CompressedSize,
+		FrameIndex:     src.FrameIndex,
+		Encryption:     enc.Encryption,
+		EncryptedKey:   enc.EncryptedKey,
+		CustomerKeyMD5: enc.CustomerKeyMD5,
+		Offloaded:      src.Offloaded,
+	}
+	if src.Striped {
+		file.BagPath, file.Striped = "", true
+		file.ErasureData, file.ErasureParity = src.ErasureData, src.ErasureParity
+		if file.Stripes, err = b.db.GetFileStripes(ctx, src.ID); err != nil {
+			return result, fmt.Errorf("DB error: %w", err)
+		}
+	}
+
+	file.ID, err = b.db.CreateFileRef(ctx, file)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return result, gofakes3.KeyNotFound(src.ObjectKey)
+	}
+	if err != nil {
+		return result, fmt.Errorf("DB error: %w", err)
+	}
+
+	if replaced != nil {
+		if err := b.removeVersion(ctx, replaced); err != nil {
+			return result, err
+		}
+	}
+
+	log.Printf("📑 Copied %s/%s to %s/%s (bag %s)", src.BucketName, src.ObjectKey, dstBucket, dstKey, src.BagID)
+	return gofakes3.CopyObjectResult{
+		ETag:         fileETag(src),
+		LastModified: gofakes3.NewContentTime(time.Now()),
+	}, nil
 }
 
 
@@ -340,21 +690,115 @@ func (b *TonBackend) DeleteMulti(bucketName string, objects ...string) (result g
 }
 
 func (b *TonBackend) DeleteObject(bucketName, objectName string) (result gofakes3.ObjectDeleteResult, err error) {
-	fMeta, err := b.db.GetFileMeta(context.Background(), bucketName, objectName)
+	ctx := context.Background()
+
+	versioning, err := b.db.GetBucketVersioning(ctx, bucketName)
 	if err != nil {
+		return result, err
+	}
+
+	var versionID string
+	if versioning == string(gofakes3.VersioningEnabled) {
+		if versionID, err = randomID(); err != nil {
+			return result, err
+		}
+	} else if err := b.removeNullVersion(ctx, bucketName, objectName); err != nil {
+		return result, err
+	}
+
+	// Без версионирования удаление окончательное, маркер не нужен
+	if versioning == "" {
 		return result, nil
 	}
 
-	bagBytes, _ := hex.DecodeString(fMeta.BagID)
+	marker := &models.File{
+		BucketName:     bucketName,
+		ObjectKey:      objectName,
+		Status:         "deleted",
+		Metadata:       map[string]string{},
+		VersionID:      versionID,
+		IsDeleteMarker: true,
+	}
+	if _, err := b.db.CreateFile(ctx, marker); err != nil {
+		return result, fmt.Errorf("DB error: %w", err)
+	}
 
-	if err := b.ton.DeleteLocalFile(bagBytes); err != nil {
-		fmt.Printf("Warning: failed to delete local files for %s: %v\n", objectName, err)
+	result.IsDeleteMarker = true
+	result.VersionID = gofakes3.VersionID(versionID)
+	return result, nil
+}
+
+// stageForPacking stores a small object in the packing area, where it is
+// served from until the packer moves it into a pack.
+func (b *TonBackend) stageForPacking(ctx context.Context, file *models.File, tmpPath string) (*models.File, error) {
+	name, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	packingPath, err := b.store.PackingPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(packingPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, packingPath); err != nil {
+		return nil, err
 	}
 
+	file.BagPath = name
+	if file.ID, err = b.db.CreateFile(ctx, file); err != nil {
+		os.Remove(packingPath)
+		return nil, fmt.Errorf("DB error: %w", err)
+	}
 
-	if err := b.db.DeleteFile(context.Background(), bucketName, objectName); err != nil {
-		return result, err
+	log.Printf("📥 %s/%s queued for packing", file.BucketName, file.ObjectKey)
+	return file, nil
+}
+
+// removeVersion permanently deletes one object version. Its bag is dropped
+// with the local copy once no other version points at it.
+func (b *TonBackend) removeVersion(ctx context.Context, fMeta *models.File) error {
+	orphaned, err := b.db.DeleteFile(ctx, fMeta.ID)
+	if err != nil {
+		return fmt.Errorf("DB error: %w", err)
 	}
 
-	return result, nil
-}
\ No newline at end of file
+	if fMeta.BagID == "" && !fMeta.Striped && !fMeta.IsDeleteMarker {
+		// Not packed yet; a pack built meanwhile keeps a dead copy until it is repacked
+		if packingPath, err := b.store.PackingPath(fMeta.BagPath); err == nil {
+			os.Remove(packingPath)
+		}
+	}
+	if len(orphaned) == 0 {
+		return nil
+	}
+
+	for _, bagID := range orphaned {
+		b.dropBag(bagID)
+	}
+
+	if err := b.store.PruneObject(fMeta.BucketName, fMeta.ObjectKey, fMeta.VersionID); err != nil {
+		fmt.Printf("Warning: failed to remove staged copy of %s: %v\n", fMeta.ObjectKey, err)
+	}
+
+	return nil
+}
+
+// dropBag removes the local data of a bag nothing points at anymore.
+func (b *TonBackend) dropBag(bagID string) {
+	bagBytes, _ := hex.DecodeString(bagID)
+
+	if err := b.ton.DeleteLocalFile(bagBytes); err != nil {
+		fmt.Printf("Warning: failed to delete local files of bag %s: %v\n", bagID, err)
+	}
+}
+
+func (b *TonBackend) removeNullVersion(ctx context.Context, bucketName, objectName string) error {
+	fMeta, err := b.db.GetFileVersion(ctx, bucketName, objectName, "")
+	if err != nil {
+		return nil
+	}
+	return b.removeVersion(ctx, fMeta)
+}
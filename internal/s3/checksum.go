@@ -0,0 +1,154 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+
+	"ton-storage-s3-cli/internal/checksum"
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+const checksumHeaderPrefix = "X-Amz-Checksum-"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// digester hashes an object while it is streamed to disk. MD5, SHA-256 and
+// CRC32C are always computed and persisted; any other x-amz-checksum-*
+// algorithm sent by the client is computed only to verify the upload.
+type digester struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	crc32c hash.Hash32
+
+	expected map[string]string
+	hashes   map[string]hash.Hash
+	writer   io.Writer
+}
+
+func newDigester(meta map[string]string) (*digester, error) {
+	d := &digester{
+		md5:      md5.New(),
+		sha256:   sha256.New(),
+		crc32c:   crc32.New(crc32cTable),
+		expected: map[string]string{},
+	}
+
+	d.hashes = map[string]hash.Hash{
+		"SHA256": d.sha256,
+		"CRC32C": d.crc32c,
+	}
+
+	writers := []io.Writer{d.md5, d.sha256, d.crc32c}
+
+	for k, v := range meta {
+		if !strings.HasPrefix(k, checksumHeaderPrefix) {
+			continue
+		}
+		algo := strings.ToUpper(strings.TrimPrefix(k, checksumHeaderPrefix))
+		if algo == "TYPE" || algo == "ALGORITHM" || algo == "MODE" {
+			continue
+		}
+
+		if _, ok := d.hashes[algo]; !ok {
+			h, ok := checksum.New(algo)
+			if !ok {
+				return nil, gofakes3.ErrorInvalidArgument(k, v, "Unsupported checksum algorithm")
+			}
+			d.hashes[algo] = h
+			writers = append(writers, h)
+		}
+		d.expected[algo] = v
+	}
+
+	d.writer = io.MultiWriter(writers...)
+	return d, nil
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	return d.writer.Write(p)
+}
+
+// Verify compares every x-amz-checksum-* header sent with the request against
+// the digest of the received payload. Checksums sent as trailers of a
+// streaming upload are verified by the sigv4 chunk reader as the body ends.
+func (d *digester) Verify() error {
+	for algo, want := range d.expected {
+		got := base64.StdEncoding.EncodeToString(d.hashes[algo].Sum(nil))
+		if got != want {
+			return gofakes3.ErrorMessagef(gofakes3.ErrBadDigest,
+				"The %s you specified did not match the calculated checksum.", "x-amz-checksum-"+strings.ToLower(algo))
+		}
+	}
+	return nil
+}
+
+func (d *digester) MD5() string    { return hex.EncodeToString(d.md5.Sum(nil)) }
+func (d *digester) SHA256() string { return hex.EncodeToString(d.sha256.Sum(nil)) }
+func (d *digester) CRC32C() string { return hex.EncodeToString(d.crc32c.Sum(nil)) }
+
+// hexToBase64 converts a digest stored in the catalog into the encoding used by
+// the x-amz-checksum-* response headers.
+func hexToBase64(s string) string {
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// fileHash returns the digest used as the object's ETag. Objects uploaded
+// before digests were recorded fall back to their bag ID.
+func fileHash(f *models.File) []byte {
+	if sum, err := hex.DecodeString(f.MD5); err == nil && len(sum) > 0 {
+		return sum
+	}
+	bagBytes, _ := hex.DecodeString(f.BagID)
+	return bagBytes
+}
+
+func fileETag(f *models.File) string {
+	return `"` + hex.EncodeToString(fileHash(f)) + `"`
+}
+
+// objectMetadata builds the response headers describing a stored object. The
+// full-object checksums are omitted for range responses, as S3 does.
+func objectMetadata(f *models.File, fullObject bool) map[string]string {
+	meta := map[string]string{}
+	for k, v := range f.Metadata {
+		meta[k] = v
+	}
+	if meta["Content-Type"] == "" {
+		meta["Content-Type"] = defaultContentType
+	}
+	meta["Last-Modified"] = f.CreatedAt.Format(time.RFC1123)
+	meta["X-Ton-Bag-Id"] = f.BagID
+	for k, v := range encryptionHeaders(f) {
+		meta[k] = v
+	}
+
+	if class := storageClass(f); class != gofakes3.StorageStandard {
+		meta["X-Amz-Storage-Class"] = string(class)
+	}
+	if v := restoreHeader(f); v != "" {
+		meta["X-Amz-Restore"] = v
+	}
+
+	if fullObject {
+		if v := hexToBase64(f.SHA256); v != "" {
+			meta[checksumHeaderPrefix+"Sha256"] = v
+		}
+		if v := hexToBase64(f.CRC32C); v != "" {
+			meta[checksumHeaderPrefix+"Crc32c"] = v
+		}
+	}
+	return meta
+}
@@ -0,0 +1,120 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"ton-storage-s3-cli/internal/compress"
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// compressUpload compresses the uploaded object at tmpPath in place with
+// codec, that of its bucket, and records the frame index with file. Objects
+// whose content type is compressed already, or which compression would not
+// make smaller, are kept as they are. It returns the size of the data stored.
+func (b *TonBackend) compressUpload(file *models.File, tmpPath, codec string) (int64, error) {
+	if codec == "" || file.SizeBytes == 0 || !compress.Compressible(file.Metadata["Content-Type"]) ||
+		file.Metadata["Content-Encoding"] != "" {
+		return file.SizeBytes, nil
+	}
+
+	in, err := os.Open(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := b.store.CreateTemp()
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(out.Name())
+
+	index, size, err := compress.Compress(out, in, codec, file.SizeBytes)
+	if err != nil {
+		out.Close()
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	if size >= file.SizeBytes {
+		return file.SizeBytes, nil
+	}
+	if err := os.Rename(out.Name(), tmpPath); err != nil {
+		return 0, err
+	}
+
+	file.Compression, file.CompressedSize, file.FrameIndex = codec, size, index
+	log.Printf("🗜️ %s/%s compressed with %s: %d -> %d bytes", file.BucketName, file.ObjectKey, codec, file.SizeBytes, size)
+	return size, nil
+}
+
+// compressedFile returns f as the compressed data stored for it.
+func compressedFile(f *models.File) *models.File {
+	compressed := *f
+	compressed.Compression, compressed.SizeBytes = "", f.CompressedSize
+	return &compressed
+}
+
+// compressedRange returns the range of the compressed data indexed by index
+// holding the frames of rng (nil for the whole object).
+func compressedRange(index compress.Index, rng *gofakes3.ObjectRange) *gofakes3.ObjectRange {
+	if rng == nil {
+		return nil
+	}
+	start, length := index.Range(rng.Start, rng.Length)
+	return &gofakes3.ObjectRange{Start: start, Length: length}
+}
+
+func frameIndex(f *models.File) (compress.Index, error) {
+	index, err := compress.ParseIndex(f.FrameIndex)
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %w", f.BucketName, f.ObjectKey, err)
+	}
+	return index, nil
+}
+
+// storedRange returns f as the data its bags hold, compressed and encrypted,
+// and the range of that data holding rng (nil for the whole object).
+func storedRange(f *models.File, rng *gofakes3.ObjectRange) (*models.File, *gofakes3.ObjectRange, error) {
+	if f.Compression != "" {
+		index, err := frameIndex(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		f, rng = compressedFile(f), compressedRange(index, rng)
+	}
+	if f.Encryption != "" {
+		f, rng = sealedFile(f), sealedRange(f, rng)
+	}
+	return f, rng, nil
+}
+
+// openDecompressed opens rng (nil for the whole object) of a compressed
+// object, reading the frames covering it and decompressing them.
+func (b *TonBackend) openDecompressed(ctx context.Context, f *models.File, jobID int64, rng *gofakes3.ObjectRange, dataKey []byte) (io.ReadCloser, error) {
+	index, err := frameIndex(f)
+	if err != nil {
+		return nil, err
+	}
+
+	start, length := int64(0), f.SizeBytes
+	if rng != nil {
+		start, length = rng.Start, rng.Length
+	}
+
+	rc, err := b.openObject(ctx, compressedFile(f), jobID, compressedRange(index, rng), dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{compress.NewReader(rc, f.Compression, index, start, length), rc}, nil
+}
@@ -0,0 +1,321 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/sse"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// Encryption of an object version, as stored in files.sse.
+const (
+	EncryptionS3       = "AES256" // data key wrapped by the master key
+	EncryptionCustomer = "SSE-C"  // data key wrapped by the client's key
+)
+
+const (
+	SSEHeader                  = "X-Amz-Server-Side-Encryption"
+	SSECustomerAlgorithmHeader = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	SSECustomerKeyHeader       = "X-Amz-Server-Side-Encryption-Customer-Key"
+	SSECustomerKeyMD5Header    = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+
+	// CopySourcePrefix precedes the SSE-C headers of the source of a copy.
+	CopySourcePrefix = "X-Amz-Copy-Source-"
+)
+
+// CustomerKey is an SSE-C key sent by a client.
+type CustomerKey struct {
+	Key []byte
+	MD5 string // base64, as sent in the headers
+}
+
+// ParseCustomerKey reads the SSE-C headers of a request through get, those
+// of a copy source if prefix is CopySourcePrefix. It returns nil if none were
+// sent.
+func ParseCustomerKey(get func(string) string, prefix string) (*CustomerKey, error) {
+	algorithm, encoded, sum := get(prefix+SSECustomerAlgorithmHeader), get(prefix+SSECustomerKeyHeader), get(prefix+SSECustomerKeyMD5Header)
+	if algorithm == "" && encoded == "" && sum == "" {
+		return nil, nil
+	}
+
+	if algorithm != "AES256" {
+		return nil, gofakes3.ErrorInvalidArgument(prefix+SSECustomerAlgorithmHeader, algorithm,
+			"The encryption algorithm specified is not valid.")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != sse.KeySize {
+		return nil, gofakes3.ErrorInvalidArgument(prefix+SSECustomerKeyHeader, "",
+			"The secret key was invalid for the specified algorithm.")
+	}
+	actual := md5.Sum(key)
+	if sum != base64.StdEncoding.EncodeToString(actual[:]) {
+		return nil, gofakes3.ErrorInvalidArgument(prefix+SSECustomerKeyMD5Header, sum,
+			"The calculated MD5 hash of the key did not match the hash that was provided.")
+	}
+	return &CustomerKey{Key: key, MD5: sum}, nil
+}
+
+func metaGetter(meta map[string]string) func(string) string {
+	return func(k string) string { return meta[k] }
+}
+
+// uploadEncryption decides how an object uploaded with the request headers
+// read through get to a bucket with the default encryption bucketDefault is
+// encrypted: with the client's key if SSE-C headers were sent, otherwise with
+// the master key if one is configured and the bucket does not opt out.
+// Asking for SSE-S3, explicitly or by the bucket, fails without a master key.
+func (b *TonBackend) uploadEncryption(get func(string) string, bucketDefault string) (string, *CustomerKey, error) {
+	key, err := ParseCustomerKey(get, "")
+	if err != nil {
+		return "", nil, err
+	}
+
+	requested := get(SSEHeader)
+	if key == nil && requested == "" {
+		switch bucketDefault {
+		case EncryptionNone:
+			return "", nil, nil
+		case EncryptionS3:
+			requested = EncryptionS3
+		}
+	}
+
+	switch {
+	case key != nil && requested != "":
+		return "", nil, gofakes3.ErrorInvalidArgument(SSEHeader, requested,
+			"Server Side Encryption with Customer provided key is incompatible with the encryption method specified.")
+	case key != nil:
+		return EncryptionCustomer, key, nil
+	case strings.HasPrefix(requested, "aws:kms"):
+		return "", nil, gofakes3.ErrorMessage(gofakes3.ErrNotImplemented, "SSE-KMS is not supported, use AES256.")
+	case requested != "" && requested != EncryptionS3:
+		return "", nil, gofakes3.ErrorInvalidArgument(SSEHeader, requested, "The encryption method specified is not supported.")
+	case b.opts.MasterKey != nil:
+		return EncryptionS3, nil, nil
+	case requested != "":
+		return "", nil, gofakes3.ErrorMessage(gofakes3.ErrNotImplemented, "Server-side encryption is not configured on this gateway.")
+	}
+	return "", nil, nil
+}
+
+// UploadEncryptionHeaders validates the encryption requested by the headers
+// of an upload to a bucket and returns the headers its response reports it
+// with.
+func (b *TonBackend) UploadEncryptionHeaders(bucketName string, header http.Header) (map[string]string, error) {
+	settings, err := b.bucketSettings(context.Background(), bucketName)
+	if err != nil {
+		return nil, err
+	}
+	encryption, key, err := b.uploadEncryption(header.Get, settings.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return encryptionHeaders(&models.File{Encryption: encryption, CustomerKeyMD5: customerKeyMD5(key)}), nil
+}
+
+func customerKeyMD5(key *CustomerKey) string {
+	if key == nil {
+		return ""
+	}
+	return key.MD5
+}
+
+// encryptionHeaders returns the headers reporting how f is encrypted.
+func encryptionHeaders(f *models.File) map[string]string {
+	switch f.Encryption {
+	case EncryptionS3:
+		return map[string]string{SSEHeader: EncryptionS3}
+	case EncryptionCustomer:
+		return map[string]string{
+			SSECustomerAlgorithmHeader: "AES256",
+			SSECustomerKeyMD5Header:    f.CustomerKeyMD5,
+		}
+	}
+	return map[string]string{}
+}
+
+// keyEncryptionKey returns the key the data key of an object with encryption
+// is wrapped with.
+func (b *TonBackend) keyEncryptionKey(encryption string, key *CustomerKey) []byte {
+	if encryption == EncryptionCustomer {
+		return key.Key
+	}
+	return b.opts.MasterKey
+}
+
+// encryptUpload encrypts the size bytes stored for an uploaded object at
+// tmpPath in place under a new data key and records the key with file. It
+// returns the size of the encrypted data.
+func (b *TonBackend) encryptUpload(file *models.File, tmpPath string, size int64, encryption string, key *CustomerKey) (int64, error) {
+	dataKey, err := sse.NewDataKey()
+	if err != nil {
+		return 0, err
+	}
+	wrapped, err := sse.WrapKey(b.keyEncryptionKey(encryption, key), dataKey)
+	if err != nil {
+		return 0, err
+	}
+
+	in, err := os.Open(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := b.store.CreateTemp()
+	if err != nil {
+		return 0, err
+	}
+	if err := sse.Encrypt(out, in, dataKey, size); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return 0, err
+	}
+	if err := os.Rename(out.Name(), tmpPath); err != nil {
+		os.Remove(out.Name())
+		return 0, err
+	}
+
+	file.Encryption, file.EncryptedKey, file.CustomerKeyMD5 = encryption, wrapped, customerKeyMD5(key)
+	return sse.SealedSize(size), nil
+}
+
+func errCustomerKeyRequired() error {
+	return gofakes3.ErrorMessage(ErrInvalidRequest,
+		"The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.")
+}
+
+// dataKey returns the key the data of f is encrypted with, nil if it is
+// stored in the clear. SSE-C objects need the client's key, key.
+func (b *TonBackend) dataKey(f *models.File, key *CustomerKey) ([]byte, error) {
+	switch f.Encryption {
+	case "":
+		return nil, nil
+	case EncryptionCustomer:
+		if key == nil {
+			return nil, errCustomerKeyRequired()
+		}
+		if subtle.ConstantTimeCompare([]byte(key.MD5), []byte(f.CustomerKeyMD5)) != 1 {
+			return nil, gofakes3.ErrorMessage(ErrAccessDenied, "Access Denied")
+		}
+	}
+
+	kek := b.keyEncryptionKey(f.Encryption, key)
+	if kek == nil {
+		return nil, fmt.Errorf("%s/%s is encrypted with SSE-S3 but no master key is configured", f.BucketName, f.ObjectKey)
+	}
+	dataKey, err := sse.UnwrapKey(kek, f.EncryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key of %s/%s: %w", f.BucketName, f.ObjectKey, err)
+	}
+	return dataKey, nil
+}
+
+// sealedFile returns f as the encrypted data its bags hold, which the read
+// paths serve like any object.
+func sealedFile(f *models.File) *models.File {
+	sealed := *f
+	sealed.SizeBytes = sse.SealedSize(f.SizeBytes)
+	return &sealed
+}
+
+// sealedRange returns the range of the encrypted data of f holding rng (nil
+// for the whole object).
+func sealedRange(f *models.File, rng *gofakes3.ObjectRange) *gofakes3.ObjectRange {
+	if rng == nil {
+		return nil
+	}
+	start, length := sse.SealedRange(f.SizeBytes, rng.Start, rng.Length)
+	return &gofakes3.ObjectRange{Start: start, Length: length}
+}
+
+// openObject opens rng (nil for the whole object) of an object's data,
+// decompressing it and decrypting it with dataKey as it is stored.
+func (b *TonBackend) openObject(ctx context.Context, f *models.File, jobID int64, rng *gofakes3.ObjectRange, dataKey []byte) (io.ReadCloser, error) {
+	if f.Compression != "" {
+		return b.openDecompressed(ctx, f, jobID, rng, dataKey)
+	}
+	if f.Encryption == "" {
+		return b.openContents(ctx, f, jobID, rng)
+	}
+
+	start, length := int64(0), f.SizeBytes
+	if rng != nil {
+		start, length = rng.Start, rng.Length
+	}
+
+	rc, err := b.openContents(ctx, sealedFile(f), jobID, sealedRange(f, rng))
+	if err != nil {
+		return nil, err
+	}
+	r, err := sse.NewReader(rc, dataKey, f.SizeBytes, start, length)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, rc}, nil
+}
+
+// CheckCustomerKey fails if an object is encrypted with SSE-C, which is read
+// only with the client's key. Missing objects pass.
+func (b *TonBackend) CheckCustomerKey(bucketName, objectName, versionID string) error {
+	fMeta, err := b.lookupVersion(context.Background(), bucketName, objectName, versionID)
+	if err != nil || fMeta.Encryption != EncryptionCustomer {
+		return nil
+	}
+	return errCustomerKeyRequired()
+}
+
+// GetObjectWithKey reads an object version (see lookupVersion) encrypted with
+// the SSE-C key key. gofakes3 passes no request headers to the backend, so
+// the S3 frontend serves such reads itself.
+func (b *TonBackend) GetObjectWithKey(bucketName, objectName, versionID, rangeHeader string, key *CustomerKey) (*gofakes3.Object, error) {
+	ctx := context.Background()
+
+	fMeta, err := b.lookupVersion(ctx, bucketName, objectName, versionID)
+	if err != nil {
+		return nil, err
+	}
+	rangeRequest := parseRange(rangeHeader)
+	if rangeHeader != "" && rangeRequest == nil {
+		return nil, gofakes3.ErrInvalidRange
+	}
+	return b.getObject(ctx, fMeta, rangeRequest, key)
+}
+
+// HeadObjectWithKey is HeadObject for an object version encrypted with the
+// SSE-C key key.
+func (b *TonBackend) HeadObjectWithKey(bucketName, objectName, versionID string, key *CustomerKey) (*gofakes3.Object, error) {
+	ctx := context.Background()
+
+	fMeta, err := b.lookupVersion(ctx, bucketName, objectName, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if !fMeta.IsDeleteMarker {
+		if _, err := b.dataKey(fMeta, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.loadRestoreState(ctx, fMeta); err != nil {
+		return nil, err
+	}
+	return headObject(fMeta), nil
+}
@@ -0,0 +1,246 @@
+package s3
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ton-storage-s3-cli/internal/erasure"
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// erasureBlockSize is how many bytes each shard holds of one coded block: a
+// block is erasureBlockSize bytes of every data shard, the last one padded
+// with zeros, plus the parity computed from them.
+const erasureBlockSize = 64 << 10
+
+// storeErasure encodes the size bytes stored for an object into the shards of
+// code next to localPath, each seeded as a bag of its own with a single
+// replica. The replicator hires a different provider for every shard of an
+// object.
+func (b *TonBackend) storeErasure(ctx context.Context, file *models.File, tmpPath, localPath string, size int64, code *erasure.Code) (*models.File, error) {
+	in, err := os.Open(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	n := code.DataShards() + code.ParityShards()
+	paths := make([]string, n)
+	outs := make([]*os.File, n)
+	shards := make([][]byte, n)
+	defer func() {
+		for _, out := range outs {
+			if out != nil {
+				out.Close()
+			}
+		}
+	}()
+	for i := range outs {
+		paths[i] = fmt.Sprintf("%s.%05d", localPath, i)
+		if outs[i], err = os.Create(paths[i]); err != nil {
+			return nil, err
+		}
+		shards[i] = make([]byte, erasureBlockSize)
+	}
+
+	var shardSize int64
+	for read := int64(0); read < size; shardSize += erasureBlockSize {
+		for _, shard := range shards[:code.DataShards()] {
+			n, err := io.ReadFull(in, shard)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			clear(shard[n:])
+			read += int64(n)
+		}
+
+		code.Encode(shards)
+		for i, shard := range shards {
+			if _, err := outs[i].Write(shard); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i, out := range outs {
+		err := out.Close()
+		outs[i] = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, path := range paths {
+		bagIDBytes, err := b.ton.CreateBag(ctx, strings.ReplaceAll(path, "\\", "/"))
+		if err != nil {
+			return nil, fmt.Errorf("TON create bag failed: %w", err)
+		}
+		file.Stripes = append(file.Stripes, models.Stripe{
+			Index:     i,
+			BagID:     hex.EncodeToString(bagIDBytes),
+			BagPath:   filepath.Base(path),
+			SizeBytes: shardSize,
+		})
+	}
+
+	file.Striped = true
+	file.ErasureData, file.ErasureParity = code.DataShards(), code.ParityShards()
+	file.TargetReplicas = 1
+	if file.ID, err = b.db.CreateFile(ctx, file); err != nil {
+		return nil, fmt.Errorf("DB error: %w", err)
+	}
+
+	log.Printf("🧩 %s/%s erasure-coded into %d+%d shards", file.BucketName, file.ObjectKey, file.ErasureData, file.ErasureParity)
+	return file, nil
+}
+
+// erasurePaths returns the local copies of an erasure-coded object's shards,
+// "" for those missing. If fewer than the data shards are local, the object
+// is marked offloaded. Offloaded objects are read only once a restore brought
+// enough shards back: there is no streaming or piece reading for them.
+func (b *TonBackend) erasurePaths(ctx context.Context, f *models.File) ([]string, error) {
+	errCold := errOffloaded()
+	if f.Offloaded {
+		return nil, errCold
+	}
+
+	shards, err := b.db.GetFileStripes(ctx, f.ID)
+	if err != nil {
+		return nil, fmt.Errorf("DB error: %w", err)
+	}
+
+	paths := make([]string, len(shards))
+	local := 0
+	for i, s := range shards {
+		bagBytes, _ := hex.DecodeString(s.BagID)
+		if path, err := b.ton.GetPathToBagFile(bagBytes, s.BagPath); err == nil {
+			paths[i] = path
+			local++
+		}
+	}
+	if local >= f.ErasureData {
+		return paths, nil
+	}
+
+	log.Printf("⚠️ Only %d of %d shards of %s/%s are local, marking it offloaded", local, len(shards), f.BucketName, f.ObjectKey)
+	for i, s := range shards {
+		if paths[i] != "" {
+			continue
+		}
+		if err := b.db.MarkBagOffloaded(ctx, s.BagID); err != nil {
+			return nil, fmt.Errorf("DB error: %w", err)
+		}
+	}
+	f.Offloaded = true
+	return nil, errCold
+}
+
+// openErasure opens rng (nil for the whole object) of an erasure-coded
+// object, reconstructing blocks from the parity shards where data shards are
+// missing.
+func (b *TonBackend) openErasure(ctx context.Context, f *models.File, rng *gofakes3.ObjectRange) (io.ReadCloser, error) {
+	paths, err := b.erasurePaths(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	code, err := erasure.New(f.ErasureData, f.ErasureParity)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &erasureReader{code: code, files: make([]*os.File, len(paths)), block: -1}
+	for i, path := range paths {
+		if path == "" {
+			continue
+		}
+		if r.files[i], err = os.Open(path); err != nil {
+			log.Printf("⚠️ Failed to open shard %d of %s/%s: %v", i, f.BucketName, f.ObjectKey, err)
+		}
+	}
+
+	r.pos, r.end = 0, f.SizeBytes
+	if rng != nil {
+		r.pos, r.end = rng.Start, rng.Start+rng.Length
+	}
+	return r, nil
+}
+
+// erasureReader reads an erasure-coded object from its local shards block by
+// block.
+type erasureReader struct {
+	code     *erasure.Code
+	files    []*os.File // nil for missing shards
+	pos, end int64
+
+	block int64  // index of the block in buf, -1 for none
+	buf   []byte // data of the block
+}
+
+func (r *erasureReader) Read(p []byte) (int, error) {
+	if r.pos >= r.end {
+		return 0, io.EOF
+	}
+
+	blockSize := int64(r.code.DataShards()) * erasureBlockSize
+	if block := r.pos / blockSize; block != r.block {
+		if err := r.readBlock(block); err != nil {
+			return 0, err
+		}
+	}
+
+	from := r.pos % blockSize
+	n := copy(p, r.buf[from:min(blockSize, from+r.end-r.pos)])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// readBlock reads a block from the data shards, reconstructing it from as
+// many parity shards as data shards are missing.
+func (r *erasureReader) readBlock(block int64) error {
+	shards := make([][]byte, len(r.files))
+	present := 0
+	for i, f := range r.files {
+		if present == r.code.DataShards() {
+			break
+		}
+		if f == nil {
+			continue
+		}
+
+		shard := make([]byte, erasureBlockSize)
+		if _, err := f.ReadAt(shard, block*erasureBlockSize); err != nil {
+			log.Printf("⚠️ Failed to read shard %d: %v", i, err)
+			continue
+		}
+		shards[i] = shard
+		present++
+	}
+
+	if err := r.code.Reconstruct(shards, erasureBlockSize); err != nil {
+		return err
+	}
+
+	r.buf = r.buf[:0]
+	for _, shard := range shards[:r.code.DataShards()] {
+		r.buf = append(r.buf, shard...)
+	}
+	r.block = block
+	return nil
+}
+
+func (r *erasureReader) Close() error {
+	for _, f := range r.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package s3
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// commonPrefix returns the part of key that is rolled up into a CommonPrefix
+// when listing with a delimiter, as S3 does: the prefix followed by everything
+// up to and including the first delimiter after it.
+func commonPrefix(key string, prefix *gofakes3.Prefix) (string, bool) {
+	if !prefix.HasDelimiter || prefix.Delimiter == "" || !strings.HasPrefix(key, prefix.Prefix) {
+		return "", false
+	}
+	rest := key[len(prefix.Prefix):]
+	idx := strings.Index(rest, prefix.Delimiter)
+	if idx < 0 {
+		return "", false
+	}
+	return prefix.Prefix + rest[:idx+len(prefix.Delimiter)], true
+}
+
+// prefixSuccessor returns the smallest string, in binary order, that is greater
+// than every string starting with p. It fails only if p consists solely of
+// the maximal rune.
+func prefixSuccessor(p string) (string, bool) {
+	for len(p) > 0 {
+		r, size := utf8.DecodeLastRuneInString(p)
+		p = p[:len(p)-size]
+		if r == utf8.MaxRune || r == utf8.RuneError {
+			continue
+		}
+		r++
+		if r >= 0xD800 && r <= 0xDFFF {
+			r = 0xE000
+		}
+		return p + string(r), true
+	}
+	return "", false
+}
+
+// keyAfter returns the smallest key greater than key. Postgres text cannot
+// hold NUL, so appending \x01 is enough.
+func keyAfter(key string) string {
+	return key + "\x01"
+}
@@ -0,0 +1,57 @@
+package s3
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// PassthroughHeaderPrefix carries standard headers that gofakes3 does not
+	// forward to the backend (Cache-Control, Content-Language, Expires). The S3
+	// frontend renames them before the request reaches gofakes3.
+	PassthroughHeaderPrefix = "X-Amz-Gw-"
+
+	// MetadataKeysHeader lists the metadata headers a client actually sent
+	// with a copy request, so that the REPLACE directive can tell them apart
+	// from the source object's metadata merged in by gofakes3.
+	MetadataKeysHeader = PassthroughHeaderPrefix + "Metadata-Keys"
+
+	defaultContentType = "binary/octet-stream"
+)
+
+// PassthroughHeaders are the object headers renamed with PassthroughHeaderPrefix.
+var PassthroughHeaders = []string{"Cache-Control", "Content-Language", "Expires"}
+
+var storedHeaders = map[string]bool{
+	"Content-Type":                    true,
+	"Content-Disposition":             true,
+	"Content-Encoding":                true,
+	"Content-Language":                true,
+	"Cache-Control":                   true,
+	"Expires":                         true,
+	"X-Amz-Website-Redirect-Location": true,
+}
+
+// IsStoredHeader reports whether a canonical request header is persisted as
+// object metadata.
+func IsStoredHeader(key string) bool {
+	return storedHeaders[key] || strings.HasPrefix(key, "X-Amz-Meta-")
+}
+
+// storableMetadata picks the user and system metadata that is persisted with
+// an object out of the headers passed by gofakes3. Transient request headers
+// (signatures, checksums, dates) are dropped.
+func storableMetadata(meta map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range meta {
+		k = http.CanonicalHeaderKey(k)
+		if k == MetadataKeysHeader {
+			continue
+		}
+		k = strings.TrimPrefix(k, PassthroughHeaderPrefix)
+		if IsStoredHeader(k) {
+			result[k] = v
+		}
+	}
+	return result
+}
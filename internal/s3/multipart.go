@@ -0,0 +1,375 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/staging"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/johannesboyne/gofakes3"
+)
+
+var _ gofakes3.MultipartBackend = &TonBackend{}
+
+func (b *TonBackend) partsDir(uploadID string) string {
+	return b.store.MultipartDir(uploadID)
+}
+
+func (b *TonBackend) partPath(uploadID string, partNumber int) string {
+	return filepath.Join(b.partsDir(uploadID), fmt.Sprintf("%05d", partNumber))
+}
+
+func (b *TonBackend) getUpload(ctx context.Context, bucket, object string, id gofakes3.UploadID) (*models.MultipartUpload, error) {
+	upload, err := b.db.GetMultipartUpload(ctx, string(id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, gofakes3.ErrNoSuchUpload
+	}
+	if err != nil {
+		return nil, err
+	}
+	if upload.BucketName != bucket || upload.ObjectKey != object {
+		return nil, gofakes3.ErrNoSuchUpload
+	}
+	return upload, nil
+}
+
+func (b *TonBackend) CreateMultipartUpload(bucket, object string, meta map[string]string) (gofakes3.UploadID, error) {
+	ctx := context.Background()
+
+	uploadID, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	if meta == nil {
+		meta = map[string]string{}
+	}
+
+	if err := staging.ValidateKey(object); err != nil {
+		return "", gofakes3.ErrorInvalidArgument("key", object, err.Error())
+	}
+
+	// The upload's headers are kept until it completes, which must not happen
+	// to a client's key
+	if key, err := ParseCustomerKey(metaGetter(meta), ""); err != nil || key != nil {
+		if err == nil {
+			err = gofakes3.ErrorMessage(gofakes3.ErrNotImplemented, "SSE-C is not supported for multipart uploads.")
+		}
+		return "", err
+	}
+	settings, err := b.bucketSettings(ctx, bucket)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := b.uploadEncryption(metaGetter(meta), settings.Encryption); err != nil {
+		return "", err
+	}
+
+	upload := &models.MultipartUpload{
+		UploadID:   uploadID,
+		BucketName: bucket,
+		ObjectKey:  object,
+		Metadata:   meta,
+	}
+	if err := b.db.CreateMultipartUpload(ctx, upload); err != nil {
+		return "", fmt.Errorf("DB error: %w", err)
+	}
+
+	if err := os.MkdirAll(b.partsDir(uploadID), 0755); err != nil {
+		return "", err
+	}
+
+	return gofakes3.UploadID(uploadID), nil
+}
+
+func (b *TonBackend) UploadPart(bucket, object string, id gofakes3.UploadID, partNumber int, contentLength int64, input io.Reader) (string, error) {
+	ctx := context.Background()
+
+	if partNumber <= 0 || partNumber > gofakes3.MaxUploadPartNumber {
+		return "", gofakes3.ErrInvalidPart
+	}
+
+	upload, err := b.getUpload(ctx, bucket, object, id)
+	if err != nil {
+		return "", err
+	}
+
+	dir := b.partsDir(upload.UploadID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, "part-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hash := md5.New()
+	written, err := io.Copy(io.MultiWriter(tmpFile, hash), input)
+	tmpFile.Close()
+	if err != nil {
+		return "", err
+	}
+	if contentLength >= 0 && written != contentLength {
+		return "", gofakes3.ErrIncompleteBody
+	}
+
+	if err := os.Rename(tmpFile.Name(), b.partPath(upload.UploadID, partNumber)); err != nil {
+		return "", err
+	}
+
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+
+	part := &models.MultipartPart{
+		UploadID:   upload.UploadID,
+		PartNumber: partNumber,
+		ETag:       etag,
+		SizeBytes:  written,
+	}
+	if err := b.db.PutMultipartPart(ctx, part); err != nil {
+		return "", fmt.Errorf("DB error: %w", err)
+	}
+
+	return etag, nil
+}
+
+func (b *TonBackend) ListMultipartUploads(bucket string, marker *gofakes3.UploadListMarker, prefix gofakes3.Prefix, limit int64) (*gofakes3.ListMultipartUploadsResult, error) {
+	ctx := context.Background()
+
+	result := &gofakes3.ListMultipartUploadsResult{
+		Bucket:     bucket,
+		Delimiter:  prefix.Delimiter,
+		Prefix:     prefix.Prefix,
+		MaxUploads: limit,
+	}
+
+	// Rows come after (keyMarker, idMarker); an idMarker of -1 takes in every
+	// upload of keyMarker itself
+	keyMarker, idMarker := "", int64(0)
+	var lastPrefix string
+
+	if marker != nil {
+		result.KeyMarker = marker.Object
+		result.UploadIDMarker = marker.UploadID
+
+		// Without an upload id marker only later keys are listed
+		keyMarker, idMarker = marker.Object, math.MaxInt64
+		if marker.UploadID != "" {
+			idMarker = 0
+			if u, err := b.db.GetMultipartUpload(ctx, string(marker.UploadID)); err == nil && u.BucketName == bucket {
+				idMarker = u.ID
+			}
+		}
+
+		if cp, ok := commonPrefix(marker.Object, &prefix); ok {
+			// Маркер внутри свернутого префикса: весь префикс уже был отдан
+			lastPrefix = cp
+			if next, ok := prefixSuccessor(cp); ok {
+				keyMarker, idMarker = next, -1
+			}
+		}
+	}
+
+	var count int64
+
+	for {
+		uploads, err := b.db.ListMultipartUploads(ctx, bucket, prefix.Prefix, keyMarker, idMarker, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		restart := false
+		for _, u := range uploads {
+			keyMarker, idMarker = u.ObjectKey, u.ID
+
+			if lastPrefix != "" && strings.HasPrefix(u.ObjectKey, lastPrefix) {
+				continue
+			}
+
+			if count >= limit {
+				result.IsTruncated = true
+				return result, nil
+			}
+			count++
+
+			if cp, ok := commonPrefix(u.ObjectKey, &prefix); ok {
+				result.CommonPrefixes = append(result.CommonPrefixes, gofakes3.CommonPrefix{Prefix: cp})
+				result.NextKeyMarker = cp
+				result.NextUploadIDMarker = ""
+				lastPrefix = cp
+
+				// Перескакиваем все загрузки под префиксом одним запросом
+				if next, ok := prefixSuccessor(cp); ok {
+					keyMarker, idMarker = next, -1
+					restart = true
+					break
+				}
+				continue
+			}
+
+			result.Uploads = append(result.Uploads, gofakes3.ListMultipartUploadItem{
+				StorageClass: gofakes3.StorageStandard,
+				Key:          u.ObjectKey,
+				UploadID:     gofakes3.UploadID(u.UploadID),
+				Initiated:    gofakes3.NewContentTime(u.CreatedAt),
+			})
+			result.NextKeyMarker = u.ObjectKey
+			result.NextUploadIDMarker = gofakes3.UploadID(u.UploadID)
+		}
+
+		if restart {
+			continue
+		}
+		if len(uploads) < listPageSize {
+			break
+		}
+	}
+
+	if !result.IsTruncated {
+		result.NextKeyMarker = ""
+		result.NextUploadIDMarker = ""
+	}
+
+	return result, nil
+}
+
+func (b *TonBackend) ListParts(bucket, object string, uploadID gofakes3.UploadID, marker int, limit int64) (*gofakes3.ListMultipartUploadPartsResult, error) {
+	ctx := context.Background()
+
+	upload, err := b.getUpload(ctx, bucket, object, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := b.db.ListMultipartParts(ctx, upload.UploadID, marker, int(limit)+1)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &gofakes3.ListMultipartUploadPartsResult{
+		Bucket:           bucket,
+		Key:              object,
+		UploadID:         uploadID,
+		MaxParts:         limit,
+		PartNumberMarker: marker,
+		StorageClass:     gofakes3.StorageStandard,
+	}
+
+	if int64(len(parts)) > limit {
+		parts = parts[:limit]
+		result.IsTruncated = true
+	}
+
+	for _, p := range parts {
+		result.Parts = append(result.Parts, gofakes3.ListMultipartUploadPartItem{
+			PartNumber:   p.PartNumber,
+			LastModified: gofakes3.NewContentTime(p.CreatedAt),
+			ETag:         p.ETag,
+			Size:         p.SizeBytes,
+		})
+		result.NextPartNumberMarker = p.PartNumber
+	}
+
+	return result, nil
+}
+
+func (b *TonBackend) AbortMultipartUpload(bucket, object string, id gofakes3.UploadID) error {
+	ctx := context.Background()
+
+	upload, err := b.getUpload(ctx, bucket, object, id)
+	if err != nil {
+		return err
+	}
+
+	return b.removeUpload(ctx, upload.UploadID)
+}
+
+func (b *TonBackend) removeUpload(ctx context.Context, uploadID string) error {
+	if err := b.db.DeleteMultipartUpload(ctx, uploadID); err != nil {
+		return fmt.Errorf("DB error: %w", err)
+	}
+
+	if err := os.RemoveAll(b.partsDir(uploadID)); err != nil {
+		log.Printf("⚠️ Failed to remove parts of upload %s: %v", uploadID, err)
+	}
+	return nil
+}
+
+func (b *TonBackend) CompleteMultipartUpload(bucket, object string, id gofakes3.UploadID, input *gofakes3.CompleteMultipartUploadRequest) (gofakes3.VersionID, string, error) {
+	ctx := context.Background()
+
+	upload, err := b.getUpload(ctx, bucket, object, id)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(input.Parts) == 0 {
+		return "", "", gofakes3.ErrorMessage(gofakes3.ErrMalformedXML, "You must specify at least one part")
+	}
+
+	stored, err := b.db.ListMultipartParts(ctx, upload.UploadID, 0, gofakes3.MaxUploadPartNumber)
+	if err != nil {
+		return "", "", err
+	}
+
+	partsByNumber := make(map[int]models.MultipartPart, len(stored))
+	for _, p := range stored {
+		partsByNumber[p.PartNumber] = p
+	}
+
+	var size int64
+	readers := make([]io.Reader, 0, len(input.Parts))
+
+	for i, inPart := range input.Parts {
+		if i > 0 && inPart.PartNumber <= input.Parts[i-1].PartNumber {
+			closeAll(readers)
+			return "", "", gofakes3.ErrInvalidPartOrder
+		}
+
+		p, ok := partsByNumber[inPart.PartNumber]
+		if !ok || strings.Trim(inPart.ETag, `"`) != strings.Trim(p.ETag, `"`) {
+			closeAll(readers)
+			return "", "", gofakes3.ErrorMessagef(gofakes3.ErrInvalidPart, "unexpected part %d in complete request", inPart.PartNumber)
+		}
+
+		f, err := os.Open(b.partPath(upload.UploadID, p.PartNumber))
+		if err != nil {
+			closeAll(readers)
+			return "", "", fmt.Errorf("part %d is missing on disk: %w", p.PartNumber, err)
+		}
+		readers = append(readers, f)
+		size += p.SizeBytes
+	}
+
+	file, err := b.putObject(ctx, bucket, object, upload.Metadata, io.MultiReader(readers...), size)
+	closeAll(readers)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := b.removeUpload(ctx, upload.UploadID); err != nil {
+		log.Printf("⚠️ Upload %s completed but cleanup failed: %v", upload.UploadID, err)
+	}
+
+	return gofakes3.VersionID(file.VersionID), fileETag(file), nil
+}
+
+func closeAll(readers []io.Reader) {
+	for _, r := range readers {
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
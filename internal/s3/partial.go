@@ -0,0 +1,90 @@
+package s3
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/ton"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// MaxPartialReadSize is the largest range of an offloaded object that is read
+// piece by piece; larger reads need a restore.
+const MaxPartialReadSize = 64 << 20
+
+// openPieces reads a range of an offloaded object by fetching only the pieces
+// covering it into the piece cache. The object stays offloaded: the job is
+// accounted as partial and the bag is never marked local.
+func (b *TonBackend) openPieces(ctx context.Context, f *models.File, jobID, start, length int64) (io.ReadCloser, error) {
+	if err := b.db.MarkDownloadPartial(ctx, jobID, f.BagID); err != nil {
+		return nil, fmt.Errorf("DB error: %w", err)
+	}
+
+	bagBytes, _ := hex.DecodeString(f.BagID)
+	r, err := b.ton.ReadBagRange(context.Background(), bagBytes, BagPath(f), start, length)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("🧩 [Job %d] Range %d+%d of %s read from pieces of bag %s", jobID, start, length, f.ObjectKey, f.BagID)
+	return &pieceReader{BagFileReader: r, db: b.db, jobID: jobID, bagID: f.BagID}, nil
+}
+
+// pieceReader accounts the pieces a partial read fetched once it is closed.
+type pieceReader struct {
+	*ton.BagFileReader
+	db    *database.DB
+	jobID int64
+	bagID string
+}
+
+func (r *pieceReader) Close() error {
+	err := r.BagFileReader.Close()
+	if err := r.db.AddFetchedBytes(context.Background(), r.jobID, r.bagID, r.FetchedBytes()); err != nil {
+		log.Printf("⚠️ [Job %d] Failed to account fetched pieces: %v", r.jobID, err)
+	}
+	return err
+}
+
+// parseRange parses a single byte range as gofakes3 does. It returns nil for
+// no or an invalid range.
+func parseRange(header string) *gofakes3.ObjectRangeRequest {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil
+	}
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return nil
+		}
+		return &gofakes3.ObjectRangeRequest{FromEnd: true, End: n}
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil
+	}
+	if last == "" {
+		return &gofakes3.ObjectRangeRequest{Start: start, End: gofakes3.RangeNoEnd}
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return nil
+	}
+	return &gofakes3.ObjectRangeRequest{Start: start, End: end}
+}
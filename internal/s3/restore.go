@@ -0,0 +1,375 @@
+package s3
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"ton-storage-s3-cli/internal/database"
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/ton"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/johannesboyne/gofakes3"
+)
+
+// StorageGlacier is reported for objects whose local copy has been offloaded
+// to TON, including temporarily restored ones.
+const StorageGlacier gofakes3.StorageClass = "GLACIER"
+
+// Error codes gofakes3 does not define; see ErrorStatus.
+const (
+	ErrInvalidObjectState       gofakes3.ErrorCode = "InvalidObjectState"
+	ErrRestoreAlreadyInProgress gofakes3.ErrorCode = "RestoreAlreadyInProgress"
+	ErrInvalidRequest           gofakes3.ErrorCode = "InvalidRequest"
+	ErrAccessDenied             gofakes3.ErrorCode = "AccessDenied"
+	ErrInvalidTag               gofakes3.ErrorCode = "InvalidTag"
+	ErrNoSuchTagSet             gofakes3.ErrorCode = "NoSuchTagSet"
+	ErrNoEncryptionConfig       gofakes3.ErrorCode = "ServerSideEncryptionConfigurationNotFoundError"
+)
+
+// ErrorStatus returns the HTTP status of an S3 error code, including the codes
+// gofakes3 would report as internal errors.
+func ErrorStatus(code gofakes3.ErrorCode) int {
+	switch code {
+	case ErrInvalidObjectState, ErrAccessDenied:
+		return http.StatusForbidden
+	case ErrInvalidRequest, ErrInvalidTag:
+		return http.StatusBadRequest
+	case ErrNoSuchTagSet, ErrNoEncryptionConfig:
+		return http.StatusNotFound
+	case ErrRestoreAlreadyInProgress:
+		return http.StatusConflict
+	}
+	return code.Status()
+}
+
+func storageClass(f *models.File) gofakes3.StorageClass {
+	if f.Offloaded || f.RestoreExpiresAt != nil {
+		return StorageGlacier
+	}
+	return gofakes3.StorageStandard
+}
+
+// restoreHeader builds the x-amz-restore value of an object, or "" if no
+// restore was ever requested.
+func restoreHeader(f *models.File) string {
+	switch {
+	case f.Restoring:
+		return `ongoing-request="true"`
+	case f.RestoreExpiresAt != nil:
+		return fmt.Sprintf(`ongoing-request="false", expiry-date="%s"`, f.RestoreExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	return ""
+}
+
+func (b *TonBackend) loadRestoreState(ctx context.Context, f *models.File) error {
+	if !f.Offloaded {
+		return nil
+	}
+	restoring, err := b.db.IsFileRestoring(ctx, f.ID)
+	if err != nil {
+		return fmt.Errorf("DB error: %w", err)
+	}
+	f.Restoring = restoring
+	return nil
+}
+
+// lookupVersion resolves the versionId query parameter of a request: empty
+// means the latest version and "null" the null version.
+func (b *TonBackend) lookupVersion(ctx context.Context, bucketName, objectName, versionID string) (*models.File, error) {
+	if versionID == "" {
+		fMeta, err := b.db.GetFileMeta(ctx, bucketName, objectName)
+		if err != nil {
+			return nil, gofakes3.KeyNotFound(objectName)
+		}
+		return fMeta, nil
+	}
+	return b.getVersion(ctx, bucketName, objectName, gofakes3.VersionID(versionID))
+}
+
+// CheckReadable fails with ErrInvalidObjectState if the object's data has been
+// offloaded and cannot be read; see readSource. It lets the S3 frontend reject
+// such reads with the proper status before gofakes3 calls GetObject.
+func (b *TonBackend) CheckReadable(bucketName, objectName, versionID, rangeHeader string) error {
+	ctx := context.Background()
+
+	fMeta, err := b.lookupVersion(ctx, bucketName, objectName, versionID)
+	if err != nil {
+		return err
+	}
+	if fMeta.IsDeleteMarker {
+		return nil
+	}
+
+	rangeRequest := parseRange(rangeHeader)
+	rng, err := rangeRequest.Range(fMeta.SizeBytes)
+	if (rangeHeader != "" && rangeRequest == nil) || err != nil {
+		// gofakes3 reports the invalid range itself
+		return nil
+	}
+	if fMeta, rng, err = storedRange(fMeta, rng); err != nil {
+		return err
+	}
+	_, _, err = b.readSource(ctx, fMeta, rng)
+	return err
+}
+
+// How the data of an object is read.
+const (
+	sourceLocal     = iota // the local copy
+	sourceRestoring        // the bag its running restore downloads
+	sourcePieces           // pieces of the offloaded bag, for small ranges
+)
+
+// readSource decides where a read of rng (nil for the whole object) is served
+// from, returning the local path for sourceLocal. Offloaded objects are
+// readable while their restore runs, and in ranges of up to
+// MaxPartialReadSize without one.
+func (b *TonBackend) readSource(ctx context.Context, f *models.File, rng *gofakes3.ObjectRange) (int, string, error) {
+	if f.ErasureData > 0 {
+		_, err := b.erasurePaths(ctx, f)
+		return sourceLocal, "", err
+	}
+	if f.Striped {
+		source, _, err := b.stripeSources(ctx, f, rng)
+		return source, "", err
+	}
+
+	path, errCold := b.localPath(ctx, f)
+	if errCold == nil {
+		return sourceLocal, path, nil
+	}
+	if !f.Offloaded {
+		return 0, "", errCold
+	}
+
+	if err := b.loadRestoreState(ctx, f); err != nil {
+		return 0, "", err
+	}
+	switch {
+	case f.Restoring:
+		return sourceRestoring, "", nil
+	case rng != nil && rng.Length <= MaxPartialReadSize:
+		return sourcePieces, "", nil
+	}
+	return 0, "", errCold
+}
+
+// openContents opens rng (nil for the whole object) of an object's data for
+// the download job jobID.
+func (b *TonBackend) openContents(ctx context.Context, f *models.File, jobID int64, rng *gofakes3.ObjectRange) (io.ReadCloser, error) {
+	if f.ErasureData > 0 {
+		return b.openErasure(ctx, f, rng)
+	}
+	if f.Striped {
+		return b.openStripes(ctx, f, jobID, rng)
+	}
+
+	start, length := int64(0), f.SizeBytes
+	if rng != nil {
+		start, length = rng.Start, rng.Length
+	}
+
+	source, path, err := b.readSource(ctx, f, rng)
+	if err != nil {
+		return nil, err
+	}
+
+	bagBytes, _ := hex.DecodeString(f.BagID)
+	fileName := BagPath(f)
+
+	switch source {
+	case sourceRestoring:
+		r, err := b.ton.OpenBagFile(context.Background(), bagBytes, fileName, start, length)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+
+	case sourcePieces:
+		return b.openPieces(ctx, f, jobID, start, length)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("❌ File open error for %s/%s: %v", f.BucketName, f.ObjectKey, err)
+		return nil, gofakes3.ErrInternal
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, start, length), file}, nil
+}
+
+func errOffloaded() error {
+	return gofakes3.ErrorMessage(ErrInvalidObjectState, "The operation is not valid for the object's storage class")
+}
+
+// localPath returns the local copy of an object's data. An object whose copy
+// is missing although it was never marked offloaded (e.g. it was offloaded
+// before offloading was tracked) is marked now, so it can be restored.
+func (b *TonBackend) localPath(ctx context.Context, f *models.File) (string, error) {
+	errCold := errOffloaded()
+	if f.Offloaded {
+		return "", errCold
+	}
+
+	if f.BagID == "" {
+		path, err := b.packingPath(ctx, f)
+		if err != nil || path != "" {
+			return path, err
+		}
+	}
+
+	bagBytes, _ := hex.DecodeString(f.BagID)
+	path, err := b.ton.GetPathToBagFile(bagBytes, BagPath(f))
+	if err == nil {
+		return path, nil
+	}
+
+	log.Printf("⚠️ Local copy of %s/%s is missing (%v), marking bag %s offloaded", f.BucketName, f.ObjectKey, err, f.BagID)
+	if err := b.db.MarkBagOffloaded(ctx, f.BagID); err != nil {
+		return "", fmt.Errorf("DB error: %w", err)
+	}
+	f.Offloaded = true
+	return "", errCold
+}
+
+// packingPath returns the staged copy of an object waiting to be packed. If
+// the object has been packed since f was loaded, f is reloaded and "" returned.
+func (b *TonBackend) packingPath(ctx context.Context, f *models.File) (string, error) {
+	path, err := b.store.PackingPath(f.BagPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	packed, err := b.db.GetFileByID(ctx, f.ID)
+	if err != nil || packed.BagID == "" {
+		return "", gofakes3.KeyNotFound(f.ObjectKey)
+	}
+	*f = *packed
+	return "", nil
+}
+
+// RestoreObject makes an offloaded object readable for days days. It reports
+// whether a new download was started; restoring an object that is already
+// restored only moves its expiry date.
+func (b *TonBackend) RestoreObject(bucketName, objectName, versionID string, days int) (bool, error) {
+	ctx := context.Background()
+
+	if days < 1 {
+		return false, gofakes3.ErrorInvalidArgument("Days", fmt.Sprint(days), "Days must be a positive number")
+	}
+
+	fMeta, err := b.lookupVersion(ctx, bucketName, objectName, versionID)
+	if err != nil {
+		return false, err
+	}
+	if fMeta.IsDeleteMarker {
+		return false, gofakes3.KeyNotFound(objectName)
+	}
+
+	if !fMeta.Offloaded {
+		if fMeta.RestoreExpiresAt == nil {
+			return false, gofakes3.ErrorMessage(ErrInvalidObjectState, "Restore is not allowed for the object's current storage class")
+		}
+		if err := b.db.ExtendRestore(ctx, fMeta.ID, days); err != nil {
+			return false, fmt.Errorf("DB error: %w", err)
+		}
+		return false, nil
+	}
+
+	if _, err := StartRestore(b.db, b.ton, fMeta, days); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// StartRestore downloads an offloaded object's file of its bag, or of each of
+// its stripes' bags at once, in the background and keeps it for days days
+// once it is complete. An erasure-coded object is restored as soon as any of
+// its data shards' worth of shards are.
+func StartRestore(db *database.DB, tonSvc *ton.Service, f *models.File, days int) (int64, error) {
+	parts := []*models.File{f}
+	if f.Striped {
+		stripes, err := db.GetFileStripes(context.Background(), f.ID)
+		if err != nil {
+			return 0, fmt.Errorf("DB error: %w", err)
+		}
+		parts = parts[:0]
+		for _, s := range stripes {
+			parts = append(parts, stripeFile(f, s))
+		}
+	}
+
+	bags := make([][]byte, len(parts))
+	for i, p := range parts {
+		bagBytes, err := hex.DecodeString(p.BagID)
+		if err != nil {
+			return 0, fmt.Errorf("invalid bag id %q: %w", p.BagID, err)
+		}
+		bags[i] = bagBytes
+	}
+
+	jobID, err := db.StartRestoreJob(context.Background(), f.ID, days)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, gofakes3.ErrorMessage(ErrRestoreAlreadyInProgress, "Object restore is already in progress")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("DB error: %w", err)
+	}
+
+	go func() {
+		ctx := context.Background()
+		log.Printf("📥 [Job %d] Restore started for %s (%d days)", jobID, f.ObjectKey, days)
+
+		done := make(chan error, len(parts))
+		for i, p := range parts {
+			go func() {
+				if err := tonSvc.DownloadBagFile(ctx, bags[i], BagPath(p)); err != nil {
+					log.Printf("❌ [Job %d] Restore init failed for bag %s: %v", jobID, p.BagID, err)
+					done <- err
+					return
+				}
+				_, err := tonSvc.WaitForFile(ctx, bags[i], BagPath(p))
+				if err != nil {
+					log.Printf("⚠️ [Job %d] Restore of bag %s failed: %v", jobID, p.BagID, err)
+				}
+				done <- err
+			}()
+		}
+
+		needed := len(parts)
+		if f.ErasureData > 0 {
+			needed = f.ErasureData
+		}
+		var restored int
+		var lastErr error
+		for range parts {
+			if err := <-done; err != nil {
+				lastErr = err
+			} else if restored++; restored == needed {
+				break
+			}
+		}
+		if restored < needed {
+			db.FinishDownloadJob(ctx, jobID, false, lastErr.Error())
+			return
+		}
+
+		log.Printf("✅ [Job %d] Restore success: %s, kept until %s", jobID, f.ObjectKey, time.Now().AddDate(0, 0, days).Format(time.RFC3339))
+		db.FinishDownloadJob(ctx, jobID, true, "")
+	}()
+
+	return jobID, nil
+}
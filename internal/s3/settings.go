@@ -0,0 +1,296 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ton-storage-s3-cli/internal/compress"
+	"ton-storage-s3-cli/internal/erasure"
+	"ton-storage-s3-cli/internal/models"
+	"ton-storage-s3-cli/internal/ton"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/johannesboyne/gofakes3"
+)
+
+// Offload policies of a bucket.
+const (
+	OffloadAuto  = "auto"  // local copies are dropped once their bags are replicated
+	OffloadNever = "never" // local copies are kept
+)
+
+// EncryptionNone as the encryption of a bucket stores its objects in the
+// clear even if the gateway has a master key. Clients may still ask for
+// encryption per request.
+const EncryptionNone = "none"
+
+// ReplicasHeader is the metadata a client sets to choose how many providers
+// store an object, x-amz-meta-replicas on the wire.
+const ReplicasHeader = "X-Amz-Meta-Replicas"
+
+// Tags of the TagSet of a bucket through which S3 clients manage its
+// settings. The TagSet of a bucket is its settings: PutBucketTagging replaces
+// them all and GetBucketTagging lists those that are set.
+const (
+	TagReplicas          = "ton:replicas"
+	TagAllowedProviders  = "ton:allowed-providers" // provider keys separated by spaces
+	TagBlockedProviders  = "ton:blocked-providers"
+	TagMaxRateNano       = "ton:max-rate-nano"
+	TagErasure           = "ton:erasure" // data+parity shards, like "4+2"
+	TagCompression       = "ton:compression"
+	TagEncryption        = "ton:encryption"
+	TagOffloadPolicy     = "ton:offload"
+	TagOffloadAfterHours = "ton:offload-after-hours"
+	TagSelectionStrategy = "ton:selection"
+	TagStorageDays       = "ton:storage-days"
+	TagMaxFundingNano    = "ton:max-funding-nano"
+	TagTopUpBelowDays    = "ton:topup-below-days"
+)
+
+// CheckBucketSettings validates the settings of a bucket. Provider addresses
+// are replaced with their keys and an empty offload policy with auto.
+func CheckBucketSettings(s *models.BucketSettings) error {
+	if s.DefaultReplicas < 0 {
+		return errors.New("default_replicas must not be negative")
+	}
+	if s.MaxRateNano < 0 {
+		return errors.New("max_rate_nano must not be negative")
+	}
+	if s.OffloadAfterHours < 0 {
+		return errors.New("offload_after_hours must not be negative")
+	}
+	if s.StorageDays < 0 {
+		return errors.New("storage_days must not be negative")
+	}
+	if s.MaxFundingNano < 0 {
+		return errors.New("max_funding_nano must not be negative")
+	}
+	if s.TopUpBelowDays < 0 {
+		return errors.New("topup_below_days must not be negative")
+	}
+
+	for _, list := range [][]string{s.AllowedProviders, s.BlockedProviders} {
+		for i, addr := range list {
+			key, err := ton.ParseProviderKey(addr)
+			if err != nil {
+				return err
+			}
+			list[i] = key
+		}
+	}
+
+	if s.ErasureData != 0 || s.ErasureParity != 0 {
+		if _, err := erasure.New(s.ErasureData, s.ErasureParity); err != nil {
+			return err
+		}
+	}
+	if s.Compression != "" && !compress.Valid(s.Compression) {
+		return errors.New("unknown compression codec, use zstd or gzip")
+	}
+
+	switch s.Encryption {
+	case "", EncryptionS3, EncryptionNone:
+	default:
+		return errors.New("unknown encryption, use AES256 or none")
+	}
+
+	if !ton.ValidStrategy(s.SelectionStrategy) {
+		return errors.New("unknown selection strategy, use cheapest, reliable or weighted")
+	}
+
+	switch s.OffloadPolicy {
+	case "":
+		s.OffloadPolicy = OffloadAuto
+	case OffloadAuto, OffloadNever:
+	default:
+		return errors.New("unknown offload policy, use auto or never")
+	}
+	return nil
+}
+
+// bucketSettings returns the settings of a bucket, NoSuchBucket if there is
+// no such bucket.
+func (b *TonBackend) bucketSettings(ctx context.Context, name string) (*models.BucketSettings, error) {
+	s, err := b.db.GetBucketSettings(ctx, name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, gofakes3.BucketNotFound(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DB error: %w", err)
+	}
+	return s, nil
+}
+
+// targetReplicas returns how many providers store an object uploaded with
+// meta to a bucket with settings s: what the client asked for, or the
+// default of the bucket or of the gateway.
+func (b *TonBackend) targetReplicas(meta map[string]string, s *models.BucketSettings) int {
+	if n, err := strconv.Atoi(meta[ReplicasHeader]); err == nil && n > 0 {
+		return n
+	}
+	if s.DefaultReplicas > 0 {
+		return s.DefaultReplicas
+	}
+	return max(1, b.opts.DefaultReplicas)
+}
+
+// settingsTags returns the tags of a bucket with settings s.
+func settingsTags(s *models.BucketSettings) map[string]string {
+	tags := map[string]string{}
+	if s.DefaultReplicas > 0 {
+		tags[TagReplicas] = strconv.Itoa(s.DefaultReplicas)
+	}
+	if len(s.AllowedProviders) > 0 {
+		tags[TagAllowedProviders] = strings.Join(s.AllowedProviders, " ")
+	}
+	if len(s.BlockedProviders) > 0 {
+		tags[TagBlockedProviders] = strings.Join(s.BlockedProviders, " ")
+	}
+	if s.MaxRateNano > 0 {
+		tags[TagMaxRateNano] = strconv.FormatInt(s.MaxRateNano, 10)
+	}
+	if s.ErasureData > 0 {
+		tags[TagErasure] = fmt.Sprintf("%d+%d", s.ErasureData, s.ErasureParity)
+	}
+	if s.Compression != "" {
+		tags[TagCompression] = s.Compression
+	}
+	if s.Encryption != "" {
+		tags[TagEncryption] = s.Encryption
+	}
+	if s.OffloadPolicy != OffloadAuto {
+		tags[TagOffloadPolicy] = s.OffloadPolicy
+	}
+	if s.OffloadAfterHours > 0 {
+		tags[TagOffloadAfterHours] = strconv.Itoa(s.OffloadAfterHours)
+	}
+	if s.SelectionStrategy != "" {
+		tags[TagSelectionStrategy] = s.SelectionStrategy
+	}
+	if s.StorageDays > 0 {
+		tags[TagStorageDays] = strconv.Itoa(s.StorageDays)
+	}
+	if s.MaxFundingNano > 0 {
+		tags[TagMaxFundingNano] = strconv.FormatInt(s.MaxFundingNano, 10)
+	}
+	if s.TopUpBelowDays > 0 {
+		tags[TagTopUpBelowDays] = strconv.Itoa(s.TopUpBelowDays)
+	}
+	return tags
+}
+
+// settingsFromTags parses the settings a bucket is tagged with.
+func settingsFromTags(tags map[string]string) (*models.BucketSettings, error) {
+	s := &models.BucketSettings{}
+	for k, v := range tags {
+		var err error
+		switch k {
+		case TagReplicas:
+			s.DefaultReplicas, err = strconv.Atoi(v)
+		case TagAllowedProviders:
+			s.AllowedProviders = strings.Fields(v)
+		case TagBlockedProviders:
+			s.BlockedProviders = strings.Fields(v)
+		case TagMaxRateNano:
+			s.MaxRateNano, err = strconv.ParseInt(v, 10, 64)
+		case TagErasure:
+			data, parity, _ := strings.Cut(v, "+")
+			if s.ErasureData, err = strconv.Atoi(data); err == nil {
+				s.ErasureParity, err = strconv.Atoi(parity)
+			}
+		case TagCompression:
+			s.Compression = v
+		case TagEncryption:
+			s.Encryption = v
+		case TagOffloadPolicy:
+			s.OffloadPolicy = v
+		case TagOffloadAfterHours:
+			s.OffloadAfterHours, err = strconv.Atoi(v)
+		case TagSelectionStrategy:
+			s.SelectionStrategy = v
+		case TagStorageDays:
+			s.StorageDays, err = strconv.Atoi(v)
+		case TagMaxFundingNano:
+			s.MaxFundingNano, err = strconv.ParseInt(v, 10, 64)
+		case TagTopUpBelowDays:
+			s.TopUpBelowDays, err = strconv.Atoi(v)
+		default:
+			return nil, gofakes3.ErrorMessagef(ErrInvalidTag, "Unknown tag %s: buckets are tagged with their ton:* settings only.", k)
+		}
+		if err != nil {
+			return nil, gofakes3.ErrorMessagef(ErrInvalidTag, "Invalid value of tag %s.", k)
+		}
+	}
+
+	if err := CheckBucketSettings(s); err != nil {
+		return nil, gofakes3.ErrorMessage(ErrInvalidTag, err.Error())
+	}
+	return s, nil
+}
+
+// GetBucketTagging returns the tags of a bucket, which are its settings.
+func (b *TonBackend) GetBucketTagging(bucketName string) (map[string]string, error) {
+	s, err := b.bucketSettings(context.Background(), bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return settingsTags(s), nil
+}
+
+// PutBucketTagging replaces the settings of a bucket with those it is tagged
+// with; untagged settings go back to their defaults.
+func (b *TonBackend) PutBucketTagging(bucketName string, tags map[string]string) error {
+	s, err := settingsFromTags(tags)
+	if err != nil {
+		return err
+	}
+	return b.setBucketSettings(context.Background(), bucketName, s)
+}
+
+// GetBucketEncryption returns the encryption objects uploaded to a bucket
+// without asking for one get, "" for none.
+func (b *TonBackend) GetBucketEncryption(bucketName string) (string, error) {
+	s, err := b.bucketSettings(context.Background(), bucketName)
+	if err != nil {
+		return "", err
+	}
+	if s.Encryption == EncryptionS3 || (s.Encryption == "" && b.opts.MasterKey != nil) {
+		return EncryptionS3, nil
+	}
+	return "", nil
+}
+
+// PutBucketEncryption sets the default encryption of a bucket: AES256, or ""
+// to fall back to the gateway's.
+func (b *TonBackend) PutBucketEncryption(bucketName, algorithm string) error {
+	switch {
+	case strings.HasPrefix(algorithm, "aws:kms"):
+		return gofakes3.ErrorMessage(gofakes3.ErrNotImplemented, "SSE-KMS is not supported, use AES256.")
+	case algorithm != "" && algorithm != EncryptionS3:
+		return gofakes3.ErrorMessage(gofakes3.ErrMalformedXML, "The encryption algorithm specified is not valid.")
+	case algorithm != "" && b.opts.MasterKey == nil:
+		return gofakes3.ErrorMessage(gofakes3.ErrNotImplemented, "Server-side encryption is not configured on this gateway.")
+	}
+
+	ctx := context.Background()
+	s, err := b.bucketSettings(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+	s.Encryption = algorithm
+	return b.setBucketSettings(ctx, bucketName, s)
+}
+
+func (b *TonBackend) setBucketSettings(ctx context.Context, bucketName string, s *models.BucketSettings) error {
+	found, err := b.db.SetBucketSettings(ctx, bucketName, s)
+	if err != nil {
+		return fmt.Errorf("DB error: %w", err)
+	}
+	if !found {
+		return gofakes3.BucketNotFound(bucketName)
+	}
+	return nil
+}
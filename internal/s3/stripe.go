@@ -0,0 +1,203 @@
+package s3
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// stripeReadahead is how many stripes a read opens ahead of the one being
+// read, so that their bags are fetched in parallel.
+const stripeReadahead = 4
+
+// storeStriped splits the size bytes stored for a large object into stripes
+// of StripeSize bytes next to localPath, each seeded as a bag of its own, so
+// that every stripe is replicated and fetched independently of the others.
+func (b *TonBackend) storeStriped(ctx context.Context, file *models.File, tmpPath, localPath string, size int64) (*models.File, error) {
+	in, err := os.Open(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	for offset := int64(0); offset < size; offset += b.opts.StripeSize {
+		idx := len(file.Stripes)
+		stripeSize := min(b.opts.StripeSize, size-offset)
+
+		path := fmt.Sprintf("%s.%05d", localPath, idx)
+		if err := writeStripe(path, in, stripeSize); err != nil {
+			return nil, err
+		}
+
+		bagIDBytes, err := b.ton.CreateBag(ctx, strings.ReplaceAll(path, "\\", "/"))
+		if err != nil {
+			return nil, fmt.Errorf("TON create bag failed: %w", err)
+		}
+
+		file.Stripes = append(file.Stripes, models.Stripe{
+			Index:     idx,
+			BagID:     hex.EncodeToString(bagIDBytes),
+			BagPath:   filepath.Base(path),
+			Offset:    offset,
+			SizeBytes: stripeSize,
+		})
+	}
+
+	file.Striped = true
+	if file.ID, err = b.db.CreateFile(ctx, file); err != nil {
+		return nil, fmt.Errorf("DB error: %w", err)
+	}
+
+	log.Printf("🧱 %s/%s striped into %d bags", file.BucketName, file.ObjectKey, len(file.Stripes))
+	return file, nil
+}
+
+func writeStripe(path string, r io.Reader, size int64) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, r, size); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// stripeFile returns the stripe s of f as an object of its own, which the
+// single bag read paths serve.
+func stripeFile(f *models.File, s models.Stripe) *models.File {
+	part := *f
+	part.Striped, part.Stripes = false, nil
+	part.BagID, part.BagPath, part.SizeBytes = s.BagID, s.BagPath, s.SizeBytes
+	return &part
+}
+
+// stripePart is the range of one stripe a read of a striped object covers.
+type stripePart struct {
+	f   *models.File
+	rng *gofakes3.ObjectRange
+}
+
+// stripeSources decides where each stripe covered by rng (nil for the whole
+// object) is read from, as readSource does for an object. It returns the
+// slowest source and the stripes to read. Reading pieces is limited by the
+// size of the whole range.
+func (b *TonBackend) stripeSources(ctx context.Context, f *models.File, rng *gofakes3.ObjectRange) (int, []stripePart, error) {
+	start, end := int64(0), f.SizeBytes
+	if rng != nil {
+		start, end = rng.Start, rng.Start+rng.Length
+	}
+
+	stripes, err := b.db.GetFileStripes(ctx, f.ID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("DB error: %w", err)
+	}
+
+	source := sourceLocal
+	var parts []stripePart
+	for _, s := range stripes {
+		from, to := max(start, s.Offset), min(end, s.Offset+s.SizeBytes)
+		if from >= to {
+			continue
+		}
+
+		part := stripePart{
+			f:   stripeFile(f, s),
+			rng: &gofakes3.ObjectRange{Start: from - s.Offset, Length: to - from},
+		}
+		partSource, _, err := b.readSource(ctx, part.f, part.rng)
+		if err != nil {
+			return 0, nil, err
+		}
+		source = max(source, partSource)
+		parts = append(parts, part)
+	}
+
+	if source == sourcePieces && end-start > MaxPartialReadSize {
+		return 0, nil, errOffloaded()
+	}
+	return source, parts, nil
+}
+
+// openStripes opens rng (nil for the whole object) of a striped object as
+// one stream over its stripes.
+func (b *TonBackend) openStripes(ctx context.Context, f *models.File, jobID int64, rng *gofakes3.ObjectRange) (io.ReadCloser, error) {
+	_, parts, err := b.stripeSources(ctx, f, rng)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &stripeReader{}
+	for _, p := range parts {
+		r.pending = append(r.pending, func() (io.ReadCloser, error) {
+			return b.openContents(ctx, p.f, jobID, p.rng)
+		})
+	}
+	if err := r.fill(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// stripeReader reads stripes one after another while keeping the next ones
+// open, so that those being downloaded are fetched in the meantime.
+type stripeReader struct {
+	pending []func() (io.ReadCloser, error)
+	open    []io.ReadCloser
+}
+
+func (r *stripeReader) fill() error {
+	for len(r.open) < stripeReadahead && len(r.pending) > 0 {
+		rc, err := r.pending[0]()
+		if err != nil {
+			return err
+		}
+		r.pending = r.pending[1:]
+		r.open = append(r.open, rc)
+	}
+	return nil
+}
+
+func (r *stripeReader) Read(p []byte) (int, error) {
+	for {
+		if len(r.open) == 0 {
+			return 0, io.EOF
+		}
+
+		n, err := r.open[0].Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		r.open[0].Close()
+		r.open = r.open[1:]
+		if err := r.fill(); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *stripeReader) Close() error {
+	var err error
+	for _, rc := range r.open {
+		if cerr := rc.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	r.open, r.pending = nil, nil
+	return err
+}
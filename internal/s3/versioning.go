@@ -0,0 +1,322 @@
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/johannesboyne/gofakes3"
+)
+
+// listPageSize is how many rows are fetched from the catalog per query while
+// building a listing.
+const listPageSize = 1000
+
+var _ gofakes3.VersionedBackend = &TonBackend{}
+
+func randomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// nextVersionID returns the version ID for a new object version: a fresh one
+// if versioning is enabled on the bucket, or the null version otherwise.
+func (b *TonBackend) nextVersionID(ctx context.Context, bucketName string) (string, error) {
+	versioning, err := b.db.GetBucketVersioning(ctx, bucketName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", gofakes3.BucketNotFound(bucketName)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if versioning != string(gofakes3.VersioningEnabled) {
+		return "", nil
+	}
+	return randomID()
+}
+
+func (b *TonBackend) VersioningConfiguration(bucket string) (result gofakes3.VersioningConfiguration, err error) {
+	versioning, err := b.db.GetBucketVersioning(context.Background(), bucket)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return result, gofakes3.BucketNotFound(bucket)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	result.Status = gofakes3.VersioningStatus(versioning)
+	return result, nil
+}
+
+func (b *TonBackend) SetVersioningConfiguration(bucket string, v gofakes3.VersioningConfiguration) error {
+	if v.MFADelete == gofakes3.MFADeleteEnabled {
+		return gofakes3.ErrNotImplemented
+	}
+
+	switch v.Status {
+	case "":
+		return nil
+	case gofakes3.VersioningEnabled, gofakes3.VersioningSuspended:
+	default:
+		return gofakes3.ErrIllegalVersioningConfiguration
+	}
+
+	exists, err := b.db.BucketExists(context.Background(), bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return gofakes3.BucketNotFound(bucket)
+	}
+
+	return b.db.SetBucketVersioning(context.Background(), bucket, string(v.Status))
+}
+
+// storedVersionID returns the version ID versionID is stored under: the null
+// version is stored without one.
+func storedVersionID(versionID gofakes3.VersionID) string {
+	if versionID == "null" {
+		return ""
+	}
+	return string(versionID)
+}
+
+func (b *TonBackend) getVersion(ctx context.Context, bucketName, objectName string, versionID gofakes3.VersionID) (*models.File, error) {
+	fMeta, err := b.db.GetFileVersion(ctx, bucketName, objectName, storedVersionID(versionID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, gofakes3.ErrNoSuchVersion
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fMeta, nil
+}
+
+func (b *TonBackend) GetObjectVersion(bucketName, objectName string, versionID gofakes3.VersionID, rangeRequest *gofakes3.ObjectRangeRequest) (*gofakes3.Object, error) {
+	ctx := context.Background()
+
+	fMeta, err := b.getVersion(ctx, bucketName, objectName, versionID)
+	if err != nil {
+		return nil, err
+	}
+	return b.getObject(ctx, fMeta, rangeRequest, nil)
+}
+
+func (b *TonBackend) HeadObjectVersion(bucketName, objectName string, versionID gofakes3.VersionID) (*gofakes3.Object, error) {
+	ctx := context.Background()
+
+	fMeta, err := b.getVersion(ctx, bucketName, objectName, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.loadRestoreState(ctx, fMeta); err != nil {
+		return nil, err
+	}
+	return headObject(fMeta), nil
+}
+
+func (b *TonBackend) DeleteObjectVersion(bucketName, objectName string, versionID gofakes3.VersionID) (result gofakes3.ObjectDeleteResult, err error) {
+	ctx := context.Background()
+
+	fMeta, err := b.db.GetFileVersion(ctx, bucketName, objectName, storedVersionID(versionID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Удалять нечего: S3 отвечает на это успехом
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	if err := b.removeVersion(ctx, fMeta); err != nil {
+		return result, err
+	}
+
+	result.IsDeleteMarker = fMeta.IsDeleteMarker
+	result.VersionID = versionID
+	return result, nil
+}
+
+func (b *TonBackend) DeleteMultiVersions(bucketName string, objects ...gofakes3.ObjectID) (result gofakes3.MultiDeleteResult, err error) {
+	return deleteObjects(b, bucketName, objects), nil
+}
+
+// objectDeleter deletes objects and object versions, as TonBackend does.
+type objectDeleter interface {
+	DeleteObject(bucketName, objectName string) (gofakes3.ObjectDeleteResult, error)
+	DeleteObjectVersion(bucketName, objectName string, versionID gofakes3.VersionID) (gofakes3.ObjectDeleteResult, error)
+}
+
+// deleteObjects deletes objects one by one and reports the outcome of each.
+// An object without a version ID is deleted as by DeleteObject, one with a
+// version ID, the null version included, as by DeleteObjectVersion.
+func deleteObjects(d objectDeleter, bucketName string, objects []gofakes3.ObjectID) (result gofakes3.MultiDeleteResult) {
+	for _, obj := range objects {
+		var res gofakes3.ObjectDeleteResult
+		var err error
+		if obj.VersionID != "" {
+			res, err = d.DeleteObjectVersion(bucketName, obj.Key, gofakes3.VersionID(obj.VersionID))
+		} else {
+			res, err = d.DeleteObject(bucketName, obj.Key)
+		}
+
+		if err != nil {
+			result.Error = append(result.Error, deleteError(obj.Key, err))
+			continue
+		}
+
+		deleted := gofakes3.ObjectID{Key: obj.Key, VersionID: obj.VersionID}
+		if res.IsDeleteMarker && obj.VersionID == "" {
+			deleted.VersionID = string(res.VersionID)
+		}
+		result.Deleted = append(result.Deleted, deleted)
+	}
+	return result
+}
+
+// deleteError reports why key was not deleted, with the S3 error code of err
+// if it has one.
+func deleteError(key string, err error) gofakes3.ErrorResult {
+	var s3Err gofakes3.Error
+	if !errors.As(err, &s3Err) {
+		return gofakes3.ErrorResult{Key: key, Code: gofakes3.ErrInternal, Message: err.Error()}
+	}
+
+	result := gofakes3.ErrorResultFromError(s3Err)
+	result.Key = key
+	if result.Message == "" {
+		result.Message = err.Error()
+	}
+	return result
+}
+
+func (b *TonBackend) ListBucketVersions(bucketName string, prefix *gofakes3.Prefix, page *gofakes3.ListBucketVersionsPage) (*gofakes3.ListBucketVersionsResult, error) {
+	ctx := context.Background()
+
+	if prefix == nil {
+		prefix = emptyPrefix
+	}
+	if page == nil {
+		page = &gofakes3.ListBucketVersionsPage{}
+	}
+
+	exists, err := b.db.BucketExists(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, gofakes3.BucketNotFound(bucketName)
+	}
+
+	maxKeys := page.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = gofakes3.DefaultMaxBucketVersionKeys
+	}
+
+	result := gofakes3.NewListBucketVersionsResult(bucketName, prefix, page)
+
+	// Rows come after (keyMarker, idMarker); an idMarker of math.MaxInt64
+	// takes in every version of keyMarker itself
+	keyMarker, idMarker := page.KeyMarker, int64(0)
+	var lastPrefix string
+
+	if cp, ok := commonPrefix(page.KeyMarker, prefix); ok {
+		// Маркер внутри свернутого префикса: весь префикс уже был отдан
+		lastPrefix = cp
+		if next, ok := prefixSuccessor(cp); ok {
+			keyMarker, idMarker = next, math.MaxInt64
+		}
+	} else if page.HasVersionIDMarker {
+		marker, err := b.db.GetFileVersion(ctx, bucketName, page.KeyMarker, storedVersionID(page.VersionIDMarker))
+		if err != nil {
+			return nil, gofakes3.ErrorInvalidArgument("version-id-marker", string(page.VersionIDMarker), "Invalid version id specified")
+		}
+		idMarker = marker.ID
+	}
+
+	var count int64
+
+	for {
+		files, err := b.db.ListFileVersions(ctx, bucketName, prefix.Prefix, keyMarker, idMarker, listPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("DB error: %w", err)
+		}
+
+		restart := false
+		for i := range files {
+			f := &files[i]
+			keyMarker, idMarker = f.ObjectKey, f.ID
+
+			if lastPrefix != "" && strings.HasPrefix(f.ObjectKey, lastPrefix) {
+				continue
+			}
+
+			if count >= maxKeys {
+				result.IsTruncated = true
+				return result, nil
+			}
+			count++
+
+			if cp, ok := commonPrefix(f.ObjectKey, prefix); ok {
+				result.AddPrefix(cp)
+				result.NextKeyMarker = cp
+				result.NextVersionIDMarker = ""
+				lastPrefix = cp
+
+				// Перескакиваем все версии под префиксом одним запросом
+				if next, ok := prefixSuccessor(cp); ok {
+					keyMarker, idMarker = next, math.MaxInt64
+					restart = true
+					break
+				}
+				continue
+			}
+
+			if f.IsDeleteMarker {
+				result.Versions = append(result.Versions, &gofakes3.DeleteMarker{
+					Key:          f.ObjectKey,
+					VersionID:    gofakes3.VersionID(f.VersionID),
+					IsLatest:     f.IsLatest,
+					LastModified: gofakes3.NewContentTime(f.CreatedAt),
+				})
+			} else {
+				result.Versions = append(result.Versions, &gofakes3.Version{
+					Key:          f.ObjectKey,
+					VersionID:    gofakes3.VersionID(f.VersionID),
+					IsLatest:     f.IsLatest,
+					LastModified: gofakes3.NewContentTime(f.CreatedAt),
+					Size:         f.SizeBytes,
+					StorageClass: storageClass(f),
+					ETag:         fileETag(f),
+				})
+			}
+
+			result.NextKeyMarker = f.ObjectKey
+			result.NextVersionIDMarker = gofakes3.VersionID(f.VersionID)
+			if result.NextVersionIDMarker == "" {
+				result.NextVersionIDMarker = "null"
+			}
+		}
+
+		if restart {
+			continue
+		}
+		if len(files) < listPageSize {
+			break
+		}
+	}
+
+	result.NextKeyMarker = ""
+	result.NextVersionIDMarker = ""
+	return result, nil
+}
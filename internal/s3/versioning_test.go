@@ -0,0 +1,95 @@
+package s3
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+)
+
+// fakeDeleter records what deleteObjects asks it to delete.
+type fakeDeleter struct {
+	calls []string
+	fail  map[string]error
+}
+
+func (d *fakeDeleter) DeleteObject(bucketName, objectName string) (gofakes3.ObjectDeleteResult, error) {
+	d.calls = append(d.calls, "object "+objectName)
+	if err := d.fail[objectName]; err != nil {
+		return gofakes3.ObjectDeleteResult{}, err
+	}
+	return gofakes3.ObjectDeleteResult{IsDeleteMarker: true, VersionID: "marker"}, nil
+}
+
+func (d *fakeDeleter) DeleteObjectVersion(bucketName, objectName string, versionID gofakes3.VersionID) (gofakes3.ObjectDeleteResult, error) {
+	d.calls = append(d.calls, "version "+objectName+"@"+string(versionID))
+	if err := d.fail[objectName]; err != nil {
+		return gofakes3.ObjectDeleteResult{}, err
+	}
+	return gofakes3.ObjectDeleteResult{VersionID: versionID}, nil
+}
+
+func TestDeleteObjectsNullVersion(t *testing.T) {
+	d := &fakeDeleter{}
+	result := deleteObjects(d, "bucket", []gofakes3.ObjectID{
+		{Key: "a"},
+		{Key: "b", VersionID: "null"},
+		{Key: "c", VersionID: "0123abcd"},
+	})
+
+	want := []string{"object a", "version b@null", "version c@0123abcd"}
+	if len(d.calls) != len(want) {
+		t.Fatalf("got calls %q, want %q", d.calls, want)
+	}
+	for i := range want {
+		if d.calls[i] != want[i] {
+			t.Fatalf("got calls %q, want %q", d.calls, want)
+		}
+	}
+
+	if len(result.Error) != 0 {
+		t.Fatalf("got errors %v", result.Error)
+	}
+	deleted := []gofakes3.ObjectID{{Key: "a", VersionID: "marker"}, {Key: "b", VersionID: "null"}, {Key: "c", VersionID: "0123abcd"}}
+	if len(result.Deleted) != len(deleted) {
+		t.Fatalf("got deleted %v, want %v", result.Deleted, deleted)
+	}
+	for i := range deleted {
+		if result.Deleted[i].Key != deleted[i].Key || result.Deleted[i].VersionID != deleted[i].VersionID {
+			t.Fatalf("got deleted %v, want %v", result.Deleted, deleted)
+		}
+	}
+}
+
+func TestDeleteObjectsErrorCodes(t *testing.T) {
+	d := &fakeDeleter{fail: map[string]error{
+		"missing-bucket": gofakes3.BucketNotFound("bucket"),
+		"denied":         gofakes3.ErrorMessage(ErrAccessDenied, "Access Denied"),
+		"wrapped":        errors.Join(errors.New("while deleting"), gofakes3.ErrNoSuchVersion),
+		"broken":         errors.New("connection reset"),
+	}}
+	result := deleteObjects(d, "bucket", []gofakes3.ObjectID{
+		{Key: "missing-bucket"},
+		{Key: "denied", VersionID: "null"},
+		{Key: "wrapped", VersionID: "0123abcd"},
+		{Key: "broken"},
+	})
+
+	want := map[string]gofakes3.ErrorCode{
+		"missing-bucket": gofakes3.ErrNoSuchBucket,
+		"denied":         ErrAccessDenied,
+		"wrapped":        gofakes3.ErrNoSuchVersion,
+		"broken":         gofakes3.ErrInternal,
+	}
+	if len(result.Deleted) != 0 || len(result.Error) != len(want) {
+		t.Fatalf("got deleted %v and errors %v", result.Deleted, result.Error)
+	}
+	for _, e := range result.Error {
+		if e.Code != want[e.Key] {
+			t.Errorf("%s: got code %s, want %s", e.Key, e.Code, want[e.Key])
+		}
+		if e.Message == "" {
+			t.Errorf("%s: no message", e.Key)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package sigv4
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ton-storage-s3-cli/internal/checksum"
+)
+
+const maxChunkHeaderLength = 4096
+
+var errMalformedChunk = &Error{
+	Code:    "IncompleteBody",
+	Message: "The chunked payload encoding is malformed",
+	Status:  http.StatusBadRequest,
+}
+
+const checksumTrailerPrefix = "x-amz-checksum-"
+
+func errBadDigest(name string) *Error {
+	return &Error{
+		Code:    "BadDigest",
+		Message: fmt.Sprintf("The %s you specified did not match the calculated checksum.", name),
+		Status:  http.StatusBadRequest,
+	}
+}
+
+// Payload verifies a request body against the payload hash of its signature
+// while it is read. Streaming uploads are decoded so that the reader yields
+// the plain object bytes. The first verification failure is kept in Err so
+// it can be reported even if the consumer masks it.
+type Payload struct {
+	body   io.ReadCloser
+	reader io.Reader
+	err    *Error
+}
+
+// WrapPayload installs a verifying reader as r.Body. Streaming uploads are
+// rewritten to look like plain uploads: Content-Length is set to the decoded
+// length and the payload hash becomes UNSIGNED-PAYLOAD. Requests without a
+// payload to verify are left untouched and nil is returned.
+func WrapPayload(r *http.Request, c *Credentials) (*Payload, error) {
+	p := &Payload{body: r.Body}
+
+	switch c.PayloadHash {
+	case UnsignedPayload:
+		return nil, nil
+
+	case StreamingPayload, StreamingPayloadTrailer, StreamingUnsignedPayloadTrailer:
+		size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || size < 0 {
+			return nil, &Error{
+				Code:    "MissingContentLength",
+				Message: "You must provide the x-amz-decoded-content-length header.",
+				Status:  http.StatusLengthRequired,
+			}
+		}
+
+		cr := &chunkReader{
+			src:     bufio.NewReaderSize(r.Body, maxChunkHeaderLength),
+			creds:   c,
+			signed:  c.PayloadHash != StreamingUnsignedPayloadTrailer,
+			trailer: c.PayloadHash != StreamingPayload,
+			prevSig: c.Signature,
+			hash:    sha256.New(),
+			left:    size,
+		}
+		if cr.trailer {
+			if cr.sums, err = trailerChecksums(r.Header.Get("X-Amz-Trailer")); err != nil {
+				return nil, err
+			}
+		}
+		p.reader = cr
+
+		r.ContentLength = size
+		r.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		r.Header.Set("X-Amz-Content-Sha256", UnsignedPayload)
+		r.Header.Del("X-Amz-Decoded-Content-Length")
+		stripAWSChunked(r.Header)
+
+	default:
+		want, err := hex.DecodeString(c.PayloadHash)
+		if err != nil || len(want) != sha256.Size {
+			return nil, ErrContentSHA256Mismatch
+		}
+		p.reader = &hashReader{src: r.Body, hash: sha256.New(), want: want}
+	}
+
+	r.Body = p
+	return p, nil
+}
+
+func (p *Payload) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	var authErr *Error
+	if p.err == nil && errors.As(err, &authErr) {
+		p.err = authErr
+	}
+	return n, err
+}
+
+func (p *Payload) Close() error {
+	return p.body.Close()
+}
+
+// Err returns the verification failure hit while reading, if any.
+func (p *Payload) Err() *Error {
+	return p.err
+}
+
+// trailerChecksums returns a hash for every x-amz-checksum-* trailer announced
+// in x-amz-trailer, keyed by the trailer name.
+func trailerChecksums(announced string) (map[string]hash.Hash, error) {
+	sums := map[string]hash.Hash{}
+	for _, name := range strings.Split(announced, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		algo, ok := strings.CutPrefix(name, checksumTrailerPrefix)
+		if !ok {
+			continue
+		}
+		h, ok := checksum.New(strings.ToUpper(algo))
+		if !ok {
+			return nil, &Error{
+				Code:    "InvalidRequest",
+				Message: "Value for x-amz-trailer header is invalid.",
+				Status:  http.StatusBadRequest,
+			}
+		}
+		sums[name] = h
+	}
+	return sums, nil
+}
+
+func stripAWSChunked(h http.Header) {
+	var kept []string
+	for _, enc := range strings.Split(h.Get("Content-Encoding"), ",") {
+		if enc = strings.TrimSpace(enc); enc != "" && enc != "aws-chunked" {
+			kept = append(kept, enc)
+		}
+	}
+	if len(kept) == 0 {
+		h.Del("Content-Encoding")
+	} else {
+		h.Set("Content-Encoding", strings.Join(kept, ","))
+	}
+}
+
+// hashReader checks a body against the hex SHA-256 sent in x-amz-content-sha256.
+type hashReader struct {
+	src  io.Reader
+	hash hash.Hash
+	want []byte
+}
+
+func (h *hashReader) Read(b []byte) (int, error) {
+	n, err := h.src.Read(b)
+	h.hash.Write(b[:n])
+	if err == io.EOF && !bytes.Equal(h.hash.Sum(nil), h.want) {
+		return n, ErrContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// chunkReader decodes an aws-chunked body:
+//
+//	<hex-size>[;chunk-signature=<sig>]\r\n<data>\r\n ... 0[;chunk-signature=<sig>]\r\n[<trailers>]\r\n
+//
+// Each chunk signature chains on the previous one, starting from the request
+// signature. Trailing checksum headers are covered by the trailer signature,
+// and the x-amz-checksum-* ones announced in x-amz-trailer are checked against
+// the decoded data once the body ends.
+type chunkReader struct {
+	src     *bufio.Reader
+	creds   *Credentials
+	signed  bool
+	trailer bool
+
+	prevSig   string
+	chunkSig  string
+	hash      hash.Hash
+	remaining int64 // unread bytes of the current chunk
+	left      int64 // bytes not yet announced by a chunk header
+	done      bool
+
+	sums     map[string]hash.Hash // checksums of the decoded data, by trailer name
+	trailers map[string]string    // trailing headers, by lower case name
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	for !c.done && c.remaining == 0 {
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.src.Read(b)
+	c.hash.Write(b[:n])
+	for _, h := range c.sums {
+		h.Write(b[:n])
+	}
+	c.remaining -= int64(n)
+
+	if err == io.EOF {
+		return n, ErrIncompleteBody
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if c.remaining == 0 {
+		if err := c.verifyChunk(); err != nil {
+			return n, err
+		}
+		line, err := c.readLine()
+		if err != nil {
+			return n, err
+		}
+		if line != "" {
+			return n, errMalformedChunk
+		}
+	}
+	return n, nil
+}
+
+func (c *chunkReader) readLine() (string, error) {
+	line, err := c.src.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errMalformedChunk
+	}
+	if err == io.EOF {
+		return "", ErrIncompleteBody
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (c *chunkReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > c.left {
+		return errMalformedChunk
+	}
+
+	if c.signed {
+		sig, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok {
+			return ErrSignatureDoesNotMatch
+		}
+		c.chunkSig = sig
+	}
+
+	c.hash.Reset()
+	c.remaining = size
+	c.left -= size
+
+	if size > 0 {
+		return nil
+	}
+
+	if c.left != 0 {
+		return ErrIncompleteBody
+	}
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	if err := c.readTrailer(); err != nil {
+		return err
+	}
+	if err := c.verifyChecksums(); err != nil {
+		return err
+	}
+	c.done = true
+	return nil
+}
+
+func (c *chunkReader) verifyChunk() error {
+	if !c.signed {
+		return nil
+	}
+
+	stringToSign := strings.Join([]string{
+		Algorithm + "-PAYLOAD",
+		c.creds.Time.UTC().Format(TimeFormat),
+		c.creds.Scope.String(),
+		c.prevSig,
+		EmptySHA256,
+		hex.EncodeToString(c.hash.Sum(nil)),
+	}, "\n")
+	return c.checkSignature(stringToSign, c.chunkSig)
+}
+
+// readTrailer consumes everything after the final chunk up to the closing
+// empty line into c.trailers, verifying the trailer signature of signed
+// uploads.
+func (c *chunkReader) readTrailer() error {
+	var headers strings.Builder
+	var sig string
+	c.trailers = map[string]string{}
+
+	for {
+		line, err := c.readLine()
+		if err == ErrIncompleteBody && c.trailer {
+			break // some clients omit the closing CRLF after the trailers
+		}
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		if !c.trailer {
+			return errMalformedChunk
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return errMalformedChunk
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+
+		if name == "x-amz-trailer-signature" {
+			sig = value
+			continue
+		}
+		headers.WriteString(name + ":" + value + "\n")
+		c.trailers[name] = value
+	}
+
+	if !c.signed || !c.trailer {
+		return nil
+	}
+
+	stringToSign := strings.Join([]string{
+		Algorithm + "-TRAILER",
+		c.creds.Time.UTC().Format(TimeFormat),
+		c.creds.Scope.String(),
+		c.prevSig,
+		hashHex([]byte(headers.String())),
+	}, "\n")
+	return c.checkSignature(stringToSign, sig)
+}
+
+// verifyChecksums compares the announced checksum trailers with the digests
+// of the decoded data.
+func (c *chunkReader) verifyChecksums() error {
+	for name, h := range c.sums {
+		want, ok := c.trailers[name]
+		if !ok {
+			return errMalformedChunk
+		}
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != want {
+			return errBadDigest(name)
+		}
+	}
+	return nil
+}
+
+func (c *chunkReader) checkSignature(stringToSign, sig string) error {
+	want := Sign(c.creds.signingKey, stringToSign)
+	if !hmac.Equal([]byte(want), []byte(sig)) {
+		return ErrSignatureDoesNotMatch
+	}
+	c.prevSig = sig
+	return nil
+}
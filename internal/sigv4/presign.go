@@ -0,0 +1,66 @@
+package sigv4
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultRegion is used in credential scopes when none is configured; the
+	// gateway accepts signatures for any region.
+	DefaultRegion = "us-east-1"
+
+	// MaxPresignExpiry is the longest validity S3 allows for a presigned URL.
+	MaxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// PresignOptions describe a presigned URL.
+type PresignOptions struct {
+	Method    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	Expires   time.Duration
+	Now       time.Time
+}
+
+// Presign returns u with query-string authentication added. The URL is bound
+// to its host and method only, so the payload of a presigned PUT is unsigned.
+func Presign(u *url.URL, opts PresignOptions) (*url.URL, error) {
+	if opts.Expires < time.Second || opts.Expires > MaxPresignExpiry {
+		return nil, fmt.Errorf("expiry must be between 1s and %s", MaxPresignExpiry)
+	}
+	if opts.Region == "" {
+		opts.Region = DefaultRegion
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+
+	t := opts.Now.UTC()
+	scope := Scope{Date: t.Format(shortFormat), Region: opts.Region, Service: Service}
+
+	signed := *u
+	q := signed.Query()
+	q.Set("X-Amz-Algorithm", Algorithm)
+	q.Set("X-Amz-Credential", opts.AccessKey+"/"+scope.String())
+	q.Set("X-Amz-Date", t.Format(TimeFormat))
+	q.Set("X-Amz-Expires", strconv.FormatInt(int64(opts.Expires/time.Second), 10))
+	q.Set("X-Amz-SignedHeaders", "host")
+	q.Del("X-Amz-Signature")
+	signed.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(opts.Method, signed.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	key := SigningKey(opts.SecretKey, scope)
+	q.Set("X-Amz-Signature", Sign(key, StringToSign(t, scope, CanonicalRequest(req, []string{"host"}, UnsignedPayload))))
+	signed.RawQuery = q.Encode()
+
+	return &signed, nil
+}
@@ -0,0 +1,239 @@
+// Package sigv4 implements AWS Signature Version 4 as used by the S3 API:
+// request canonicalisation, header and query-string verification and the
+// chunk signatures of streaming uploads.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Algorithm   = "AWS4-HMAC-SHA256"
+	Service     = "s3"
+	scopeSuffix = "aws4_request"
+
+	TimeFormat  = "20060102T150405Z"
+	shortFormat = "20060102"
+
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	StreamingPayload                = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingPayloadTrailer         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	StreamingUnsignedPayloadTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// MaxClockSkew is how far the request date may drift from the server
+	// clock for header-signed requests.
+	MaxClockSkew = 15 * time.Minute
+)
+
+// EmptySHA256 is the hex SHA-256 of an empty payload.
+var EmptySHA256 = hashHex(nil)
+
+// Error is an authentication failure carrying the S3 error code and HTTP
+// status it must be reported with.
+type Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func errAccessDenied(msg string) *Error {
+	return &Error{Code: "AccessDenied", Message: msg, Status: http.StatusForbidden}
+}
+
+func errMalformed(msg string) *Error {
+	return &Error{Code: "AuthorizationHeaderMalformed", Message: msg, Status: http.StatusBadRequest}
+}
+
+func errQueryParameters(msg string) *Error {
+	return &Error{Code: "AuthorizationQueryParametersError", Message: msg, Status: http.StatusBadRequest}
+}
+
+var (
+	ErrAccessDenied = errAccessDenied("Access Denied")
+
+	ErrUnsupportedAuth = &Error{
+		Code:    "InvalidRequest",
+		Message: "The authorization mechanism you have provided is not supported. Please use AWS4-HMAC-SHA256.",
+		Status:  http.StatusBadRequest,
+	}
+
+	ErrInvalidAccessKeyID = &Error{
+		Code:    "InvalidAccessKeyId",
+		Message: "The AWS Access Key Id you provided does not exist in our records.",
+		Status:  http.StatusForbidden,
+	}
+
+	ErrSignatureDoesNotMatch = &Error{
+		Code:    "SignatureDoesNotMatch",
+		Message: "The request signature we calculated does not match the signature you provided. Check your key and signing method.",
+		Status:  http.StatusForbidden,
+	}
+
+	ErrRequestTimeTooSkewed = &Error{
+		Code:    "RequestTimeTooSkewed",
+		Message: "The difference between the request time and the current time is too large.",
+		Status:  http.StatusForbidden,
+	}
+
+	ErrExpired = errAccessDenied("Request has expired")
+
+	ErrContentSHA256Mismatch = &Error{
+		Code:    "XAmzContentSHA256Mismatch",
+		Message: "The provided 'x-amz-content-sha256' header does not match what was computed.",
+		Status:  http.StatusBadRequest,
+	}
+
+	ErrIncompleteBody = &Error{
+		Code:    "IncompleteBody",
+		Message: "The request body terminated unexpectedly",
+		Status:  http.StatusBadRequest,
+	}
+)
+
+// Scope is the credential scope of a signature: <date>/<region>/<service>/aws4_request.
+type Scope struct {
+	Date    string
+	Region  string
+	Service string
+}
+
+func (s Scope) String() string {
+	return s.Date + "/" + s.Region + "/" + s.Service + "/" + scopeSuffix
+}
+
+// SigningKey derives the HMAC key for a secret and credential scope.
+func SigningKey(secret string, scope Scope) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), scope.Date)
+	k = hmacSHA256(k, scope.Region)
+	k = hmacSHA256(k, scope.Service)
+	return hmacSHA256(k, scopeSuffix)
+}
+
+// StringToSign builds the string signed for a request.
+func StringToSign(t time.Time, scope Scope, canonicalRequest string) string {
+	return strings.Join([]string{
+		Algorithm,
+		t.UTC().Format(TimeFormat),
+		scope.String(),
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+}
+
+// Sign returns the hex signature of stringToSign.
+func Sign(key []byte, stringToSign string) string {
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// CanonicalRequest builds the canonical form of r covering signedHeaders. The
+// X-Amz-Signature query parameter is never part of the canonical query.
+func CanonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, h := range signedHeaders {
+		headers.WriteString(h)
+		headers.WriteByte(':')
+		headers.WriteString(headerValue(r, h))
+		headers.WriteByte('\n')
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		EncodePath(r.URL.Path),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func headerValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if _, ok := r.Header["Content-Length"]; !ok && r.ContentLength >= 0 {
+			return strconv.FormatInt(r.ContentLength, 10)
+		}
+	}
+
+	var values []string
+	for _, v := range r.Header.Values(name) {
+		values = append(values, strings.Join(strings.Fields(v), " "))
+	}
+	return strings.Join(values, ",")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// EncodePath URI-encodes an object path the way S3 signers do: every byte
+// except unreserved characters and '/' is percent-encoded.
+func EncodePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return uriEncode(path, false)
+}
+
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
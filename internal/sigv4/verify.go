@@ -0,0 +1,191 @@
+package sigv4
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecretLookup returns the secret key of an access key. Unknown keys must be
+// reported as ErrInvalidAccessKeyID.
+type SecretLookup func(accessKey string) (string, error)
+
+// Credentials describe a request whose signature has been verified.
+type Credentials struct {
+	AccessKey   string
+	Scope       Scope
+	Time        time.Time
+	Signature   string
+	PayloadHash string
+
+	signingKey []byte
+}
+
+// Verify checks the SigV4 signature of r, sent either in the Authorization
+// header or in the query string. Failures are returned as *Error; lookup
+// errors other than ErrInvalidAccessKeyID are passed through unchanged.
+func Verify(r *http.Request, now time.Time, lookup SecretLookup) (*Credentials, error) {
+	auth := r.Header.Get("Authorization")
+	switch {
+	case auth != "":
+		return verifyHeader(r, auth, now, lookup)
+	case r.URL.Query().Has("X-Amz-Algorithm"):
+		return verifyQuery(r, now, lookup)
+	case r.URL.Query().Has("AWSAccessKeyId"):
+		return nil, ErrUnsupportedAuth
+	default:
+		return nil, ErrAccessDenied
+	}
+}
+
+func verifyHeader(r *http.Request, auth string, now time.Time, lookup SecretLookup) (*Credentials, error) {
+	params, ok := strings.CutPrefix(auth, Algorithm+" ")
+	if !ok {
+		return nil, ErrUnsupportedAuth
+	}
+
+	fields := map[string]string{}
+	for _, p := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		fields[k] = v
+	}
+	if fields["Credential"] == "" || fields["SignedHeaders"] == "" || fields["Signature"] == "" {
+		return nil, errMalformed("The authorization header is malformed; it must contain Credential, SignedHeaders and Signature.")
+	}
+
+	accessKey, scope, err := parseCredential(fields["Credential"])
+	if err != nil {
+		return nil, err
+	}
+
+	var t time.Time
+	if v := r.Header.Get("X-Amz-Date"); v != "" {
+		t, err = time.Parse(TimeFormat, v)
+	} else if v := r.Header.Get("Date"); v != "" {
+		t, err = http.ParseTime(v)
+	} else {
+		return nil, errAccessDenied("AWS authentication requires a valid Date or x-amz-date header")
+	}
+	if err != nil {
+		return nil, errAccessDenied("AWS authentication requires a valid Date or x-amz-date header")
+	}
+	if scope.Date != t.UTC().Format(shortFormat) {
+		return nil, errMalformed("The authorization header is malformed; the credential date does not match the request date.")
+	}
+	if d := now.Sub(t); d > MaxClockSkew || d < -MaxClockSkew {
+		return nil, ErrRequestTimeTooSkewed
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return nil, &Error{
+			Code:    "InvalidRequest",
+			Message: "Missing required header for this request: x-amz-content-sha256",
+			Status:  http.StatusBadRequest,
+		}
+	}
+
+	return verifySignature(r, &Credentials{
+		AccessKey:   accessKey,
+		Scope:       scope,
+		Time:        t,
+		Signature:   fields["Signature"],
+		PayloadHash: payloadHash,
+	}, strings.Split(fields["SignedHeaders"], ";"), lookup)
+}
+
+func verifyQuery(r *http.Request, now time.Time, lookup SecretLookup) (*Credentials, error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != Algorithm {
+		return nil, ErrUnsupportedAuth
+	}
+
+	for _, p := range []string{"X-Amz-Credential", "X-Amz-Date", "X-Amz-Expires", "X-Amz-SignedHeaders", "X-Amz-Signature"} {
+		if q.Get(p) == "" {
+			return nil, errQueryParameters("Query-string authentication version 4 requires the X-Amz-Algorithm, X-Amz-Credential, X-Amz-Signature, X-Amz-Date, X-Amz-SignedHeaders, and X-Amz-Expires parameters.")
+		}
+	}
+
+	accessKey, scope, err := parseCredential(q.Get("X-Amz-Credential"))
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := time.Parse(TimeFormat, q.Get("X-Amz-Date"))
+	if err != nil || scope.Date != t.UTC().Format(shortFormat) {
+		return nil, errAccessDenied("X-Amz-Date must be in the ISO8601 Long Format and match the credential date")
+	}
+
+	expires, err := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+	if err != nil {
+		return nil, errQueryParameters("X-Amz-Expires should be a number")
+	}
+	if expires <= 0 {
+		return nil, errQueryParameters("X-Amz-Expires must be non-negative")
+	}
+	if expires > int64(MaxPresignExpiry/time.Second) {
+		return nil, errQueryParameters("X-Amz-Expires must be less than a week (in seconds) that is 604800")
+	}
+	if t.Sub(now) > MaxClockSkew {
+		return nil, errAccessDenied("Request is not valid yet")
+	}
+	if now.After(t.Add(time.Duration(expires) * time.Second)) {
+		return nil, ErrExpired
+	}
+
+	payloadHash := q.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = UnsignedPayload
+	}
+
+	return verifySignature(r, &Credentials{
+		AccessKey:   accessKey,
+		Scope:       scope,
+		Time:        t,
+		Signature:   q.Get("X-Amz-Signature"),
+		PayloadHash: payloadHash,
+	}, strings.Split(q.Get("X-Amz-SignedHeaders"), ";"), lookup)
+}
+
+func verifySignature(r *http.Request, c *Credentials, signedHeaders []string, lookup SecretLookup) (*Credentials, error) {
+	signed := make(map[string]bool, len(signedHeaders))
+	for _, h := range signedHeaders {
+		signed[h] = true
+	}
+	if !signed["host"] {
+		return nil, errAccessDenied("The host header must be signed")
+	}
+	for k := range r.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") && !signed[k] {
+			return nil, errAccessDenied("There were headers present in the request which were not signed: " + k)
+		}
+	}
+
+	secret, err := lookup(c.AccessKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c.signingKey = SigningKey(secret, c.Scope)
+	stringToSign := StringToSign(c.Time, c.Scope, CanonicalRequest(r, signedHeaders, c.PayloadHash))
+
+	if !hmac.Equal([]byte(Sign(c.signingKey, stringToSign)), []byte(c.Signature)) {
+		return nil, ErrSignatureDoesNotMatch
+	}
+	return c, nil
+}
+
+// parseCredential splits <access-key>/<date>/<region>/s3/aws4_request.
+func parseCredential(s string) (string, Scope, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 5 || parts[0] == "" || len(parts[1]) != len(shortFormat) || parts[4] != scopeSuffix {
+		return "", Scope{}, errMalformed("The credential is malformed; expecting \"<YOUR-AKID>/YYYYMMDD/REGION/SERVICE/aws4_request\".")
+	}
+	if parts[3] != Service {
+		return "", Scope{}, errMalformed("The credential is malformed; the service must be \"s3\".")
+	}
+	return parts[0], Scope{Date: parts[1], Region: parts[2], Service: parts[3]}, nil
+}
@@ -0,0 +1,203 @@
+// Package sse implements the format objects are encrypted at rest with.
+//
+// Every object has a random data key of its own. Its data is split into
+// chunks of ChunkSize bytes, each sealed with AES-256-GCM under the data key
+// and the chunk index as nonce, so that any range is decrypted and
+// authenticated from the chunks covering it alone. The last chunk is sealed
+// with a flag as additional data, which makes a truncated object fail to
+// decrypt. An empty object is one empty chunk.
+//
+// The data key is stored wrapped (AES-256-GCM) by a key-encryption key: the
+// gateway's master key for SSE-S3, the client's key for SSE-C.
+package sse
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// KeySize is the size of data and key-encryption keys.
+	KeySize = 32
+	// ChunkSize is how many bytes of plaintext one chunk holds.
+	ChunkSize = 64 << 10
+	// Overhead is how many bytes sealing adds to a chunk.
+	Overhead = 16
+)
+
+var ErrKeySize = fmt.Errorf("encryption key must be %d bytes", KeySize)
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrKeySize
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewDataKey returns a random data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapKey encrypts a data key with kek for storage.
+func WrapKey(kek, key []byte) (string, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, key, nil)), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey. It fails if kek is not
+// the key it was wrapped with.
+func UnwrapKey(kek []byte, wrapped string) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, errors.New("malformed wrapped key")
+	}
+	return aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+}
+
+func chunks(size int64) int64 {
+	return max(1, (size+ChunkSize-1)/ChunkSize)
+}
+
+// SealedSize returns the size of an object of size bytes once encrypted.
+func SealedSize(size int64) int64 {
+	return size + chunks(size)*Overhead
+}
+
+// SealedRange returns the range of an encrypted object of size bytes holding
+// the chunks that cover the plaintext range start+length.
+func SealedRange(size, start, length int64) (int64, int64) {
+	if length == 0 {
+		return 0, 0
+	}
+	first, last := start/ChunkSize, (start+length-1)/ChunkSize
+	from := first * (ChunkSize + Overhead)
+	to := min(SealedSize(size), (last+1)*(ChunkSize+Overhead))
+	return from, to - from
+}
+
+func nonce(index int64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], uint64(index))
+	return n
+}
+
+func additionalData(index, size int64) []byte {
+	if index == chunks(size)-1 {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Encrypt reads an object of size bytes from src and writes it encrypted
+// with key to dst.
+func Encrypt(dst io.Writer, src io.Reader, key []byte, size int64) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, ChunkSize, ChunkSize+Overhead)
+	for i := int64(0); i < chunks(size); i++ {
+		n := min(ChunkSize, size-i*ChunkSize)
+		if _, err := io.ReadFull(src, buf[:n]); err != nil {
+			return err
+		}
+		if _, err := dst.Write(aead.Seal(buf[:0], nonce(i), buf[:n], additionalData(i, size))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewReader returns the plaintext range start+length of an object of size
+// bytes encrypted with key. src reads the object from the start of
+// SealedRange on.
+func NewReader(src io.Reader, key []byte, size, start, length int64) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		src:   src,
+		aead:  aead,
+		size:  size,
+		chunk: start / ChunkSize,
+		skip:  start % ChunkSize,
+		left:  length,
+		buf:   make([]byte, 0, ChunkSize+Overhead),
+	}, nil
+}
+
+type reader struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	size  int64
+	chunk int64 // index of the next chunk to read
+	skip  int64 // bytes of the next chunk before the range
+	left  int64 // bytes of the range not returned yet
+
+	buf   []byte
+	plain []byte // decrypted bytes not returned yet
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if len(r.plain) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain[:min(int64(len(r.plain)), r.left)])
+	r.plain = r.plain[n:]
+	r.left -= int64(n)
+	return n, nil
+}
+
+func (r *reader) next() error {
+	n := min(ChunkSize, r.size-r.chunk*ChunkSize) + Overhead
+	sealed := r.buf[:n]
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	plain, err := r.aead.Open(sealed[:0], nonce(r.chunk), sealed, additionalData(r.chunk, r.size))
+	if err != nil {
+		return fmt.Errorf("chunk %d: %w", r.chunk, err)
+	}
+	r.plain = plain[r.skip:]
+	r.chunk++
+	r.skip = 0
+	return nil
+}
@@ -0,0 +1,161 @@
+package sse
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func seal(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	if err := Encrypt(&sealed, bytes.NewReader(plain), key, int64(len(plain))); err != nil {
+		t.Fatal(err)
+	}
+	if int64(sealed.Len()) != SealedSize(int64(len(plain))) {
+		t.Fatalf("sealed %d bytes into %d, want %d", len(plain), sealed.Len(), SealedSize(int64(len(plain))))
+	}
+	return sealed.Bytes()
+}
+
+// open decrypts the plaintext range start+length of an object of size bytes
+// from sealed, reading only the part SealedRange points at, or what is there
+// of it.
+func open(key, sealed []byte, size, start, length int64) ([]byte, error) {
+	from, n := SealedRange(size, start, length)
+	to := min(from+n, int64(len(sealed)))
+	r, err := NewReader(bytes.NewReader(sealed[from:to]), key, size, start, length)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	key := newKey(t)
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17} {
+		plain := make([]byte, size)
+		rng.Read(plain)
+		sealed := seal(t, key, plain)
+
+		got, err := open(key, sealed, int64(size), 0, int64(size))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: decrypted data differs", size)
+		}
+	}
+}
+
+func TestRangeReads(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	key := newKey(t)
+
+	const size = 3*ChunkSize + 100
+	plain := make([]byte, size)
+	rng.Read(plain)
+	sealed := seal(t, key, plain)
+
+	ranges := [][2]int64{
+		{0, 1},
+		{10, 20},                          // inside the first chunk
+		{ChunkSize - 5, 10},               // across a chunk boundary
+		{ChunkSize + 1, ChunkSize},        // from the middle of a chunk to the middle of the next
+		{ChunkSize / 2, 2 * ChunkSize},    // across three chunks
+		{2*ChunkSize + 7, ChunkSize + 93}, // up to the end
+		{size - 1, 1},
+		{5, 0},
+	}
+	for _, rg := range ranges {
+		start, length := rg[0], rg[1]
+		got, err := open(key, sealed, size, start, length)
+		if err != nil {
+			t.Fatalf("range %d+%d: %v", start, length, err)
+		}
+		if !bytes.Equal(got, plain[start:start+length]) {
+			t.Fatalf("range %d+%d: decrypted data differs", start, length)
+		}
+	}
+}
+
+func TestTamperedChunks(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	key := newKey(t)
+
+	const size = 3 * ChunkSize
+	plain := make([]byte, size)
+	rng.Read(plain)
+	sealed := seal(t, key, plain)
+	chunk := ChunkSize + Overhead
+
+	// Cut inside the last chunk
+	if _, err := open(key, sealed[:len(sealed)-1], size, 0, size); err == nil {
+		t.Error("truncated chunk decrypted")
+	}
+
+	// Whole chunks cut off and the size shrunk to match: the last chunk left
+	// was not sealed as the last one
+	if _, err := open(key, sealed[:2*chunk], 2*ChunkSize, 0, 2*ChunkSize); err == nil {
+		t.Error("object truncated at a chunk boundary decrypted")
+	}
+
+	// First two chunks swapped
+	swapped := append([]byte(nil), sealed...)
+	copy(swapped[:chunk], sealed[chunk:2*chunk])
+	copy(swapped[chunk:2*chunk], sealed[:chunk])
+	if _, err := open(key, swapped, size, 0, size); err == nil {
+		t.Error("reordered chunks decrypted")
+	}
+
+	// A flipped bit
+	flipped := append([]byte(nil), sealed...)
+	flipped[chunk+3] ^= 1
+	if _, err := open(key, flipped, size, ChunkSize, 10); err == nil {
+		t.Error("modified chunk decrypted")
+	}
+
+	// Another key
+	if _, err := open(newKey(t), sealed, size, 0, size); err == nil {
+		t.Error("decrypted with a wrong key")
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	kek, key := newKey(t), newKey(t)
+
+	wrapped, err := WrapKey(kek, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := UnwrapKey(kek, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Fatal("unwrapped key differs")
+	}
+
+	if _, err := UnwrapKey(newKey(t), wrapped); err == nil {
+		t.Error("unwrapped with a wrong key")
+	}
+	if _, err := UnwrapKey(kek, "not base64!"); err == nil {
+		t.Error("unwrapped a malformed key")
+	}
+	if _, err := UnwrapKey(kek[:16], wrapped); err != ErrKeySize {
+		t.Errorf("got %v for a short key, want ErrKeySize", err)
+	}
+}
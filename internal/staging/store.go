@@ -0,0 +1,178 @@
+package staging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// ObjectsDirName holds the local copies of object versions.
+	ObjectsDirName = "objects"
+
+	// MultipartDirName holds parts of in-flight multipart uploads until the
+	// upload is completed or aborted.
+	MultipartDirName = ".multipart"
+
+	// PackingDirName holds small objects until the packer puts them into a
+	// pack, and PacksDirName the packs: directory bags of many objects.
+	PackingDirName = ".packing"
+	PacksDirName   = "packs"
+
+	tmpDirName = ".tmp"
+
+	// MaxKeyLength is the S3 limit on object key size in bytes.
+	MaxKeyLength = 1024
+
+	nullVersionDir = "null"
+	defaultName    = "object"
+)
+
+var ErrInvalidKey = errors.New("invalid object key")
+
+// Store lays out everything the gateway keeps under DOWNLOADS_PATH. Each object
+// version gets its own directory derived from the bucket name and a hash of
+// the key, so keys can neither collide on disk nor escape the root:
+//
+//	objects/<bucket>/<sha256(key)[:2]>/<sha256(key)>/<version or "null">/<file name>
+//
+// Large objects are split next to it into stripes <file name>.00000 and so on.
+//
+// Small objects are staged flat under .packing and later moved into packs:
+//
+//	packs/<pack id>/<object version id>
+type Store struct {
+	root string
+}
+
+func NewStore(root string) *Store {
+	return &Store{root: filepath.Clean(root)}
+}
+
+func (s *Store) Root() string {
+	return s.root
+}
+
+// ValidateKey rejects keys that cannot be stored: empty, too long, not UTF-8,
+// containing NUL or "."/".." path segments.
+func ValidateKey(key string) error {
+	if key == "" || len(key) > MaxKeyLength {
+		return fmt.Errorf("%w: length must be between 1 and %d bytes", ErrInvalidKey, MaxKeyLength)
+	}
+	if !utf8.ValidString(key) || strings.ContainsRune(key, 0) {
+		return fmt.Errorf("%w: must be valid UTF-8 without NUL", ErrInvalidKey)
+	}
+	for _, seg := range strings.FieldsFunc(key, isSeparator) {
+		if seg == "." || seg == ".." {
+			return fmt.Errorf("%w: %q path segments are not allowed", ErrInvalidKey, seg)
+		}
+	}
+	return nil
+}
+
+func validateName(kind, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("invalid %s name %q", kind, name)
+	}
+	return nil
+}
+
+func isSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// FileName is the name of the object's file inside its bag: the last segment
+// of the key.
+func FileName(key string) string {
+	segs := strings.FieldsFunc(key, isSeparator)
+	if len(segs) == 0 {
+		return defaultName
+	}
+	name := path.Base(segs[len(segs)-1])
+	if validateName("file", name) != nil {
+		return defaultName
+	}
+	return name
+}
+
+// ObjectDir is the directory holding the local copy of one object version.
+func (s *Store) ObjectDir(bucket, key, versionID string) (string, error) {
+	if err := validateName("bucket", bucket); err != nil {
+		return "", err
+	}
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+
+	versionDir := nullVersionDir
+	if versionID != "" {
+		if err := validateName("version", versionID); err != nil {
+			return "", err
+		}
+		versionDir = versionID
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	keyHash := hex.EncodeToString(sum[:])
+
+	return filepath.Join(s.root, ObjectsDirName, bucket, keyHash[:2], keyHash, versionDir), nil
+}
+
+// ObjectPath is the file a bag is created from for one object version.
+func (s *Store) ObjectPath(bucket, key, versionID string) (string, error) {
+	dir, err := s.ObjectDir(bucket, key, versionID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, FileName(key)), nil
+}
+
+// PruneObject removes the directory of an object version once its bag has
+// dropped its files. Data is never removed here: with deduplication the
+// directory may hold a bag that other versions still point at.
+func (s *Store) PruneObject(bucket, key, versionID string) error {
+	dir, err := s.ObjectDir(bucket, key, versionID)
+	if err != nil {
+		return err
+	}
+	// Каталоги удаляются, только если они пусты
+	os.Remove(dir)
+	os.Remove(filepath.Dir(dir))
+	return nil
+}
+
+// CreateTemp creates a file to stream an upload into before it is moved to
+// its final place with os.Rename.
+func (s *Store) CreateTemp() (*os.File, error) {
+	dir := filepath.Join(s.root, tmpDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, "upload-*")
+}
+
+func (s *Store) MultipartDir(uploadID string) string {
+	return filepath.Join(s.root, MultipartDirName, uploadID)
+}
+
+// PackingPath is the file a small object waits in until it is packed.
+func (s *Store) PackingPath(name string) (string, error) {
+	if err := validateName("packing", name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, PackingDirName, name), nil
+}
+
+// PackDir is the directory a pack is built in and seeded from.
+func (s *Store) PackDir(packID string) (string, error) {
+	if err := validateName("pack", packID); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, PacksDirName, packID), nil
+}
@@ -0,0 +1,143 @@
+package ton
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/ton/wallet"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+	"github.com/xssnick/tonutils-storage-provider/pkg/contract"
+)
+
+// ErrNotDeployed is returned by FetchContractState for a contract that was
+// never deployed or is gone.
+var ErrNotDeployed = contract.ErrNotDeployed
+
+// ContractState is what a storage contract holds on-chain and what its
+// providers earn from it.
+type ContractState struct {
+	BalanceNano int64 // coins on the contract
+	AccruedNano int64 // earned by the providers since their last proofs, not paid out yet
+	PerDayNano  int64 // earned by all providers per day
+	Providers   []ContractProvider
+}
+
+// ContractProvider is a provider a storage contract pays.
+type ContractProvider struct {
+	Key           string    `json:"key"`              // hex
+	RatePerMBNano int64     `json:"rate_per_mb_nano"` // per MB per day
+	PerDayNano    int64     `json:"per_day_nano"`     // for the whole bag
+	LastProofAt   time.Time `json:"last_proof_at"`
+}
+
+// Runway returns how long the balance left after paying what the providers
+// accrued lasts at the current rates; ok is false if no provider is paid.
+func (st *ContractState) Runway() (runway time.Duration, ok bool) {
+	if st.PerDayNano <= 0 {
+		return 0, false
+	}
+	left := max(st.BalanceNano-st.AccruedNano, 0)
+	seconds := new(big.Int).Mul(big.NewInt(left), big.NewInt(int64(24*time.Hour/time.Second)))
+	seconds.Quo(seconds, big.NewInt(st.PerDayNano))
+	return secondsDuration(seconds), true
+}
+
+// maxSeconds is the longest time.Duration in whole seconds.
+const maxSeconds = math.MaxInt64 / int64(time.Second)
+
+// secondsDuration converts a number of seconds to a time.Duration, clamped
+// to the longest one: a balance may well last longer than 292 years.
+func secondsDuration(seconds *big.Int) time.Duration {
+	if seconds.Cmp(big.NewInt(maxSeconds)) > 0 {
+		return time.Duration(maxSeconds) * time.Second
+	}
+	return time.Duration(seconds.Int64()) * time.Second
+}
+
+// FetchContractState reads the balance and the providers of a storage
+// contract by its address. The bag need not be on the node.
+func (s *Service) FetchContractState(ctx context.Context, contractAddr string) (*ContractState, error) {
+	addr, err := address.ParseAddr(contractAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid contract address: %w", err)
+	}
+
+	master, err := s.api.CurrentMasterchainInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch master block: %w", err)
+	}
+
+	providers, balance, err := contract.GetProvidersV1(ctx, s.api, master, addr)
+	if err != nil {
+		return nil, err
+	}
+	info, err := contract.GetStorageInfoV1(ctx, s.api, master, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	st := &ContractState{BalanceNano: balance.Nano().Int64()}
+	for _, p := range providers {
+		perDay, accrued := providerEarnings(p, info.Size, now)
+
+		st.PerDayNano += perDay.Int64()
+		st.AccruedNano += accrued.Int64()
+		st.Providers = append(st.Providers, ContractProvider{
+			Key:           hex.EncodeToString(p.Key),
+			RatePerMBNano: p.RatePerMB.Nano().Int64(),
+			PerDayNano:    perDay.Int64(),
+			LastProofAt:   p.LastProofAt,
+		})
+	}
+	return st, nil
+}
+
+// providerEarnings returns what a provider of a contract for a bag of size
+// bytes earns per day, and what it earned since its last proof, not paid yet.
+func providerEarnings(p contract.ProviderDataV1, size uint64, now time.Time) (perDay, accrued *big.Int) {
+	const mb = 1 << 20
+
+	perDay = new(big.Int).Mul(p.RatePerMB.Nano(), new(big.Int).SetUint64(size))
+	perDay.Quo(perDay, big.NewInt(mb))
+
+	// A proof is paid for at most MaxSpan seconds of storage.
+	unpaid := min(now.Sub(p.LastProofAt), time.Duration(p.MaxSpan)*time.Second)
+	accrued = new(big.Int).Mul(perDay, big.NewInt(int64(max(unpaid, 0)/time.Second)))
+	accrued.Quo(accrued, big.NewInt(int64(24*time.Hour/time.Second)))
+	return perDay, accrued
+}
+
+// TopUpContract sends amount to a storage contract. The message has no body,
+// which the contract takes as a top-up; it bounces back if the contract is
+// gone.
+func (s *Service) TopUpContract(ctx context.Context, contractAddr string, amount tlb.Coins) (string, error) {
+	addr, err := address.ParseAddr(contractAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid contract address: %w", err)
+	}
+
+	msg := &wallet.Message{
+		Mode: 1,
+		InternalMessage: &tlb.InternalMessage{
+			IHRDisabled: true,
+			Bounce:      true,
+			DstAddr:     addr,
+			Amount:      amount,
+			Body:        cell.BeginCell().EndCell(),
+		},
+	}
+
+	tx, _, err := s.wallet.SendManyWaitTransaction(ctx, []*wallet.Message{msg})
+	if err != nil {
+		return "", fmt.Errorf("tx failed: %w", err)
+	}
+	return hex.EncodeToString(tx.Hash), nil
+}
@@ -0,0 +1,111 @@
+package ton
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"ton-storage-s3-cli/internal/models"
+
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-storage-provider/pkg/contract"
+	"github.com/xssnick/tonutils-storage/provider"
+)
+
+// ErrSpendLimit is returned by HireProvider when the spend limit of a hire
+// does not pay for even one storage proof of the provider.
+var ErrSpendLimit = errors.New("spend limit is too low for the provider rate")
+
+// contractFeeNano is sent on top of what storage costs, for the deployment of
+// the contract and the fees of its messages.
+const contractFeeNano = 50_000_000
+
+// Funding is how a provider is paid when hired for a bag.
+type Funding struct {
+	Days    int   // how long to pay for storage
+	MaxNano int64 // spend limit of one hire, 0 = none
+}
+
+// BucketFunding returns how providers are paid for the bags of a bucket with
+// settings s, falling back to defaults for what the bucket does not set.
+func BucketFunding(s *models.BucketSettings, defaults Funding) Funding {
+	f := defaults
+	if s.StorageDays > 0 {
+		f.Days = s.StorageDays
+	}
+	if s.MaxFundingNano > 0 {
+		f.MaxNano = s.MaxFundingNano
+	}
+	return f
+}
+
+// Hire is a provider hired for a bag by HireProvider.
+type Hire struct {
+	ContractAddr string
+	Amount       tlb.Coins  // sent to the contract
+	ExpiresAt    *time.Time // when the contract runs out paying all its providers, nil if none is paid
+}
+
+// fundingAmount returns how much to send to hire a provider with offer under
+// funding. Without a spend limit it is funding.Days of storage; with one, as
+// much storage as the limit pays for.
+func fundingAmount(offer provider.Offer, funding Funding) (*big.Int, error) {
+	perDay := offer.PerDayNano
+	if perDay == nil || perDay.Sign() <= 0 {
+		return big.NewInt(contractFeeNano), nil
+	}
+
+	storage := new(big.Int).Mul(perDay, big.NewInt(int64(funding.Days)))
+	if funding.MaxNano > 0 {
+		limit := big.NewInt(funding.MaxNano - contractFeeNano)
+		if storage.Cmp(limit) > 0 {
+			storage = limit
+		}
+	}
+
+	if storage.Sign() <= 0 || (offer.PerProofNano != nil && storage.Cmp(offer.PerProofNano) < 0) {
+		return nil, fmt.Errorf("%w: one proof costs %s nanoTON", ErrSpendLimit, offer.PerProofNano)
+	}
+
+	return new(big.Int).Add(storage, big.NewInt(contractFeeNano)), nil
+}
+
+// spendableNano returns what a contract holding balance can spend on
+// storage: neither what its providers earned and were not paid yet, nor the
+// fees each earlier hire sent along.
+func spendableNano(balance tlb.Coins, providers []contract.ProviderDataV1, size uint64) *big.Int {
+	now := time.Now()
+	spendable := new(big.Int).Set(balance.Nano())
+	for _, p := range providers {
+		_, accrued := providerEarnings(p, size, now)
+		spendable.Sub(spendable, accrued)
+		spendable.Sub(spendable, big.NewInt(contractFeeNano))
+	}
+	if spendable.Sign() < 0 {
+		spendable.SetInt64(0)
+	}
+	return spendable
+}
+
+// contractExpiry returns when balanceNano runs out on a contract for a bag of
+// size bytes paying all of providers, nil if none of them is paid.
+func contractExpiry(balanceNano *big.Int, providers []provider.NewProviderData, size uint64) *time.Time {
+	const mb = 1 << 20
+
+	perDay := new(big.Int)
+	for _, p := range providers {
+		perDay.Add(perDay, new(big.Int).Mul(p.PricePerMBDay.Nano(), new(big.Int).SetUint64(size)))
+	}
+	perDay.Quo(perDay, big.NewInt(mb))
+	if perDay.Sign() <= 0 {
+		return nil
+	}
+
+	// Storage is paid by the second: the balance lasts balance / perDay days.
+	seconds := new(big.Int).Mul(balanceNano, big.NewInt(int64(24*time.Hour/time.Second)))
+	seconds.Quo(seconds, perDay)
+
+	expiresAt := time.Now().Add(secondsDuration(seconds))
+	return &expiresAt
+}
@@ -2,44 +2,102 @@ package ton
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"strings"
-	"math/rand"
-	"time"
+
+	"ton-storage-s3-cli/internal/models"
 )
 
-var KnownProviders = []string{
-	"94059ff6f0e534b571797a41d2203c500b305e924333ff2264ae20ca0976f9f7",
-	"0f40a7b9c0d22294214bfee73a31051189b7728ac006b9264c8e963d18279c34",
-	"7a156635aeae3a97e2947ba88385390e7aefbb70d789d2f6916c9423d4697f3a",
-}
+// ErrRateTooHigh is returned by HireProvider when a provider asks more than
+// the bucket of the bag is willing to pay.
+var ErrRateTooHigh = errors.New("provider rate is above the bucket limit")
 
+// ErrNoProvider is returned by SelectProvider when every provider the policy
+// allows already stores the bag or cannot take it.
+var ErrNoProvider = errors.New("no unused provider is allowed by the bucket policy")
 
-func (s *Service) FindRandomProvider(ctx context.Context, exclude []string) (string, error) {
+// ErrNoProbeBag is returned by ProbeProvider while the node has no bag to ask
+// providers for their rates with.
+var ErrNoProbeBag = errors.New("no local bag to probe providers with")
 
-	excludedMap := make(map[string]bool)
-	for _, addr := range exclude {
-		if len(addr) > 64 && strings.Contains(addr, ":") {
-			parts := strings.Split(addr, ":")
-			if len(parts) == 2 {
-				excludedMap[parts[1]] = true
-			}
-		} else {
-			excludedMap[addr] = true
+// ProviderPolicy restricts the providers the bags of a bucket are hired from.
+type ProviderPolicy struct {
+	Allowed		[]string	// keys of the only providers to hire, empty = any
+	Blocked		[]string
+	MaxRateNano	int64		// highest price per MB per day, 0 = any
+	Strategy	SelectionStrategy	// nil = DefaultStrategy
+}
+
+// BucketPolicy returns the providers the bags of a bucket with settings s may
+// be hired from.
+func BucketPolicy(s *models.BucketSettings) ProviderPolicy {
+	return ProviderPolicy{
+		Allowed:	s.AllowedProviders,
+		Blocked:	s.BlockedProviders,
+		MaxRateNano:	s.MaxRateNano,
+		Strategy:	StrategyByName(s.SelectionStrategy),
+	}
+}
+
+// ProviderKey returns the hex key of a provider given either as a key or as
+// a "workchain:key" address.
+func ProviderKey(addr string) string {
+	if len(addr) > 64 && strings.Contains(addr, ":") {
+		parts := strings.Split(addr, ":")
+		if len(parts) == 2 {
+			return parts[1]
 		}
 	}
+	return addr
+}
 
-	var candidates []string
-	for _, provider := range KnownProviders {
-		if !excludedMap[provider] {
-			candidates = append(candidates, provider)
+// ParseProviderKey returns the key of a provider given as by ProviderKey,
+// in lower case, and fails if it is not a 32-byte hex key.
+func ParseProviderKey(addr string) (string, error) {
+	key := strings.ToLower(ProviderKey(addr))
+	if raw, err := hex.DecodeString(key); err != nil || len(raw) != 32 {
+		return "", fmt.Errorf("invalid provider key %q", addr)
+	}
+	return key, nil
+}
+
+// ProbeProvider asks a provider for its rates, quoted for the smallest bag the
+// node has, and returns what it advertised with the status it implies.
+func (s *Service) ProbeProvider(ctx context.Context, key string) (*models.Provider, error) {
+	provKey, err := hex.DecodeString(key)
+	if err != nil || len(provKey) != 32 {
+		return nil, fmt.Errorf("invalid provider key %q", key)
+	}
+
+	var probeBag []byte
+	var probeSize uint64
+	for _, t := range s.storage.GetAll() {
+		if t.Info != nil && (probeBag == nil || t.Info.FileSize < probeSize) {
+			probeBag, probeSize = t.BagID, t.Info.FileSize
 		}
 	}
+	if probeBag == nil {
+		return nil, ErrNoProbeBag
+	}
 
-	if len(candidates) == 0 {
-		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-		return KnownProviders[rng.Intn(len(KnownProviders))], nil
+	rates, err := s.providerClient.FetchProviderRates(ctx, probeBag, provKey)
+	if err != nil {
+		return nil, err
 	}
 
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	return candidates[rng.Intn(len(candidates))], nil
-}
\ No newline at end of file
+	p := &models.Provider{
+		Key:		key,
+		Status:		"active",
+		RateNano:	rates.RatePerMBDay.Nano().Int64(),
+		MinBountyNano:	rates.MinBounty.Nano().Int64(),
+		MaxBagBytes:	int64(rates.SpaceAvailableMB) << 20,
+		MinSpan:	rates.MinSpan,
+		MaxSpan:	rates.MaxSpan,
+	}
+	if !rates.Available {
+		p.Status = "unavailable"
+	}
+	return p, nil
+}
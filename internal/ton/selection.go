@@ -0,0 +1,204 @@
+package ton
+
+import (
+	"cmp"
+	"math"
+	"math/rand"
+	"slices"
+	"time"
+
+	"ton-storage-s3-cli/internal/models"
+)
+
+// Provider selection strategies a bucket may choose.
+const (
+	StrategyCheapest = "cheapest" // lowest price per MB per day first
+	StrategyReliable = "reliable" // best audited uptime first
+	StrategyWeighted = "weighted" // at random, weighted by uptime and price
+)
+
+// DefaultStrategy is the strategy of buckets that did not choose one.
+const DefaultStrategy = StrategyWeighted
+
+// hireFailureWindow is how long a failed hire counts against a provider.
+const hireFailureWindow = 24 * time.Hour
+
+// unknownRateFactor is the price weight of providers not probed yet, which
+// the weighted strategy treats as costing twice the cheapest known rate.
+const unknownRateFactor = 0.5
+
+// SelectionStrategy orders the providers a bag may be hired from, best first.
+// Rank gets the providers the bucket policy allows and that have room for
+// the bag, and must not modify the slice.
+type SelectionStrategy interface {
+	Rank(candidates []models.Provider) []models.Provider
+}
+
+var strategies = map[string]SelectionStrategy{
+	StrategyCheapest: cheapest{},
+	StrategyReliable: reliable{},
+	StrategyWeighted: weightedRandom{},
+}
+
+// ValidStrategy reports whether name is a selection strategy; "" stands for
+// DefaultStrategy.
+func ValidStrategy(name string) bool {
+	_, ok := strategies[name]
+	return ok || name == ""
+}
+
+// StrategyByName returns the selection strategy called name, DefaultStrategy
+// if there is none.
+func StrategyByName(name string) SelectionStrategy {
+	if s, ok := strategies[name]; ok {
+		return s
+	}
+	return strategies[DefaultStrategy]
+}
+
+// SelectProvider chooses, by the strategy of policy, one of candidates, the
+// providers that can be hired, that policy allows, that is not in exclude
+// and that has room for bagSize bytes.
+func SelectProvider(candidates []models.Provider, exclude []string, bagSize int64, policy ProviderPolicy) (string, error) {
+	excludedMap := make(map[string]bool)
+	for _, addr := range exclude {
+		excludedMap[ProviderKey(addr)] = true
+	}
+	for _, addr := range policy.Blocked {
+		excludedMap[ProviderKey(addr)] = true
+	}
+	allowedMap := make(map[string]bool)
+	for _, addr := range policy.Allowed {
+		allowedMap[ProviderKey(addr)] = true
+	}
+
+	var eligible []models.Provider
+	for _, p := range candidates {
+		if excludedMap[p.Key] || (len(allowedMap) > 0 && !allowedMap[p.Key]) {
+			continue
+		}
+		if policy.MaxRateNano > 0 && p.RateNano > policy.MaxRateNano {
+			continue
+		}
+		if p.MaxBagBytes > 0 && p.MaxBagBytes < bagSize {
+			continue
+		}
+		eligible = append(eligible, p)
+	}
+
+	if len(eligible) == 0 {
+		return "", ErrNoProvider
+	}
+
+	strategy := policy.Strategy
+	if strategy == nil {
+		strategy = StrategyByName(DefaultStrategy)
+	}
+	return strategy.Rank(eligible)[0].Key, nil
+}
+
+// uptime returns the share of audits a provider passed, counting one passed
+// and one failed audit more so that providers without history rank between
+// good and bad ones.
+func uptime(p *models.Provider) float64 {
+	return float64(p.AuditsPassed+1) / float64(p.AuditsPassed+p.AuditsFailed+2)
+}
+
+// recentHireFailures returns how many hires of a provider failed in a row,
+// if the last of them is recent.
+func recentHireFailures(p *models.Provider, now time.Time) int {
+	if p.LastHireFailureAt == nil || now.Sub(*p.LastHireFailureAt) > hireFailureWindow {
+		return 0
+	}
+	return p.HireFailures
+}
+
+// reliability scores a provider by its uptime, halved for each recent hire
+// failure.
+func reliability(p *models.Provider, now time.Time) float64 {
+	return uptime(p) / math.Pow(2, float64(recentHireFailures(p, now)))
+}
+
+// compareRates orders providers by price, those not probed yet last.
+func compareRates(a, b *models.Provider) int {
+	if (a.RateNano == 0) != (b.RateNano == 0) {
+		if a.RateNano == 0 {
+			return 1
+		}
+		return -1
+	}
+	return cmp.Compare(a.RateNano, b.RateNano)
+}
+
+func sortedProviders(candidates []models.Provider, compare func(a, b *models.Provider) int) []models.Provider {
+	sorted := slices.Clone(candidates)
+	slices.SortStableFunc(sorted, func(a, b models.Provider) int { return compare(&a, &b) })
+	return sorted
+}
+
+// cheapest hires the provider with the lowest rate among those whose last
+// hire did not fail recently, breaking ties by reliability.
+type cheapest struct{}
+
+func (cheapest) Rank(candidates []models.Provider) []models.Provider {
+	now := time.Now()
+	return sortedProviders(candidates, func(a, b *models.Provider) int {
+		failedA, failedB := recentHireFailures(a, now) > 0, recentHireFailures(b, now) > 0
+		if failedA != failedB {
+			if failedA {
+				return 1
+			}
+			return -1
+		}
+		if c := compareRates(a, b); c != 0 {
+			return c
+		}
+		return cmp.Compare(reliability(b, now), reliability(a, now))
+	})
+}
+
+// reliable hires the provider with the best reliability, breaking ties by
+// rate.
+type reliable struct{}
+
+func (reliable) Rank(candidates []models.Provider) []models.Provider {
+	now := time.Now()
+	return sortedProviders(candidates, func(a, b *models.Provider) int {
+		if c := cmp.Compare(reliability(b, now), reliability(a, now)); c != 0 {
+			return c
+		}
+		return compareRates(a, b)
+	})
+}
+
+// weightedRandom draws providers at random with weights proportional to their
+// reliability and to how cheap they are relative to the cheapest candidate,
+// spreading bags over providers while favouring good ones.
+type weightedRandom struct{}
+
+func (weightedRandom) Rank(candidates []models.Provider) []models.Provider {
+	now := time.Now()
+
+	var cheapestRate int64
+	for _, p := range candidates {
+		if p.RateNano > 0 && (cheapestRate == 0 || p.RateNano < cheapestRate) {
+			cheapestRate = p.RateNano
+		}
+	}
+
+	// Weighted sampling without replacement: sorting by u^(1/w) for uniform
+	// u draws providers in proportion to their weights w.
+	keys := make(map[string]float64, len(candidates))
+	for i := range candidates {
+		p := &candidates[i]
+		priceFactor := unknownRateFactor
+		if p.RateNano > 0 {
+			priceFactor = float64(cheapestRate) / float64(p.RateNano)
+		}
+		keys[p.Key] = math.Pow(rand.Float64(), 1/(reliability(p, now)*priceFactor))
+	}
+
+	return sortedProviders(candidates, func(a, b *models.Provider) int {
+		return cmp.Compare(keys[b.Key], keys[a.Key])
+	})
+}
@@ -0,0 +1,432 @@
+package ton
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/xssnick/tonutils-storage/storage"
+)
+
+// pieceReadahead bounds how many pieces a stream fetches ahead of its reader,
+// so a slow client holds back the download instead of filling memory.
+const pieceReadahead = 16
+
+// pieceWaitTimeout is how long a stream waits for a single piece.
+const pieceWaitTimeout = 10 * time.Minute
+
+// downloadStallTimeout is how long WaitForFile waits for a file whose download
+// makes no progress.
+const downloadStallTimeout = 10 * time.Minute
+
+// pieceCacheDirName holds, under the downloads path, pieces of offloaded bags
+// fetched for range reads: .pieces/<bag id>/<piece>.
+const pieceCacheDirName = ".pieces"
+
+var errIncompleteFile = errors.New("file is not fully downloaded")
+
+// waitForHeader waits until the header of a bag is known, i.e. the torrent
+// has been added and its file index resolved from the network.
+func (s *Service) waitForHeader(ctx context.Context, bagID []byte) (*storage.Torrent, error) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if tor := s.storage.GetTorrent(bagID); tor != nil && tor.Header != nil && tor.Info != nil {
+			return tor, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("bag header not resolved: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func hasPiece(mask []byte, id uint32) bool {
+	i := id / 8
+	return int(i) < len(mask) && mask[i]&(1<<(id%8)) != 0
+}
+
+// filePieces returns the pieces holding the data of a file.
+func filePieces(info *storage.FileInfo) (uint32, uint32) {
+	last := info.ToPiece
+	if info.ToPieceOffset == 0 && last > info.FromPiece {
+		last--
+	}
+	return info.FromPiece, last
+}
+
+// fileComplete reports whether every piece of a file has been verified.
+func fileComplete(tor *storage.Torrent, info *storage.FileInfo) bool {
+	mask := tor.PiecesMask()
+	from, to := filePieces(info)
+	for id := from; id <= to; id++ {
+		if !hasPiece(mask, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// filePiecesDone returns how many pieces of a file in a bag are verified, or
+// -1 while the header of the bag is not resolved yet.
+func (s *Service) filePiecesDone(bagID []byte, filename string) int {
+	tor := s.storage.GetTorrent(bagID)
+	if tor == nil || tor.Header == nil || tor.Info == nil {
+		return -1
+	}
+	info, err := tor.GetFileOffsets(filename)
+	if err != nil {
+		return -1
+	}
+
+	mask := tor.PiecesMask()
+	from, to := filePieces(info)
+	done := 0
+	for id := from; id <= to; id++ {
+		if hasPiece(mask, id) {
+			done++
+		}
+	}
+	return done
+}
+
+// BagFileReader reads a byte range of a file while its bag may still be
+// downloading. Pieces the piece mask marks as verified are read from disk;
+// the missing ones are fetched from peers in order, ahead of the bag's own
+// download, and handed over as soon as their proof checks out. Readers with a
+// piece cache keep the fetched pieces there and read them back from it.
+type BagFileReader struct {
+	tor       *storage.Torrent
+	path      string
+	file      *os.File
+	fileStart uint64 // offset of the file in the bag
+	pieceSize uint64
+
+	offset uint64 // next byte, as an offset in the bag
+	end    uint64
+
+	cacheDir     string
+	cached       map[uint32]bool
+	fetchedBytes int64
+
+	fetch   *storage.PreFetcher
+	fetched map[uint32]bool
+	piece   []byte
+	pieceID uint32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// OpenBagFile opens length bytes at offset of a file in a bag that is being
+// downloaded. The download must have been started with DownloadBag or
+// DownloadBagFile.
+func (s *Service) OpenBagFile(ctx context.Context, bagID []byte, filename string, offset, length int64) (*BagFileReader, error) {
+	return s.openBagFile(ctx, bagID, filename, offset, length, "")
+}
+
+// ReadBagRange opens length bytes at offset of a file in a bag that is not
+// stored locally, without downloading the rest of the bag. Only the header
+// and the pieces covering the range are fetched; the pieces are kept in the
+// piece cache until DropPieceCache.
+func (s *Service) ReadBagRange(ctx context.Context, bagID []byte, filename string, offset, length int64) (*BagFileReader, error) {
+	if err := s.resolveBag(bagID); err != nil {
+		return nil, err
+	}
+	return s.openBagFile(ctx, bagID, filename, offset, length, s.pieceCacheDir(bagID))
+}
+
+// resolveBag adds a bag to the storage without downloading its files, which
+// connects it to peers and fetches its header.
+func (s *Service) resolveBag(bagID []byte) error {
+	if tor := s.storage.GetTorrent(bagID); tor != nil {
+		if active, _ := tor.IsActive(); active {
+			return nil
+		}
+		if err := tor.Start(true, false, false); err != nil {
+			return fmt.Errorf("failed to restart torrent: %w", err)
+		}
+		return nil
+	}
+
+	savePath := filepath.Join(s.config.DownloadsPath, hex.EncodeToString(bagID))
+	if err := os.MkdirAll(savePath, 0755); err != nil {
+		return fmt.Errorf("failed to create dir: %w", err)
+	}
+
+	tor := storage.NewTorrent(savePath, s.storage, s.connector)
+	tor.BagID = bagID
+
+	if err := tor.Start(true, false, false); err != nil {
+		return fmt.Errorf("failed to start new torrent: %w", err)
+	}
+	if err := s.storage.SetTorrent(tor); err != nil {
+		return fmt.Errorf("failed to set torrent to storage: %w", err)
+	}
+	return nil
+}
+
+// DownloadBagFile downloads one file of a bag, such as an object of a pack,
+// without the rest of the bag. Files requested before keep downloading.
+func (s *Service) DownloadBagFile(ctx context.Context, bagID []byte, filename string) error {
+	if err := s.resolveBag(bagID); err != nil {
+		return err
+	}
+
+	headerCtx, cancel := context.WithTimeout(ctx, pieceWaitTimeout)
+	tor, err := s.waitForHeader(headerCtx, bagID)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	if tor.Header.FilesCount <= 1 {
+		return tor.Start(true, true, false)
+	}
+
+	info, err := tor.GetFileOffsets(filename)
+	if err != nil {
+		return fmt.Errorf("file %s not found in bag: %w", filename, err)
+	}
+	active := tor.GetActiveFilesIDs()
+	if slices.Contains(active, info.Index) {
+		return nil
+	}
+	return tor.SetActiveFilesIDs(append(slices.Clone(active), info.Index))
+}
+
+func (s *Service) pieceCacheDir(bagID []byte) string {
+	return filepath.Join(s.config.DownloadsPath, pieceCacheDirName, hex.EncodeToString(bagID))
+}
+
+// DropPieceCache removes the cached pieces of a bag. A torrent left behind by
+// range reads is removed with them; complete bags stay.
+func (s *Service) DropPieceCache(bagID []byte) error {
+	if err := os.RemoveAll(s.pieceCacheDir(bagID)); err != nil {
+		return fmt.Errorf("failed to remove piece cache: %w", err)
+	}
+
+	tor := s.storage.GetTorrent(bagID)
+	if tor == nil || (tor.Info != nil && tor.IsCompleted()) {
+		return nil
+	}
+	if err := s.storage.RemoveTorrent(tor, true); err != nil {
+		return fmt.Errorf("failed to remove torrent: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) openBagFile(ctx context.Context, bagID []byte, filename string, offset, length int64, cacheDir string) (*BagFileReader, error) {
+	if !filepath.IsLocal(filename) {
+		return nil, fmt.Errorf("invalid file name in bag: %q", filename)
+	}
+
+	headerCtx, cancelHeader := context.WithTimeout(ctx, pieceWaitTimeout)
+	tor, err := s.waitForHeader(headerCtx, bagID)
+	cancelHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := tor.GetFileOffsets(filename)
+	if err != nil {
+		return nil, fmt.Errorf("file %s not found in bag: %w", filename, err)
+	}
+	if offset < 0 || length < 0 || uint64(offset+length) > info.Size {
+		return nil, fmt.Errorf("range %d+%d is out of file size %d", offset, length, info.Size)
+	}
+
+	pieceSize := uint64(tor.Info.PieceSize)
+	fileStart := uint64(info.FromPiece)*pieceSize + uint64(info.FromPieceOffset)
+
+	r := &BagFileReader{
+		tor:       tor,
+		path:      filepath.Join(tor.Path, string(tor.Header.DirName), filename),
+		fileStart: fileStart,
+		pieceSize: pieceSize,
+		offset:    fileStart + uint64(offset),
+		end:       fileStart + uint64(offset+length),
+		cacheDir:  cacheDir,
+		cached:    map[uint32]bool{},
+		fetched:   map[uint32]bool{},
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+
+	if length == 0 {
+		return r, nil
+	}
+
+	// Fetch the missing pieces of the range ourselves, so the reader does not
+	// wait for the download to reach them
+	mask := tor.PiecesMask()
+	pieces := make([]byte, tor.Info.PiecesNum())
+	for id := uint32(r.offset / pieceSize); id <= uint32((r.end-1)/pieceSize); id++ {
+		switch {
+		case hasPiece(mask, id):
+		case cacheDir != "" && fileExists(r.cachePath(id)):
+			r.cached[id] = true
+		default:
+			pieces[id] = 1
+			r.fetched[id] = true
+		}
+	}
+	if len(r.fetched) > 0 {
+		if cacheDir != "" {
+			if err := os.MkdirAll(cacheDir, 0755); err != nil {
+				r.cancel()
+				return nil, fmt.Errorf("failed to create piece cache: %w", err)
+			}
+		}
+		r.fetch = storage.NewPreFetcher(r.ctx, tor, func(storage.Event) {}, pieceReadahead, pieces)
+	}
+
+	return r, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (r *BagFileReader) Read(p []byte) (int, error) {
+	if r.offset >= r.end {
+		return 0, io.EOF
+	}
+
+	id := uint32(r.offset / r.pieceSize)
+	within := r.offset - uint64(id)*r.pieceSize
+	n := min(uint64(len(p)), r.pieceSize-within, r.end-r.offset)
+
+	var err error
+	switch {
+	case r.fetched[id]:
+		err = r.readFetched(p[:n], id, within)
+	case r.cached[id]:
+		err = r.readCached(p[:n], id, within)
+	default:
+		err = r.readLocal(p[:n])
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	r.offset += n
+	return int(n), nil
+}
+
+// FetchedBytes is the amount of piece data the reader pulled from the network.
+func (r *BagFileReader) FetchedBytes() int64 {
+	return r.fetchedBytes
+}
+
+func (r *BagFileReader) readFetched(p []byte, id uint32, within uint64) error {
+	if r.piece == nil || r.pieceID != id {
+		r.releasePiece()
+
+		ctx, cancel := context.WithTimeout(r.ctx, pieceWaitTimeout)
+		data, _, err := r.fetch.WaitGet(ctx, id)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to fetch piece %d: %w", id, err)
+		}
+		r.piece, r.pieceID = data, id
+		r.fetchedBytes += int64(len(data))
+
+		if r.cacheDir != "" {
+			if err := r.cachePiece(id, data); err != nil {
+				log.Printf("⚠️ Failed to cache piece %d of bag %s: %v", id, hex.EncodeToString(r.tor.BagID), err)
+			}
+		}
+	}
+
+	return r.copyPiece(p, within)
+}
+
+func (r *BagFileReader) readCached(p []byte, id uint32, within uint64) error {
+	if r.piece == nil || r.pieceID != id {
+		r.releasePiece()
+
+		data, err := os.ReadFile(r.cachePath(id))
+		if err != nil {
+			return fmt.Errorf("failed to read cached piece %d: %w", id, err)
+		}
+		r.piece, r.pieceID = data, id
+	}
+
+	return r.copyPiece(p, within)
+}
+
+// releasePiece drops the current piece; fetched pieces are handed back to the
+// fetcher, which frees a slot for the next one.
+func (r *BagFileReader) releasePiece() {
+	if r.piece != nil && r.fetched[r.pieceID] {
+		r.fetch.Free(r.pieceID)
+	}
+	r.piece = nil
+}
+
+func (r *BagFileReader) copyPiece(p []byte, within uint64) error {
+	if within+uint64(len(p)) > uint64(len(r.piece)) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(p, r.piece[within:])
+	return nil
+}
+
+func (r *BagFileReader) cachePath(id uint32) string {
+	return filepath.Join(r.cacheDir, strconv.FormatUint(uint64(id), 10))
+}
+
+// cachePiece stores a verified piece. It is written aside and renamed, so a
+// cached piece is always whole.
+func (r *BagFileReader) cachePiece(id uint32, data []byte) error {
+	tmp, err := os.CreateTemp(r.cacheDir, ".piece-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.cachePath(id))
+}
+
+func (r *BagFileReader) readLocal(p []byte) error {
+	if r.file == nil {
+		f, err := os.Open(r.path)
+		if err != nil {
+			return err
+		}
+		r.file = f
+	}
+
+	_, err := r.file.ReadAt(p, int64(r.offset-r.fileStart))
+	return err
+}
+
+func (r *BagFileReader) Close() error {
+	r.cancel()
+	if r.fetch != nil {
+		r.fetch.Stop()
+	}
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
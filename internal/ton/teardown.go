@@ -0,0 +1,133 @@
+package ton
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/ton"
+	"github.com/xssnick/tonutils-go/ton/wallet"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+	"github.com/xssnick/tonutils-storage-provider/pkg/contract"
+)
+
+// opWithdraw is the op of the message the owner of a storage contract takes
+// its balance back with, as built by contract.PrepareWithdrawalRequest.
+const opWithdraw = 0x61fff683
+
+// scanPageSize is how many wallet transactions are read per request.
+const scanPageSize = 16
+
+// OwnedContract is a storage contract owned by our wallet.
+type OwnedContract struct {
+	ContractAddr string
+	BagID        string // hex
+}
+
+// WithdrawContract takes the balance of a storage contract back to our wallet.
+// Unlike WithdrawAllFunds it needs only the address of the contract, not the
+// bag, which is usually gone from the node by then.
+func (s *Service) WithdrawContract(ctx context.Context, contractAddr string) (string, error) {
+	addr, err := address.ParseAddr(contractAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid contract address: %w", err)
+	}
+
+	msg := &wallet.Message{
+		Mode: 1,
+		InternalMessage: &tlb.InternalMessage{
+			IHRDisabled: true,
+			Bounce:      true,
+			DstAddr:     addr,
+			Amount:      tlb.MustFromTON("0.05"),
+			Body:        cell.BeginCell().MustStoreUInt(opWithdraw, 32).MustStoreUInt(0, 64).EndCell(),
+		},
+	}
+
+	tx, _, err := s.wallet.SendManyWaitTransaction(ctx, []*wallet.Message{msg})
+	if err != nil {
+		return "", fmt.Errorf("tx failed: %w", err)
+	}
+	return hex.EncodeToString(tx.Hash), nil
+}
+
+// WalletAddress returns the address of our wallet, which owns the storage
+// contracts.
+func (s *Service) WalletAddress() string {
+	return s.wallet.Address().String()
+}
+
+// ScanOwnedContracts walks the transactions of our wallet newer than afterLT
+// and returns the storage contracts we own among the destinations of our
+// messages, with the logical time of the newest transaction to continue
+// from next time.
+func (s *Service) ScanOwnedContracts(ctx context.Context, afterLT uint64) ([]OwnedContract, uint64, error) {
+	owner := s.wallet.Address()
+
+	master, err := s.api.CurrentMasterchainInfo(ctx)
+	if err != nil {
+		return nil, afterLT, fmt.Errorf("failed to fetch master block: %w", err)
+	}
+	acc, err := s.api.WaitForBlock(master.SeqNo).GetAccount(ctx, master, owner)
+	if err != nil {
+		return nil, afterLT, fmt.Errorf("failed to fetch wallet: %w", err)
+	}
+	if acc.LastTxLT <= afterLT {
+		return nil, afterLT, nil
+	}
+
+	destinations := make(map[string]*address.Address)
+	lt, hash := acc.LastTxLT, acc.LastTxHash
+	for lt > afterLT {
+		list, err := s.api.ListTransactions(ctx, owner, scanPageSize, lt, hash)
+		if errors.Is(err, ton.ErrNoTransactionsWereFound) {
+			break
+		}
+		if err != nil {
+			return nil, afterLT, fmt.Errorf("failed to list wallet transactions: %w", err)
+		}
+
+		for _, tx := range list {
+			if tx.LT <= afterLT || tx.IO.Out == nil {
+				continue
+			}
+			msgs, err := tx.IO.Out.ToSlice()
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				if m.MsgType == tlb.MsgTypeInternal {
+					dst := m.AsInternal().DstAddr
+					destinations[dst.String()] = dst
+				}
+			}
+		}
+
+		lt, hash = list[0].PrevTxLT, list[0].PrevTxHash
+	}
+
+	var owned []OwnedContract
+	for addrStr, addr := range destinations {
+		if ctx.Err() != nil {
+			return nil, afterLT, ctx.Err()
+		}
+		// Anything that is not a deployed storage contract fails the get
+		// method; other errors are retried by the next scan.
+		info, err := contract.GetStorageInfoV1(ctx, s.api, master, addr)
+		var execErr ton.ContractExecError
+		if errors.As(err, &execErr) {
+			continue
+		}
+		if err != nil {
+			return nil, afterLT, err
+		}
+		if info.OwnerAddr == nil || !info.OwnerAddr.Equals(owner) {
+			continue
+		}
+		owned = append(owned, OwnedContract{ContractAddr: addrStr, BagID: hex.EncodeToString(info.TorrentHash)})
+	}
+	return owned, acc.LastTxLT, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/ed25519"
 	"encoding/hex"
+	"math/big"
 	"math/bits"
 	"fmt"
 	"log"
@@ -248,7 +249,11 @@ func (s *Service) GetAllBagsFullStatus() ([]BagFullStatus, error) {
 
 
 
-func (s *Service) HireProvider(ctx context.Context, bagID []byte, providerAddrStr string, amount tlb.Coins) (string, error) {
+// HireProvider adds a provider to the storage contract of a bag, deploying it
+// if needed, and sends it what storage at the provider's rate costs under
+// funding. Providers asking more than maxRateNano per MB per day (0 = any
+// rate) are not hired: ErrRateTooHigh.
+func (s *Service) HireProvider(ctx context.Context, bagID []byte, providerAddrStr string, funding Funding, maxRateNano int64) (*Hire, error) {
 	var provAddr *address.Address
 	var err error
 
@@ -264,19 +269,28 @@ func (s *Service) HireProvider(ctx context.Context, bagID []byte, providerAddrSt
 	}
 
 	if err != nil || provAddr == nil {
-		return "", fmt.Errorf("invalid provider address: %w", err)
+		return nil, fmt.Errorf("invalid provider address: %w", err)
 	}
 
 	rates, err := s.providerClient.FetchProviderRates(ctx, bagID, provAddr.Data())
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch rates: %w", err)
+		return nil, fmt.Errorf("failed to fetch rates: %w", err)
 	}
 
 	if !rates.Available {
-		return "", fmt.Errorf("provider is not accepting requests")
+		return nil, fmt.Errorf("provider is not accepting requests")
 	}
 
 	offer := provider.CalculateBestProviderOffer(rates)
+	if maxRateNano > 0 && offer.RatePerMBNano.Cmp(big.NewInt(maxRateNano)) > 0 {
+		return nil, fmt.Errorf("%w: %s nanoTON per MB per day", ErrRateTooHigh, offer.RatePerMBNano)
+	}
+
+	amountNano, err := fundingAmount(offer, funding)
+	if err != nil {
+		return nil, err
+	}
+	amount := tlb.FromNanoTON(amountNano)
 
 	newProviderData := provider.NewProviderData{
 		Address:       provAddr,
@@ -286,12 +300,17 @@ func (s *Service) HireProvider(ctx context.Context, bagID []byte, providerAddrSt
 
 	providersList := []provider.NewProviderData{newProviderData}
 
+	// The contract pays all its providers from one balance: what it can
+	// still spend of what is on it, and the new amount less the fees
+	balanceNano := new(big.Int).Sub(amountNano, big.NewInt(contractFeeNano))
+
 	contractData, err := s.providerClient.FetchProviderContract(ctx, bagID, s.wallet.Address())
 	if err != nil {
 		if !errors.Is(err, contract.ErrNotDeployed) {
-			return "", fmt.Errorf("failed to fetch contract info: %w", err)
+			return nil, fmt.Errorf("failed to fetch contract info: %w", err)
 		}
 	} else {
+		balanceNano.Add(balanceNano, spendableNano(contractData.Balance, contractData.Providers, contractData.Size))
 		for _, p := range contractData.Providers {
 			if bytes.Equal(p.Key, provAddr.Data()) {
 				continue
@@ -306,24 +325,24 @@ func (s *Service) HireProvider(ctx context.Context, bagID []byte, providerAddrSt
 
 	contractAddr, body, stateInit, err := s.providerClient.BuildAddProviderTransaction(ctx, bagID, s.wallet.Address(), providersList)
 	if err != nil {
-		return "", fmt.Errorf("failed to build tx: %w", err)
+		return nil, fmt.Errorf("failed to build tx: %w", err)
 	}
 
 	bodyCell, err := cell.FromBOC(body)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse body boc: %w", err)
+		return nil, fmt.Errorf("failed to parse body boc: %w", err)
 	}
 
 	var stateInitStruct *tlb.StateInit
 	if len(stateInit) > 0 {
 		siCell, err := cell.FromBOC(stateInit)
 		if err != nil {
-			return "", fmt.Errorf("failed to parse stateInit boc: %w", err)
+			return nil, fmt.Errorf("failed to parse stateInit boc: %w", err)
 		}
 		
 		stateInitStruct = &tlb.StateInit{}
 		if err := tlb.LoadFromCell(stateInitStruct, siCell.BeginParse()); err != nil {
-			return "", fmt.Errorf("failed to load stateInit: %w", err)
+			return nil, fmt.Errorf("failed to load stateInit: %w", err)
 		}
 	}
 
@@ -345,10 +364,14 @@ func (s *Service) HireProvider(ctx context.Context, bagID []byte, providerAddrSt
 
 	_, _, err = s.wallet.SendManyWaitTransaction(ctx, []*wallet.Message{msg})
 	if err != nil {
-		return "", fmt.Errorf("tx failed: %w", err)
+		return nil, fmt.Errorf("tx failed: %w", err)
 	}
 
-	return contractAddr.String(), nil
+	return &Hire{
+		ContractAddr:	contractAddr.String(),
+		Amount:		amount,
+		ExpiresAt:	contractExpiry(balanceNano, providersList, rates.Size),
+	}, nil
 }
 
 func (s *Service) DownloadBag(ctx context.Context, bagID []byte) error {
@@ -408,44 +431,64 @@ func parseAddressAny(addrStr string) (*address.Address, error) {
 	
 }
 
+// WaitForFile waits until every piece of a file in a downloading bag has been
+// verified, and returns its path. There is no deadline besides ctx: a large
+// file may take hours, so it gives up only once the download has made no
+// progress for downloadStallTimeout.
 func (s *Service) WaitForFile(ctx context.Context, bagID []byte, filename string) (string, error) {
-	bagHex := hex.EncodeToString(bagID)
-	
-	targetPath := filepath.Join(s.config.DownloadsPath, bagHex, filename)
-
-	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
-	defer cancel()
-
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 
+	progress := -1
+	lastProgress := time.Now()
 	for {
+		targetPath, err := s.GetPathToBagFile(bagID, filename)
+		if err == nil {
+			return targetPath, nil
+		}
+
+		if n := s.filePiecesDone(bagID, filename); n != progress {
+			progress, lastProgress = n, time.Now()
+		} else if time.Since(lastProgress) > downloadStallTimeout {
+			return "", fmt.Errorf("download of %s stalled for %s", filename, downloadStallTimeout)
+		}
+
 		select {
-		case <-timeoutCtx.Done():
-			return "", fmt.Errorf("timeout waiting for file download: %s", filename)
+		case <-ctx.Done():
+			return "", fmt.Errorf("waiting for file download %s: %w", filename, ctx.Err())
 		case <-ticker.C:
-			info, err := os.Stat(targetPath)
-			if err == nil && info.Size() > 0 {
-				return targetPath, nil
-			}
 		}
 	}
 }
 
+// GetPathToBagFile resolves a file of a locally known bag through the torrent
+// itself, so it works both for bags seeded from the staging store and for bags
+// downloaded from the network. Files with pieces still missing are reported
+// as incomplete.
 func (s *Service) GetPathToBagFile(bagID []byte, filename string) (string, error) {
-	bagHex := hex.EncodeToString(bagID)
+	if !filepath.IsLocal(filename) {
+		return "", fmt.Errorf("invalid file name in bag: %q", filename)
+	}
+
+	tor := s.storage.GetTorrent(bagID)
+	if tor == nil || tor.Header == nil || tor.Info == nil {
+		return "", os.ErrNotExist
+	}
 
-	targetPath := filepath.Join(s.config.DownloadsPath, bagHex, filename)
-	if _, err := os.Stat(targetPath); err == nil {
-		return targetPath, nil
+	info, err := tor.GetFileOffsets(filename)
+	if err != nil {
+		return "", err
+	}
+	if !fileComplete(tor, info) {
+		return "", errIncompleteFile
 	}
 
-	flatPath := filepath.Join(s.config.DownloadsPath, filename)
-	if _, err := os.Stat(flatPath); err == nil {
-		return flatPath, nil
+	targetPath := filepath.Join(tor.Path, string(tor.Header.DirName), filename)
+	if _, err := os.Stat(targetPath); err != nil {
+		return "", err
 	}
 
-	return "", os.ErrNotExist
+	return targetPath, nil
 }
 
 func (s *Service) GetTorrentStats(bagID []byte) (uploadSpeed uint64, uploadedTotal uint64, err error) {
@@ -495,6 +538,10 @@ func (s *Service) PingProvider(ctx context.Context, bagID []byte, providerKeyHex
 }
 
 func (s *Service) DeleteLocalFile(bagID []byte) error {
+	if err := os.RemoveAll(s.pieceCacheDir(bagID)); err != nil {
+		return fmt.Errorf("failed to remove piece cache: %w", err)
+	}
+
 	tor := s.storage.GetTorrent(bagID)
 	if tor == nil {
 		return nil